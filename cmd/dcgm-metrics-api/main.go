@@ -1,13 +1,18 @@
 package main
 
 import (
+	"errors"
 	"log"
+	"os"
 
 	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
 )
 
 func main() {
-	if err := cmd.Run(); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	if err := cmd.Execute(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		if errors.Is(err, cmd.ErrUsage) {
+			os.Exit(2)
+		}
+		log.Fatalf("Error: %v", err)
 	}
 }
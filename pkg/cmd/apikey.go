@@ -0,0 +1,357 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// APIKeyHeader is the request header carrying an API key, as an alternative to a bearer token
+const APIKeyHeader = "X-API-Key"
+
+// Authentication errors
+var (
+	ErrMissingCredentials = errors.New("missing API key or token")
+	ErrInvalidCredentials = errors.New("invalid API key")
+	ErrInvalidToken       = errors.New("invalid token")
+	ErrAccessDenied       = errors.New("access denied")
+)
+
+// APIAuthConfig configures the authentication of API clients.
+// Authentication is disabled when neither keys nor JWT are configured.
+type APIAuthConfig struct {
+	APIKeys []APIKey `yaml:"api_keys"`
+	// APIKeysFile is a YAML list of keys, e.g. a mounted secret, re-read when it changes
+	APIKeysFile string    `yaml:"api_keys_file"`
+	JWT         JWTConfig `yaml:"jwt"`
+}
+
+// APIKey is an API key with the endpoints and GPUs it gives access to
+type APIKey struct {
+	// ID identifies the key in the audit log; the key itself is never logged
+	ID string `yaml:"id"`
+	// Key is the secret, or KeySHA256 its hex-encoded SHA-256 digest
+	Key       string `yaml:"key"`
+	KeySHA256 string `yaml:"key_sha256"`
+	// Endpoints are the paths the key may call, with * matching one path
+	// segment as in /gpus/*; every endpoint when empty
+	Endpoints []string `yaml:"endpoints"`
+	// Admin gives access to the /admin endpoints, which no key has otherwise
+	Admin bool `yaml:"admin"`
+	// Hostnames and Namespaces restrict the GPUs returned to the key;
+	// every GPU when empty
+	Hostnames  []string `yaml:"hostnames"`
+	Namespaces []string `yaml:"namespaces"`
+
+	digest [sha256.Size]byte
+}
+
+// Identity is an authenticated client with the endpoints and GPUs it may access
+type Identity struct {
+	// ID names the client in the audit log: the key ID, or jwt: and the token subject
+	ID string
+	// Endpoints, Admin, Hostnames and Namespaces restrict the client as for an API key
+	Endpoints  []string
+	Admin      bool
+	Hostnames  []string
+	Namespaces []string
+}
+
+// Enabled reports whether API clients must authenticate
+func (c *APIAuthConfig) Enabled() bool {
+	return len(c.APIKeys) > 0 || c.APIKeysFile != "" || c.JWT.Enabled()
+}
+
+// applyEnv overrides the settings with the environment variables
+func (c *APIAuthConfig) applyEnv() error {
+	if v := os.Getenv("API_KEYS"); v != "" {
+		if err := yaml.Unmarshal([]byte(v), &c.APIKeys); err != nil {
+			return fmt.Errorf("failed to parse API_KEYS: %v", err)
+		}
+	}
+	if v := os.Getenv("API_KEYS_FILE"); v != "" {
+		c.APIKeysFile = v
+	}
+	return c.JWT.applyEnv()
+}
+
+// Validate checks the keys and the JWT settings of the configuration
+func (c *APIAuthConfig) Validate() error {
+	if err := validateAPIKeys(c.APIKeys); err != nil {
+		return err
+	}
+	if err := c.JWT.Validate(); err != nil {
+		return fmt.Errorf("jwt: %v", err)
+	}
+	return nil
+}
+
+// validateAPIKeys checks the keys and computes their digests
+func validateAPIKeys(keys []APIKey) error {
+	seen := make(map[string]bool)
+	for i := range keys {
+		k := &keys[i]
+		if k.ID == "" {
+			return fmt.Errorf("api_keys[%d]: id is required", i)
+		}
+		if seen[k.ID] {
+			return fmt.Errorf("api_keys[%d]: duplicate id %s", i, k.ID)
+		}
+		seen[k.ID] = true
+
+		switch {
+		case k.Key != "" && k.KeySHA256 != "":
+			return fmt.Errorf("api key %s: key and key_sha256 are mutually exclusive", k.ID)
+		case k.Key != "":
+			k.digest = sha256.Sum256([]byte(k.Key))
+		case k.KeySHA256 != "":
+			digest, err := hex.DecodeString(k.KeySHA256)
+			if err != nil || len(digest) != sha256.Size {
+				return fmt.Errorf("api key %s: key_sha256 must be a hex-encoded SHA-256 digest", k.ID)
+			}
+			copy(k.digest[:], digest)
+		default:
+			return fmt.Errorf("api key %s: key or key_sha256 is required", k.ID)
+		}
+
+		for _, endpoint := range k.Endpoints {
+			if _, err := path.Match(endpoint, "/"); err != nil || !strings.HasPrefix(endpoint, "/") {
+				return fmt.Errorf("api key %s: invalid endpoint %q", k.ID, endpoint)
+			}
+		}
+	}
+	return nil
+}
+
+// identity returns the client authenticated by the key
+func (k *APIKey) identity() *Identity {
+	return &Identity{ID: k.ID, Endpoints: k.Endpoints, Admin: k.Admin, Hostnames: k.Hostnames, Namespaces: k.Namespaces}
+}
+
+// AllowsEndpoint reports whether the client may call the endpoint at urlPath.
+// The admin endpoints need the admin scope, and the simulator endpoint, which
+// exposes every GPU, is closed to clients restricted to some GPUs.
+func (id *Identity) AllowsEndpoint(urlPath string) bool {
+	switch {
+	case strings.HasPrefix(urlPath, "/admin/") && !id.Admin:
+		return false
+	case urlPath == "/simulator/metrics" && (len(id.Hostnames) > 0 || len(id.Namespaces) > 0):
+		return false
+	case len(id.Endpoints) == 0:
+		return true
+	}
+	for _, endpoint := range id.Endpoints {
+		if ok, _ := path.Match(endpoint, urlPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsGPU reports whether the GPU is within the hostnames and namespaces of the client
+func (id *Identity) AllowsGPU(gpu GpuStatus) bool {
+	if len(id.Hostnames) > 0 && !slices.Contains(id.Hostnames, gpu.Hostname) {
+		return false
+	}
+	if len(id.Namespaces) > 0 && !slices.Contains(id.Namespaces, gpu.Namespace) {
+		return false
+	}
+	return true
+}
+
+// Authenticator authenticates requests by their API key or JWT bearer token
+type Authenticator struct {
+	keys []APIKey
+	file *fileAPIKeys
+	jwt  *JWTAuth
+}
+
+// newAuthenticator returns the authenticator of the configuration, or nil when authentication is disabled
+func (c *APIAuthConfig) newAuthenticator(metricsEndpoint string) (*Authenticator, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+
+	keys := slices.Clone(c.APIKeys)
+	if err := validateAPIKeys(keys); err != nil {
+		return nil, err
+	}
+	a := &Authenticator{keys: keys}
+	if c.APIKeysFile != "" {
+		a.file = &fileAPIKeys{path: c.APIKeysFile}
+		if _, err := a.file.load(); err != nil {
+			return nil, err
+		}
+	}
+	if c.JWT.Enabled() {
+		jwt, err := c.JWT.newJWTAuth(metricsEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		a.jwt = jwt
+	}
+	return a, nil
+}
+
+// Authenticate returns the client presenting the key in the X-API-Key header,
+// or the key or JWT sent as a bearer token
+func (a *Authenticator) Authenticate(r *http.Request) (*Identity, error) {
+	presented := r.Header.Get(APIKeyHeader)
+	if presented == "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			presented = strings.TrimSpace(token)
+			if a.jwt != nil && isJWT(presented) {
+				return a.jwt.Authenticate(r.Context(), presented)
+			}
+		}
+	}
+	if presented == "" {
+		return nil, ErrMissingCredentials
+	}
+
+	key, err := a.authenticateKey(presented)
+	if err != nil {
+		return nil, err
+	}
+	return key.identity(), nil
+}
+
+// authenticateKey returns the API key matching the presented secret.
+// The keys of the configuration are checked even when the keys file cannot be read.
+func (a *Authenticator) authenticateKey(presented string) (*APIKey, error) {
+	keys := a.keys
+	var fileErr error
+	if a.file != nil {
+		fileKeys, err := a.file.load()
+		if err != nil {
+			fileErr = err
+		} else {
+			keys = append(slices.Clone(keys), fileKeys...)
+		}
+	}
+
+	// Compare fixed-size digests in constant time, and every key, so that
+	// the timing reveals neither the keys nor which one matched
+	digest := sha256.Sum256([]byte(presented))
+	var match *APIKey
+	for i := range keys {
+		if subtle.ConstantTimeCompare(digest[:], keys[i].digest[:]) == 1 {
+			match = &keys[i]
+		}
+	}
+	switch {
+	case match != nil:
+		return match, nil
+	case fileErr != nil:
+		return nil, fileErr
+	default:
+		return nil, ErrInvalidCredentials
+	}
+}
+
+// fileAPIKeys is a YAML list of API keys re-read when the file changes
+type fileAPIKeys struct {
+	path string
+
+	mu sync.Mutex
+	// modTime is the modification time of the last read, even a failed one,
+	// so that a broken file is read and reported once per change
+	modTime time.Time
+	keys    []APIKey
+	err     error
+}
+
+// load returns the current keys, re-reading the file if it was modified.
+// Once keys were read, failures to re-read the file keep the previous keys.
+func (f *fileAPIKeys) load() ([]APIKey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	switch {
+	case err != nil:
+		err = fmt.Errorf("failed to read API keys file: %v", err)
+		if f.err == nil || f.err.Error() != err.Error() {
+			f.fail(err)
+		}
+		f.modTime = time.Time{}
+	case !info.ModTime().Equal(f.modTime):
+		f.modTime = info.ModTime()
+		if keys, err := f.read(); err != nil {
+			f.fail(err)
+		} else {
+			f.keys, f.err = keys, nil
+		}
+	}
+
+	if f.keys == nil {
+		return nil, f.err
+	}
+	return f.keys, nil
+}
+
+// fail records the error of a read, which is logged when previous keys are kept
+func (f *fileAPIKeys) fail(err error) {
+	f.err = err
+	if f.keys != nil {
+		log.Printf("Failed to reload API keys, keeping the previous ones: %v", err)
+	}
+}
+
+// read reads and validates the keys of the file
+func (f *fileAPIKeys) read() ([]APIKey, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API keys file: %v", err)
+	}
+	keys := []APIKey{}
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse API keys file %s: %v", f.path, err)
+	}
+	if err := validateAPIKeys(keys); err != nil {
+		return nil, fmt.Errorf("invalid API keys file %s: %v", f.path, err)
+	}
+	return keys, nil
+}
+
+// identityContextKey is the context key of the authenticated client
+type identityContextKey struct{}
+
+// withIdentity returns a context carrying the authenticated client
+func withIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey{}, id)
+}
+
+// identityFrom returns the authenticated client of the context, if any
+func identityFrom(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityContextKey{}).(*Identity)
+	return id
+}
+
+// filterAllowed keeps the GPUs the client of the context has access to
+func filterAllowed(ctx context.Context, statuses []GpuStatus) []GpuStatus {
+	id := identityFrom(ctx)
+	if id == nil || (len(id.Hostnames) == 0 && len(id.Namespaces) == 0) {
+		return statuses
+	}
+	allowed := make([]GpuStatus, 0, len(statuses))
+	for _, gpu := range statuses {
+		if id.AllowsGPU(gpu) {
+			allowed = append(allowed, gpu)
+		}
+	}
+	return allowed
+}
@@ -1,16 +1,24 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 
 	"gopkg.in/yaml.v3"
 )
 
 const (
 	defaultEndpoint = "/metrics"
+
+	// sortByEffectiveUtil is the sort query value ranking GPUs by effective utilization
+	sortByEffectiveUtil = "effective_utilization"
 )
 
 // ErrorResponse represents an error response
@@ -18,38 +26,321 @@ type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
-// MetricsHandler handles HTTP requests for metrics
-// It fetches metrics from Prometheus and returns them in a formatted JSON response
-func MetricsHandler(w http.ResponseWriter, r *http.Request) {
-	promURL := os.Getenv("PROMETHEUS_URL")
-	if promURL == "" {
-		sendError(w, "PROMETHEUS_URL environment variable is not set", http.StatusInternalServerError)
+// Handlers serves the GPU metrics API from a MetricSource
+type Handlers struct {
+	Source      MetricSource
+	MetricNames []string
+	// Encoder writes the JSON responses; NaN and ±Inf values are written as null when nil
+	Encoder *JSONEncoder
+	// CustomFields are PromQL-backed fields added to every GPU
+	CustomFields []CustomField
+	// Auth authenticates the clients of a Server; every client is allowed when nil
+	Auth *Authenticator
+}
+
+// NewHandlers creates the API handlers for the given source and metric names
+func NewHandlers(source MetricSource, metricNames []string) *Handlers {
+	return &Handlers{Source: source, MetricNames: metricNames}
+}
+
+// Metrics returns the merged status of every GPU
+func (h *Handlers) Metrics(w http.ResponseWriter, r *http.Request) {
+	sortKey := r.URL.Query().Get("sort")
+	if sortKey != "" && sortKey != sortByEffectiveUtil {
+		sendError(w, "invalid sort key: "+sortKey, http.StatusBadRequest)
 		return
 	}
 
-	metricNamesStr := os.Getenv("METRIC_NAMES")
-	if metricNamesStr == "" {
-		sendError(w, "METRIC_NAMES environment variable is not set", http.StatusInternalServerError)
+	data, ok := h.gpuStatuses(w, r)
+	if !ok {
 		return
 	}
 
-	results, err := FetchPrometheusMetrics(promURL, metricNamesStr)
-	if err != nil {
-		sendError(w, err.Error(), http.StatusInternalServerError)
+	if sortKey == sortByEffectiveUtil {
+		sort.Sort(ByEffectiveUtilization(data))
+	}
+
+	sendJSON(w, h.Encoder, data)
+}
+
+// Throttling returns the GPUs that are currently throttled together with the decoded reasons
+func (h *Handlers) Throttling(w http.ResponseWriter, r *http.Request) {
+	data, ok := h.gpuStatuses(w, r)
+	if !ok {
+		return
+	}
+
+	sendJSON(w, h.Encoder, ThrottledGpus(data))
+}
+
+// Hosts returns the PCIe and NVLink throughput of every host summed over its GPUs
+func (h *Handlers) Hosts(w http.ResponseWriter, r *http.Request) {
+	data, ok := h.gpuStatuses(w, r)
+	if !ok {
+		return
+	}
+
+	sendJSON(w, h.Encoder, SummarizeHosts(data))
+}
+
+// GPU returns the status of the GPU with the UUID of the uuid path parameter
+func (h *Handlers) GPU(w http.ResponseWriter, r *http.Request) {
+	uuid := r.PathValue("uuid")
+	data, ok := h.gpuStatuses(w, r, LabelMatcher{Name: "UUID", Op: MatchEqual, Value: uuid})
+	if !ok {
+		return
+	}
+
+	for _, gpu := range data {
+		if gpu.UUID == uuid {
+			sendJSON(w, h.Encoder, gpu)
+			return
+		}
+	}
+	sendError(w, "GPU not found: "+uuid, http.StatusNotFound)
+}
+
+// Host returns the throughput summary of the host of the hostname path parameter
+func (h *Handlers) Host(w http.ResponseWriter, r *http.Request) {
+	hostname := r.PathValue("hostname")
+	data, ok := h.gpuStatuses(w, r, LabelMatcher{Name: "Hostname", Op: MatchEqual, Value: hostname})
+	if !ok {
+		return
+	}
+
+	for _, summary := range SummarizeHosts(data) {
+		if summary.Hostname == hostname {
+			sendJSON(w, h.Encoder, summary)
+			return
+		}
+	}
+	sendError(w, "host not found: "+hostname, http.StatusNotFound)
+}
+
+// Ready reports whether the metric source can serve requests
+func (h *Handlers) Ready(w http.ResponseWriter, r *http.Request) {
+	if err := h.Source.HealthCheck(r.Context()); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
 		return
 	}
 
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// Health reports that the server is alive; the configuration was validated at startup
+func (h *Handlers) Health(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// gpuStatuses fetches metrics from the source for the GPUs matching matchers and
+// the match parameters and merges them into GPU statuses.
+// On failure it writes an error response and returns false.
+func (h *Handlers) gpuStatuses(w http.ResponseWriter, r *http.Request, matchers ...LabelMatcher) ([]GpuStatus, bool) {
+	// Per-request label matchers, e.g. ?match=Hostname=node-a&match=modelName=~H100.*
+	for _, param := range r.URL.Query()["match"] {
+		matcher, err := ParseMatcher(param)
+		if err != nil {
+			sendError(w, err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+		matchers = append(matchers, matcher)
+	}
+
+	report, err := h.Fetch(r.Context(), matchers)
+
+	// Pass on the warnings and infos Prometheus attached to the query results
+	for _, warning := range report.Warnings {
+		w.Header().Add("X-Prometheus-Warning", warning)
+	}
+	for _, info := range report.Infos {
+		w.Header().Add("X-Prometheus-Info", info)
+	}
+	if err != nil {
+		sendError(w, err.Error(), errorStatus(err))
+		return nil, false
+	}
+
+	// Report the failed backends and custom fields and serve the rest
+	for _, backendErr := range report.BackendErrors {
+		w.Header().Add("X-Backend-Error", backendErr)
+	}
+	for _, fieldErr := range report.CustomFieldErrors {
+		w.Header().Add("X-Custom-Field-Error", fieldErr)
+	}
+
+	return report.Statuses, true
+}
+
+// FetchReport is the outcome of fetching the GPU statuses
+type FetchReport struct {
+	Statuses []GpuStatus
+	// Warnings and Infos are the notes Prometheus attached to the query results
+	Warnings []string
+	Infos    []string
+	// BackendErrors and CustomFieldErrors describe the failures that did not
+	// prevent serving the other results, as "name: error"
+	BackendErrors     []string
+	CustomFieldErrors []string
+}
+
+// Fetch fetches metrics from the source for the GPUs matching matchers and
+// merges them into GPU statuses. The report is never nil.
+func (h *Handlers) Fetch(ctx context.Context, matchers []LabelMatcher) (*FetchReport, error) {
+	report := &FetchReport{}
+
+	ctx, notes := withQueryNotes(withMatchers(withSnapshotPin(ctx), matchers))
+	results, err := h.Source.FetchInstant(ctx, h.MetricNames)
+	report.Warnings, report.Infos = notes.warnings, notes.infos
+	if len(matchers) > 0 {
+		// Sources that cannot push the matchers down return every series
+		results = filterMatching(results, matchers)
+		if len(results) == 0 && (err == nil || errors.Is(err, ErrNoResults)) {
+			report.Statuses = []GpuStatus{}
+			return report, nil
+		}
+	}
+
+	var partial *PartialError
+	if errors.As(err, &partial) && len(results) > 0 {
+		for _, name := range partial.Backends() {
+			report.BackendErrors = append(report.BackendErrors, name+": "+partial.Errors[name].Error())
+		}
+	} else if err != nil {
+		return report, err
+	}
+
 	data, err := MergeGpuMetrics(results)
+	if err != nil {
+		return report, err
+	}
+	data = filterAllowed(ctx, data)
+
+	failed := FetchCustomFields(ctx, h.Source, h.CustomFields, data)
+	for _, field := range h.CustomFields {
+		if err, ok := failed[field.Name]; ok {
+			report.CustomFieldErrors = append(report.CustomFieldErrors, field.Name+": "+err.Error())
+		}
+	}
+
+	report.Statuses = data
+	return report, nil
+}
+
+// errorStatus returns the HTTP status reporting a fetch error,
+// derived from the Prometheus error type when there is one
+func errorStatus(err error) int {
+	var promErr *PrometheusError
+	if errors.As(err, &promErr) {
+		return promErr.StatusCode()
+	}
+	return http.StatusInternalServerError
+}
+
+// MetricsHandler handles HTTP requests for metrics
+// It fetches metrics from the configured source and returns them in a formatted JSON response
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if h, ok := handlersFromEnv(w); ok {
+		h.Metrics(w, r)
+	}
+}
+
+// ThrottleHandler handles HTTP requests for the throttling report
+// It returns the GPUs that are currently throttled together with the decoded reasons
+func ThrottleHandler(w http.ResponseWriter, r *http.Request) {
+	if h, ok := handlersFromEnv(w); ok {
+		h.Throttling(w, r)
+	}
+}
+
+// HostsHandler handles HTTP requests for the per-host summary
+// It returns the PCIe and NVLink throughput of every host summed over its GPUs
+func HostsHandler(w http.ResponseWriter, r *http.Request) {
+	if h, ok := handlersFromEnv(w); ok {
+		h.Hosts(w, r)
+	}
+}
+
+// envHandlers caches the handlers created from the environment, so that the
+// source and its client are built once rather than for every request
+var envHandlers struct {
+	mu       sync.Mutex
+	key      string
+	source   MetricSource
+	handlers *Handlers
+}
+
+// handlersFromEnv returns the API handlers configured by the environment
+// variables, creating them only when the variables change.
+// On failure it writes an error response and returns false.
+func handlersFromEnv(w http.ResponseWriter) (*Handlers, bool) {
+	source, err := cachedSourceFromEnv()
 	if err != nil {
 		sendError(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, false
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(data); err != nil {
+	var key strings.Builder
+	for _, name := range []string{"METRIC_NAMES", "CUSTOM_FIELDS", "NON_FINITE_POLICY", "NON_FINITE_FIELDS"} {
+		fmt.Fprintf(&key, "%s=%q;", name, os.Getenv(name))
+	}
+
+	envHandlers.mu.Lock()
+	defer envHandlers.mu.Unlock()
+
+	if envHandlers.handlers != nil && envHandlers.source == source && envHandlers.key == key.String() {
+		return envHandlers.handlers, true
+	}
+
+	if os.Getenv("METRIC_NAMES") == "" {
+		sendError(w, "METRIC_NAMES environment variable is not set", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	// Validate the environment the same way as a config file, so that the
+	// checks across settings also apply without one
+	cfg := DefaultConfig()
+	if err := cfg.applyEnv(); err != nil {
+		sendError(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if err := cfg.Validate(); err != nil {
+		sendError(w, "invalid configuration: "+err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	customFields, err := cfg.customFields()
+	if err != nil {
+		sendError(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	h := NewHandlers(source, cfg.Metrics.Names)
+	h.Encoder = cfg.encoder()
+	h.CustomFields = customFields
+
+	envHandlers.key = key.String()
+	envHandlers.source = source
+	envHandlers.handlers = h
+	return h, true
+}
+
+// sendJSON sends a successful response in JSON format,
+// writing NaN and ±Inf values according to the policies of enc
+func sendJSON(w http.ResponseWriter, enc *JSONEncoder, data interface{}) {
+	if enc == nil {
+		enc = &JSONEncoder{}
+	}
+
+	body, err := enc.Marshal(data)
+	if err != nil {
 		sendError(w, "Failed to encode response", http.StatusInternalServerError)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
 }
 
 // sendError sends an error response in JSON format
@@ -65,40 +356,24 @@ func sendError(w http.ResponseWriter, message string, statusCode int) {
 
 // ReadinessProbeHandler handles readiness probe requests
 func ReadinessProbeHandler(w http.ResponseWriter, r *http.Request) {
-	// Check if Prometheus is accessible
-	promURL := os.Getenv("PROMETHEUS_URL")
-	if promURL == "" {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		w.Write([]byte("PROMETHEUS_URL not set"))
-		return
-	}
-
-	// Try to connect to Prometheus
-	resp, err := http.Get(promURL + "/api/v1/query?query=up")
+	source, err := cachedSourceFromEnv()
 	if err != nil {
 		w.WriteHeader(http.StatusServiceUnavailable)
-		w.Write([]byte("Cannot connect to Prometheus"))
+		w.Write([]byte(err.Error()))
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		w.Write([]byte("Prometheus returned non-200 status"))
-		return
-	}
-
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+	NewHandlers(source, nil).Ready(w, r)
 }
 
 // LivenessProbeHandler handles liveness probe requests
 func LivenessProbeHandler(w http.ResponseWriter, r *http.Request) {
-	// Check if required environment variables are set
-	promURL := os.Getenv("PROMETHEUS_URL")
+	// Check if required environment variables are set, reusing the source
+	// of the previous probes while the environment is unchanged
+	_, err := cachedSourceFromEnv()
 	metricNamesStr := os.Getenv("METRIC_NAMES")
 
-	if promURL == "" || metricNamesStr == "" {
+	if err != nil || metricNamesStr == "" {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		w.Write([]byte("Required environment variables not set"))
 		return
@@ -116,21 +391,12 @@ func LivenessProbeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
 
-// Run starts the HTTP server and sets up the metrics endpoint
-func Run() error {
-	// Get endpoint from environment variable or use default
-	endpoint := os.Getenv("METRICS_ENDPOINT")
-	if endpoint == "" {
-		endpoint = defaultEndpoint
+// Run starts the server configured by CONFIG_FILE and the environment variables
+// and serves until ctx is done or the process receives SIGTERM or SIGINT
+func Run(ctx context.Context) error {
+	r, err := NewReloader(os.Getenv("CONFIG_FILE"), nil)
+	if err != nil {
+		return err
 	}
-
-	// Register handlers
-	http.HandleFunc(endpoint, MetricsHandler)
-	http.HandleFunc("/ready", ReadinessProbeHandler)
-	http.HandleFunc("/health", LivenessProbeHandler)
-
-	// Start server
-	port := ":8080"
-	log.Printf("Starting server on %s with endpoint %s", port, endpoint)
-	return http.ListenAndServe(port, nil)
+	return Serve(ctx, r)
 }
@@ -0,0 +1,311 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AuthConfig configures the credentials and TLS settings used to reach Prometheus
+type AuthConfig struct {
+	// BearerToken is sent as an Authorization header.
+	// BearerTokenFile takes precedence and is re-read whenever the file changes.
+	BearerToken     string `yaml:"bearer_token"`
+	BearerTokenFile string `yaml:"bearer_token_file"`
+
+	BasicAuthUsername string `yaml:"basic_auth_username"`
+	BasicAuthPassword string `yaml:"basic_auth_password"`
+
+	// Headers are added to every request, e.g. X-Scope-OrgID for Mimir/Cortex tenants
+	Headers map[string]string `yaml:"headers"`
+
+	// CAFile is a PEM bundle used to verify the server certificate.
+	// CertFile and KeyFile hold the client certificate, reloaded whenever they change.
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// authEnvVars lists the environment variables read by applyEnv
+var authEnvVars = []string{
+	"PROMETHEUS_BEARER_TOKEN",
+	"PROMETHEUS_BEARER_TOKEN_FILE",
+	"PROMETHEUS_BASIC_AUTH_USERNAME",
+	"PROMETHEUS_BASIC_AUTH_PASSWORD",
+	"PROMETHEUS_HEADERS",
+	"PROMETHEUS_CA_FILE",
+	"PROMETHEUS_CERT_FILE",
+	"PROMETHEUS_KEY_FILE",
+	"PROMETHEUS_INSECURE_SKIP_VERIFY",
+}
+
+// applyEnv overrides the settings with the Prometheus credentials set in the environment
+func (c *AuthConfig) applyEnv() error {
+	strings := []struct {
+		name  string
+		value *string
+	}{
+		{"PROMETHEUS_BEARER_TOKEN", &c.BearerToken},
+		{"PROMETHEUS_BEARER_TOKEN_FILE", &c.BearerTokenFile},
+		{"PROMETHEUS_BASIC_AUTH_USERNAME", &c.BasicAuthUsername},
+		{"PROMETHEUS_BASIC_AUTH_PASSWORD", &c.BasicAuthPassword},
+		{"PROMETHEUS_CA_FILE", &c.CAFile},
+		{"PROMETHEUS_CERT_FILE", &c.CertFile},
+		{"PROMETHEUS_KEY_FILE", &c.KeyFile},
+	}
+	for _, s := range strings {
+		if v := os.Getenv(s.name); v != "" {
+			*s.value = v
+		}
+	}
+
+	if headersStr := os.Getenv("PROMETHEUS_HEADERS"); headersStr != "" {
+		if err := yaml.Unmarshal([]byte(headersStr), &c.Headers); err != nil {
+			return fmt.Errorf("failed to parse PROMETHEUS_HEADERS: %v", err)
+		}
+	}
+	if v := os.Getenv("PROMETHEUS_INSECURE_SKIP_VERIFY"); v != "" {
+		insecure, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid PROMETHEUS_INSECURE_SKIP_VERIFY: %v", err)
+		}
+		c.InsecureSkipVerify = insecure
+	}
+
+	return nil
+}
+
+// Validate checks that the settings are consistent
+func (c *AuthConfig) Validate() error {
+	if (c.BearerToken != "" || c.BearerTokenFile != "") && c.BasicAuthUsername != "" {
+		return fmt.Errorf("bearer token and basic auth are mutually exclusive")
+	}
+	if c.BasicAuthPassword != "" && c.BasicAuthUsername == "" {
+		return fmt.Errorf("basic auth password requires a username")
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("client certificate and key must be set together")
+	}
+	return nil
+}
+
+// IsZero reports whether no setting differs from the defaults
+func (c *AuthConfig) IsZero() bool {
+	return c.BearerToken == "" && c.BearerTokenFile == "" &&
+		c.BasicAuthUsername == "" && c.BasicAuthPassword == "" &&
+		len(c.Headers) == 0 && c.CAFile == "" && c.CertFile == "" &&
+		c.KeyFile == "" && !c.InsecureSkipVerify
+}
+
+// Client returns an HTTP client with the default timeouts and retries
+// applying the credentials to every request
+func (c *AuthConfig) Client() (*http.Client, error) {
+	return DefaultClientConfig().NewClient(c)
+}
+
+// transport configures TLS on base and wraps it to add the credentials to every request
+func (c *AuthConfig) transport(base *http.Transport) (http.RoundTripper, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.CertFile != "" {
+		certs := &fileCertificate{certFile: c.CertFile, keyFile: c.KeyFile}
+		if _, err := certs.load(); err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certs.load()
+		}
+	}
+	base.TLSClientConfig = tlsConfig
+
+	var token *fileToken
+	if c.BearerTokenFile != "" {
+		token = &fileToken{path: c.BearerTokenFile}
+		if _, err := token.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &authTransport{base: base, config: c, token: token}, nil
+}
+
+// authTransport adds the configured credentials and headers to every request
+type authTransport struct {
+	base   http.RoundTripper
+	config *AuthConfig
+	token  *fileToken
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+
+	for name, value := range t.config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	switch {
+	case t.token != nil:
+		token, err := t.token.load()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case t.config.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+t.config.BearerToken)
+	case t.config.BasicAuthUsername != "":
+		req.SetBasicAuth(t.config.BasicAuthUsername, t.config.BasicAuthPassword)
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+// reloadWarning logs the failures to re-read a credential file while the
+// last good credential is still served, once per distinct error, since
+// files being rotated may briefly be missing or incomplete
+type reloadWarning struct {
+	last string
+}
+
+// warn logs err unless it was the last error logged
+func (w *reloadWarning) warn(what string, err error) {
+	if msg := err.Error(); msg != w.last {
+		log.Printf("Failed to reload %s, keeping the previous one: %v", what, err)
+		w.last = msg
+	}
+}
+
+// fileToken is a bearer token read from a file and re-read when the file changes
+type fileToken struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	token   string
+	failure reloadWarning
+}
+
+// load returns the current token, re-reading the file if it was modified.
+// Once a token was read, failures to re-read it keep the previous token.
+func (f *fileToken) load() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	token, err := f.reload()
+	if err != nil {
+		if f.token == "" {
+			return "", err
+		}
+		f.failure.warn("bearer token", err)
+		return f.token, nil
+	}
+	f.failure = reloadWarning{}
+	return token, nil
+}
+
+// reload re-reads the token file if it was modified
+func (f *fileToken) reload() (string, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read bearer token file: %v", err)
+	}
+
+	if f.token != "" && info.ModTime().Equal(f.modTime) {
+		return f.token, nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read bearer token file: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("bearer token file %s is empty", f.path)
+	}
+
+	f.token = token
+	f.modTime = info.ModTime()
+	return f.token, nil
+}
+
+// fileCertificate is a certificate/key pair reloaded when either file changes
+type fileCertificate struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.Mutex
+	certModTime time.Time
+	keyModTime  time.Time
+	cert        *tls.Certificate
+	failure     reloadWarning
+}
+
+// load returns the current certificate, reloading the files if they were modified.
+// Once a certificate was loaded, failures to reload it keep the previous certificate.
+func (f *fileCertificate) load() (*tls.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cert, err := f.reload()
+	if err != nil {
+		if f.cert == nil {
+			return nil, err
+		}
+		f.failure.warn("certificate", err)
+		return f.cert, nil
+	}
+	f.failure = reloadWarning{}
+	return cert, nil
+}
+
+// reload reloads the certificate if either file was modified
+func (f *fileCertificate) reload() (*tls.Certificate, error) {
+	certInfo, err := os.Stat(f.certFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate file: %v", err)
+	}
+	keyInfo, err := os.Stat(f.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %v", err)
+	}
+
+	if f.cert != nil && certInfo.ModTime().Equal(f.certModTime) && keyInfo.ModTime().Equal(f.keyModTime) {
+		return f.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %v", err)
+	}
+
+	f.cert = &cert
+	f.certModTime = certInfo.ModTime()
+	f.keyModTime = keyInfo.ModTime()
+	return f.cert, nil
+}
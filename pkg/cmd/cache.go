@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachingSource is a MetricSource reusing the instant results of Source for TTL,
+// so that bursts of API requests do not each query the backend.
+// Failed fetches are not cached.
+type CachingSource struct {
+	Source MetricSource
+	TTL    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+// cacheEntry is a cached instant fetch together with the Prometheus notes it produced
+type cacheEntry struct {
+	results  []Result
+	warnings []string
+	infos    []string
+	expires  time.Time
+}
+
+// FetchInstant returns the cached results for the metric names and
+// per-request matchers, fetching them from the source when missing or expired
+func (c *CachingSource) FetchInstant(ctx context.Context, metricNames []string) ([]Result, error) {
+	key := cacheKey(metricNames, matchersFrom(ctx))
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		addQueryNotes(ctx, entry.warnings, entry.infos)
+		return entry.results, nil
+	}
+
+	fetchCtx, notes := withQueryNotes(ctx)
+	results, err := c.Source.FetchInstant(fetchCtx, metricNames)
+	addQueryNotes(ctx, notes.warnings, notes.infos)
+	if err != nil {
+		return results, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]cacheEntry)
+	}
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cacheEntry{results: results, warnings: notes.warnings, infos: notes.infos, expires: now.Add(c.TTL)}
+	return results, nil
+}
+
+// FetchRange is not cached
+func (c *CachingSource) FetchRange(ctx context.Context, metricNames []string, start, end time.Time, step time.Duration) ([]Result, error) {
+	return c.Source.FetchRange(ctx, metricNames, start, end, step)
+}
+
+// HealthCheck checks the underlying source
+func (c *CachingSource) HealthCheck(ctx context.Context) error {
+	return c.Source.HealthCheck(ctx)
+}
+
+// cacheKey identifies a fetch by its metric names and matchers
+func cacheKey(metricNames []string, matchers []LabelMatcher) string {
+	var key strings.Builder
+	for _, name := range metricNames {
+		key.WriteString(name)
+		key.WriteByte(0)
+	}
+	for _, m := range matchers {
+		key.WriteString(m.String())
+		key.WriteByte(0)
+	}
+	return key.String()
+}
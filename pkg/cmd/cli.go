@@ -0,0 +1,258 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Version is the version of the binary, set at build time with
+// -ldflags "-X github.com/V01d42/dcgm-metrics-api/pkg/cmd.Version=v1.2.3"
+var Version = "dev"
+
+// ErrUsage is returned when the command line is invalid; the usage has already been printed
+var ErrUsage = errors.New("invalid usage")
+
+// Output formats of the query command
+const (
+	OutputTable = "table"
+	OutputJSON  = "json"
+)
+
+const usage = `Usage: dcgm-metrics-api <command> [flags]
+
+Commands:
+  serve            start the API server (default)
+  query            fetch the GPU statuses once and print them
+  top              show the GPU statuses in a refreshing table
+  validate-config  check the configuration and exit
+  version          print the version
+
+Run "dcgm-metrics-api <command> -h" for the flags of a command.
+`
+
+// Execute runs the command line given by args (without the program name).
+// Without a command, or when args start with a flag, the server is started.
+func Execute(args []string, stdout, stderr io.Writer) error {
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		return runServe(args, stderr)
+	case "query":
+		return runQuery(args, stdout, stderr)
+	case "top":
+		return runTop(args, stdout, stderr)
+	case "validate-config":
+		return runValidateConfig(args, stdout, stderr)
+	case "version":
+		fmt.Fprintf(stdout, "dcgm-metrics-api %s (%s)\n", version(), runtime.Version())
+		return nil
+	case "help":
+		fmt.Fprint(stdout, usage)
+		return nil
+	default:
+		fmt.Fprintf(stderr, "unknown command: %s\n\n%s", command, usage)
+		return ErrUsage
+	}
+}
+
+// newFlagSet creates the flag set of a command writing its usage to stderr
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	return fs
+}
+
+// parseFlags parses args, turning flag errors into ErrUsage
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return ErrUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(fs.Output(), "unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+		return ErrUsage
+	}
+	return nil
+}
+
+// runServe starts the API server
+func runServe(args []string, stderr io.Writer) error {
+	fs := newFlagSet("serve", stderr)
+	var flags ConfigFlags
+	flags.Register(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return ignoreHelp(err)
+	}
+
+	r, err := NewReloader(flags.ConfigFile, &flags)
+	if err != nil {
+		return err
+	}
+	return Serve(context.Background(), r)
+}
+
+// runQuery fetches and merges the GPU statuses once and prints them
+func runQuery(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("query", stderr)
+	var flags ConfigFlags
+	flags.RegisterSource(fs)
+	output := fs.String("output", OutputTable, "output format: table or json")
+	sortKey := fs.String("sort", "", "sort key: "+sortByEffectiveUtil+" (default by host and GPU)")
+	timeout := fs.Duration("timeout", 30*time.Second, "timeout of the query")
+	var matchers []LabelMatcher
+	fs.Func("match", "label matcher narrowing the GPUs, e.g. Hostname=node-a (repeatable)", func(s string) error {
+		matcher, err := ParseMatcher(s)
+		if err != nil {
+			return err
+		}
+		matchers = append(matchers, matcher)
+		return nil
+	})
+	if err := parseFlags(fs, args); err != nil {
+		return ignoreHelp(err)
+	}
+
+	if *output != OutputTable && *output != OutputJSON {
+		return fmt.Errorf("invalid output format: %s", *output)
+	}
+	if *sortKey != "" && *sortKey != sortByEffectiveUtil {
+		return fmt.Errorf("invalid sort key: %s", *sortKey)
+	}
+
+	cfg, err := LoadConfig(flags.ConfigFile, &flags)
+	if err != nil {
+		return err
+	}
+	h, err := NewHandlersFromConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	report, err := h.Fetch(ctx, matchers)
+	for _, warning := range report.Warnings {
+		fmt.Fprintf(stderr, "warning: %s\n", warning)
+	}
+	if err != nil {
+		return err
+	}
+	for _, backendErr := range report.BackendErrors {
+		fmt.Fprintf(stderr, "backend error: %s\n", backendErr)
+	}
+	for _, fieldErr := range report.CustomFieldErrors {
+		fmt.Fprintf(stderr, "custom field error: %s\n", fieldErr)
+	}
+
+	data := report.Statuses
+	if *sortKey == sortByEffectiveUtil {
+		sort.Sort(ByEffectiveUtilization(data))
+	} else {
+		sort.Sort(ByHostnameAndDeviceID(data))
+	}
+
+	if *output == OutputJSON {
+		body, err := h.Encoder.Marshal(data)
+		if err != nil {
+			return err
+		}
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, body, "", "  "); err != nil {
+			return err
+		}
+		indented.WriteByte('\n')
+		_, err = indented.WriteTo(stdout)
+		return err
+	}
+	return writeGpuTable(stdout, data)
+}
+
+// writeGpuTable prints the GPU statuses as an aligned table
+func writeGpuTable(w io.Writer, data []GpuStatus) error {
+	withCluster := false
+	for _, gpu := range data {
+		if gpu.Cluster != "" {
+			withCluster = true
+			break
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if withCluster {
+		fmt.Fprint(tw, "CLUSTER\t")
+	}
+	fmt.Fprintln(tw, "HOST\tGPU\tMODEL\tUTIL\tMEM UTIL\tMEM USED/TOTAL (MiB)\tTEMP\tEFFECTIVE")
+	for _, gpu := range data {
+		if withCluster {
+			fmt.Fprintf(tw, "%s\t", gpu.Cluster)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%.0f%%\t%.0f%%\t%.0f/%.0f\t%.0fC\t%.2f\n",
+			gpu.Hostname, gpu.DeviceID, gpu.Name, gpu.GPUUtil, gpu.MemUtil,
+			gpu.MemUsed, gpu.MemTotal, gpu.GPUTemp, gpu.EffectiveUtil)
+	}
+	return tw.Flush()
+}
+
+// runValidateConfig loads and validates the configuration
+func runValidateConfig(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("validate-config", stderr)
+	var flags ConfigFlags
+	flags.Register(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return ignoreHelp(err)
+	}
+
+	cfg, err := LoadConfig(flags.ConfigFile, &flags)
+	if err != nil {
+		return err
+	}
+	if _, err := cfg.Source.NewSource(); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	if _, err := cfg.Server.TLS.serverConfig(); err != nil {
+		return fmt.Errorf("invalid configuration: server.tls: %v", err)
+	}
+
+	name := flags.ConfigFile
+	if name == "" {
+		name = "configuration"
+	}
+	fmt.Fprintf(stdout, "%s is valid: %s source, %d metrics\n", name, cfg.Source.sourceType(), len(cfg.Metrics.Names))
+	return nil
+}
+
+// ignoreHelp treats a request for the usage as success
+func ignoreHelp(err error) error {
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	return err
+}
+
+// version returns Version, or the module version when installed with go install
+func version() string {
+	if Version != "dev" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return Version
+}
@@ -0,0 +1,242 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ClientConfig configures the HTTP client used for every outbound request
+type ClientConfig struct {
+	// ConnectTimeout bounds establishing a connection
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	// RequestTimeout bounds a whole request, including its retries
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	// MaxRetries is the number of retries of idempotent requests after
+	// connection errors, 429 and 502/503/504 responses
+	MaxRetries int `yaml:"max_retries"`
+	// RetryBaseDelay and RetryMaxDelay bound the exponential backoff.
+	// A Retry-After longer than RetryMaxDelay is not waited for.
+	RetryBaseDelay time.Duration `yaml:"retry_base_delay"`
+	RetryMaxDelay  time.Duration `yaml:"retry_max_delay"`
+}
+
+// clientEnvVars lists the environment variables read by applyEnv
+var clientEnvVars = []string{
+	"CLIENT_CONNECT_TIMEOUT",
+	"CLIENT_REQUEST_TIMEOUT",
+	"CLIENT_MAX_RETRIES",
+	"CLIENT_RETRY_BASE_DELAY",
+	"CLIENT_RETRY_MAX_DELAY",
+}
+
+// defaultClient is the shared client used by sources without their own client
+var defaultClient = mustNewClient(DefaultClientConfig())
+
+// DefaultClientConfig returns the default timeouts and retry policy
+func DefaultClientConfig() ClientConfig {
+	return ClientConfig{
+		ConnectTimeout: 5 * time.Second,
+		RequestTimeout: 30 * time.Second,
+		MaxRetries:     2,
+		RetryBaseDelay: 200 * time.Millisecond,
+		RetryMaxDelay:  5 * time.Second,
+	}
+}
+
+// applyEnv overrides the settings with the client settings set in the environment
+func (cfg *ClientConfig) applyEnv() error {
+	durations := []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"CLIENT_CONNECT_TIMEOUT", &cfg.ConnectTimeout},
+		{"CLIENT_REQUEST_TIMEOUT", &cfg.RequestTimeout},
+		{"CLIENT_RETRY_BASE_DELAY", &cfg.RetryBaseDelay},
+		{"CLIENT_RETRY_MAX_DELAY", &cfg.RetryMaxDelay},
+	}
+	for _, d := range durations {
+		if v := os.Getenv(d.name); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", d.name, err)
+			}
+			*d.value = parsed
+		}
+	}
+
+	if v := os.Getenv("CLIENT_MAX_RETRIES"); v != "" {
+		retries, err := strconv.Atoi(v)
+		if err != nil || retries < 0 {
+			return fmt.Errorf("invalid CLIENT_MAX_RETRIES: %s", v)
+		}
+		cfg.MaxRetries = retries
+	}
+
+	return nil
+}
+
+// Validate checks that the settings are usable
+func (c ClientConfig) Validate() error {
+	if c.ConnectTimeout < 0 || c.RequestTimeout < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	if c.MaxRetries < 0 {
+		return fmt.Errorf("max retries must not be negative")
+	}
+	if c.RetryBaseDelay < 0 || c.RetryMaxDelay < c.RetryBaseDelay {
+		return fmt.Errorf("retry delays must satisfy 0 <= base delay <= max delay")
+	}
+	return nil
+}
+
+// NewClient returns an HTTP client with the configured timeouts and retries,
+// applying the credentials of auth (which may be nil) to every attempt
+func (c ClientConfig) NewClient(auth *AuthConfig) (*http.Client, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: c.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = c.ConnectTimeout
+
+	var base http.RoundTripper = transport
+	if auth != nil && !auth.IsZero() {
+		var err error
+		if base, err = auth.transport(transport); err != nil {
+			return nil, err
+		}
+	}
+
+	return &http.Client{
+		Timeout:   c.RequestTimeout,
+		Transport: &retryTransport{base: base, config: c},
+	}, nil
+}
+
+// mustNewClient is NewClient for configurations known to be valid
+func mustNewClient(c ClientConfig) *http.Client {
+	client, err := c.NewClient(nil)
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+// retryTransport retries idempotent requests with exponential backoff and jitter
+type retryTransport struct {
+	base   http.RoundTripper
+	config ClientConfig
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead || req.Method == http.MethodOptions
+	if !idempotent || req.Body != nil && req.GetBody == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	for attempt := 0; ; attempt++ {
+		attemptReq := req
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(attemptReq)
+		if attempt >= t.config.MaxRetries || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		var delay time.Duration
+		switch {
+		case err != nil:
+			if !isRetryableError(err) {
+				return resp, err
+			}
+			delay = t.backoff(attempt)
+		case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusBadGateway,
+			resp.StatusCode == http.StatusServiceUnavailable, resp.StatusCode == http.StatusGatewayTimeout:
+			var ok bool
+			if delay, ok = retryAfter(resp, time.Now()); !ok {
+				delay = t.backoff(attempt)
+			} else if delay > t.config.RetryMaxDelay {
+				// The server asked for a longer pause than we are willing to wait
+				return resp, nil
+			}
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		default:
+			return resp, nil
+		}
+
+		if err := sleepContext(req.Context(), delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// isRetryableError reports whether a transport error may succeed on another attempt.
+// Certificate verification failures are permanent.
+func isRetryableError(err error) bool {
+	var certErr *tls.CertificateVerificationError
+	return !errors.As(err, &certErr)
+}
+
+// backoff returns the delay before a retry using exponential backoff with full jitter
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	delay := t.config.RetryBaseDelay << attempt
+	if delay <= 0 || delay > t.config.RetryMaxDelay {
+		delay = t.config.RetryMaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// retryAfter parses the Retry-After header given in seconds or as an HTTP date
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := date.Sub(now); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
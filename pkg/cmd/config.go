@@ -0,0 +1,535 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultListenAddress  = ":8080"
+	defaultReloadInterval = 10 * time.Second
+)
+
+// Config is the configuration of the API server.
+// Settings are read from the defaults, the YAML config file, the environment
+// variables and the command line flags, each overriding the previous ones.
+type Config struct {
+	Server    ServerConfig    `yaml:"server"`
+	Source    SourceConfig    `yaml:"source"`
+	Metrics   MetricsConfig   `yaml:"metrics"`
+	Cache     CacheConfig     `yaml:"cache"`
+	Auth      APIAuthConfig   `yaml:"auth"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+}
+
+// ServerConfig configures the HTTP server
+type ServerConfig struct {
+	Listen          string `yaml:"listen"`
+	MetricsEndpoint string `yaml:"metrics_endpoint"`
+	// ReloadInterval is how often the config file is checked for changes;
+	// polling is disabled when zero
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+
+	// Timeouts of the HTTP server; zero disables a timeout
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	// ShutdownDelay is how long readiness fails before the server stops
+	// accepting connections, so that load balancers stop sending requests
+	ShutdownDelay time.Duration `yaml:"shutdown_delay"`
+	// ShutdownTimeout is how long in-flight requests are given to complete
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	TLS TLSConfig `yaml:"tls"`
+	// ProbeListen is an optional plaintext address serving only /health and
+	// /ready, for probes that cannot use HTTPS or client certificates
+	ProbeListen string `yaml:"probe_listen"`
+}
+
+// SourceConfig selects and configures the metric source
+type SourceConfig struct {
+	// Type is one of prometheus, exporter, file or simulate. When empty the
+	// exporter source is used if exporter URLs are set and Prometheus otherwise.
+	Type       string           `yaml:"type"`
+	Prometheus PrometheusConfig `yaml:"prometheus"`
+	Exporter   ExporterConfig   `yaml:"exporter"`
+	File       FileConfig       `yaml:"file"`
+	Simulator  SimulatorSource  `yaml:"simulator"`
+	Client     ClientConfig     `yaml:"client"`
+}
+
+// PrometheusConfig configures the Prometheus source
+type PrometheusConfig struct {
+	// URLs are equivalent replicas, given as a list or a comma-separated string
+	URLs replicaList `yaml:"urls"`
+	// Backends maps cluster names to replicas queried concurrently instead of URLs
+	Backends map[string]replicaList `yaml:"backends"`
+	Failover string                 `yaml:"failover"`
+	Selector string                 `yaml:"selector"`
+	Auth     AuthConfig             `yaml:"auth"`
+}
+
+// ExporterConfig configures the dcgm-exporter source
+type ExporterConfig struct {
+	URLs []string `yaml:"urls"`
+}
+
+// FileConfig configures the recorded snapshot source
+type FileConfig struct {
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+	Rebase   bool          `yaml:"rebase"`
+}
+
+// MetricsConfig configures the metrics collected for every GPU and how they are written
+type MetricsConfig struct {
+	Names           []string                   `yaml:"names"`
+	CustomFields    map[string]string          `yaml:"custom_fields"`
+	NonFinitePolicy NonFinitePolicy            `yaml:"non_finite_policy"`
+	NonFiniteFields map[string]NonFinitePolicy `yaml:"non_finite_fields"`
+}
+
+// CacheConfig configures the cache of source results
+type CacheConfig struct {
+	// TTL is how long fetched metrics are reused; caching is disabled when zero
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// DefaultConfig returns the configuration used when nothing is set
+func DefaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Listen:          defaultListenAddress,
+			MetricsEndpoint: defaultEndpoint,
+			ReloadInterval:  defaultReloadInterval,
+
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       30 * time.Second,
+			WriteTimeout:      2 * time.Minute,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   30 * time.Second,
+		},
+		Source: SourceConfig{
+			Prometheus: PrometheusConfig{Failover: FailoverOrdered},
+			Simulator:  defaultSimulator(),
+			Client:     DefaultClientConfig(),
+		},
+	}
+}
+
+// LoadConfig reads the config file at path (if any) over the defaults, then
+// applies the environment variables and the flags (if any) and validates the result
+func LoadConfig(path string, flags *ConfigFlags) (*Config, error) {
+	cfg := DefaultConfig()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %v", err)
+		}
+		if err := cfg.decode(data); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	if flags != nil {
+		flags.apply(cfg)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	return cfg, nil
+}
+
+// decode reads YAML over the current settings, rejecting unknown fields
+func (c *Config) decode(data []byte) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// applyEnv overrides the settings with the environment variables
+func (c *Config) applyEnv() error {
+	if v := os.Getenv("LISTEN_ADDRESS"); v != "" {
+		c.Server.Listen = v
+	}
+	if v := os.Getenv("METRICS_ENDPOINT"); v != "" {
+		c.Server.MetricsEndpoint = v
+	}
+	if v := os.Getenv("PROBE_LISTEN_ADDRESS"); v != "" {
+		c.Server.ProbeListen = v
+	}
+	c.Server.TLS.applyEnv()
+
+	durations := []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"CONFIG_RELOAD_INTERVAL", &c.Server.ReloadInterval},
+		{"SERVER_READ_HEADER_TIMEOUT", &c.Server.ReadHeaderTimeout},
+		{"SERVER_READ_TIMEOUT", &c.Server.ReadTimeout},
+		{"SERVER_WRITE_TIMEOUT", &c.Server.WriteTimeout},
+		{"SERVER_IDLE_TIMEOUT", &c.Server.IdleTimeout},
+		{"SHUTDOWN_DELAY", &c.Server.ShutdownDelay},
+		{"SHUTDOWN_TIMEOUT", &c.Server.ShutdownTimeout},
+	}
+	for _, d := range durations {
+		if v := os.Getenv(d.name); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", d.name, err)
+			}
+			*d.value = parsed
+		}
+	}
+
+	if err := c.Source.applyEnv(); err != nil {
+		return err
+	}
+
+	if v := os.Getenv("METRIC_NAMES"); v != "" {
+		names, err := parseMetricNames(v)
+		if err != nil {
+			return fmt.Errorf("invalid METRIC_NAMES: %v", err)
+		}
+		c.Metrics.Names = names
+	}
+	if v := os.Getenv("CUSTOM_FIELDS"); v != "" {
+		if err := yaml.Unmarshal([]byte(v), &c.Metrics.CustomFields); err != nil {
+			return fmt.Errorf("failed to parse CUSTOM_FIELDS: %v", err)
+		}
+	}
+	if v := os.Getenv("NON_FINITE_POLICY"); v != "" {
+		c.Metrics.NonFinitePolicy = NonFinitePolicy(v)
+	}
+	if v := os.Getenv("NON_FINITE_FIELDS"); v != "" {
+		if err := yaml.Unmarshal([]byte(v), &c.Metrics.NonFiniteFields); err != nil {
+			return fmt.Errorf("failed to parse NON_FINITE_FIELDS: %v", err)
+		}
+	}
+
+	if err := c.Auth.applyEnv(); err != nil {
+		return err
+	}
+	if err := c.RateLimit.applyEnv(); err != nil {
+		return err
+	}
+
+	if v := os.Getenv("CACHE_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid CACHE_TTL: %v", err)
+		}
+		c.Cache.TTL = ttl
+	}
+
+	return nil
+}
+
+// applyEnv overrides the source settings with the environment variables
+func (c *SourceConfig) applyEnv() error {
+	if v := os.Getenv("METRICS_SOURCE"); v != "" {
+		c.Type = v
+	}
+
+	if v := os.Getenv("PROMETHEUS_URL"); v != "" {
+		c.Prometheus.URLs = ParseReplicaURLs(v)
+	}
+	if v := os.Getenv("PROMETHEUS_BACKENDS"); v != "" {
+		backends, err := parseBackendURLs(v)
+		if err != nil {
+			return err
+		}
+		c.Prometheus.Backends = backends
+	}
+	if v := os.Getenv("PROMETHEUS_FAILOVER"); v != "" {
+		c.Prometheus.Failover = v
+	}
+	if v := os.Getenv("PROMETHEUS_SELECTOR"); v != "" {
+		c.Prometheus.Selector = v
+	}
+	if err := c.Prometheus.Auth.applyEnv(); err != nil {
+		return err
+	}
+
+	if v := os.Getenv("EXPORTER_URLS"); v != "" {
+		urls, err := ParseExporterURLs(v)
+		if err != nil {
+			return err
+		}
+		c.Exporter.URLs = urls
+	}
+
+	if v := os.Getenv("METRICS_FILE"); v != "" {
+		c.File.Path = v
+	}
+	if v := os.Getenv("METRICS_FILE_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid METRICS_FILE_INTERVAL: %v", err)
+		}
+		c.File.Interval = interval
+	}
+	if v := os.Getenv("METRICS_FILE_REBASE"); v != "" {
+		rebase, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid METRICS_FILE_REBASE: %v", err)
+		}
+		c.File.Rebase = rebase
+	}
+
+	if err := c.Simulator.applyEnv(); err != nil {
+		return err
+	}
+	return c.Client.applyEnv()
+}
+
+// sourceType returns the configured source type, resolving the default
+func (c *SourceConfig) sourceType() string {
+	switch {
+	case c.Type != "":
+		return c.Type
+	case len(c.Exporter.URLs) > 0:
+		return SourceExporter
+	default:
+		return SourcePrometheus
+	}
+}
+
+// Validate checks the whole configuration, naming the offending setting in errors
+func (c *Config) Validate() error {
+	if c.Server.Listen == "" {
+		return fmt.Errorf("server.listen must not be empty")
+	}
+	if !strings.HasPrefix(c.Server.MetricsEndpoint, "/") {
+		return fmt.Errorf("server.metrics_endpoint must start with /: %q", c.Server.MetricsEndpoint)
+	}
+	if err := checkMetricsEndpoint(c.Server.MetricsEndpoint); err != nil {
+		return fmt.Errorf("server.metrics_endpoint %q is not usable: %v", c.Server.MetricsEndpoint, err)
+	}
+	serverDurations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"reload_interval", c.Server.ReloadInterval},
+		{"read_header_timeout", c.Server.ReadHeaderTimeout},
+		{"read_timeout", c.Server.ReadTimeout},
+		{"write_timeout", c.Server.WriteTimeout},
+		{"idle_timeout", c.Server.IdleTimeout},
+		{"shutdown_delay", c.Server.ShutdownDelay},
+		{"shutdown_timeout", c.Server.ShutdownTimeout},
+	}
+	for _, d := range serverDurations {
+		if d.value < 0 {
+			return fmt.Errorf("server.%s must not be negative", d.name)
+		}
+	}
+	if err := c.Server.TLS.Validate(); err != nil {
+		return fmt.Errorf("server.tls: %v", err)
+	}
+	if c.Server.ProbeListen != "" && c.Server.ProbeListen == c.Server.Listen {
+		return fmt.Errorf("server.probe_listen must differ from server.listen: %q", c.Server.ProbeListen)
+	}
+
+	if err := c.Source.Validate(); err != nil {
+		return err
+	}
+
+	if len(c.Metrics.Names) == 0 {
+		return fmt.Errorf("metrics.names must list at least one metric")
+	}
+	for i, name := range c.Metrics.Names {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("metrics.names[%d] must not be empty", i)
+		}
+		if isNVLinkCounter(name) && c.Source.sourceType() != SourcePrometheus {
+			return fmt.Errorf("metrics.names[%d]: %s is a counter, which only the prometheus source turns into a rate; use %s and %s instead",
+				i, name, MetricNVLinkTxBytes, MetricNVLinkRxBytes)
+		}
+	}
+	if _, err := c.customFields(); err != nil {
+		return fmt.Errorf("metrics.custom_fields: %v", err)
+	}
+	if len(c.Metrics.CustomFields) > 0 && c.Source.sourceType() != SourcePrometheus {
+		return fmt.Errorf("metrics.custom_fields: %v, not %s", ErrCustomFieldsUnsupported, c.Source.sourceType())
+	}
+	if err := c.encoder().Validate(); err != nil {
+		return fmt.Errorf("metrics: %v", err)
+	}
+
+	if c.Cache.TTL < 0 {
+		return fmt.Errorf("cache.ttl must not be negative")
+	}
+	if err := c.Auth.Validate(); err != nil {
+		return fmt.Errorf("auth: %v", err)
+	}
+	if err := c.RateLimit.Validate(); err != nil {
+		return fmt.Errorf("rate_limit: %v", err)
+	}
+	return nil
+}
+
+// Validate checks the source settings
+func (c *SourceConfig) Validate() error {
+	switch c.sourceType() {
+	case SourcePrometheus:
+		if len(c.Prometheus.URLs) == 0 && len(c.Prometheus.Backends) == 0 {
+			return fmt.Errorf("source.prometheus.urls or source.prometheus.backends is required")
+		}
+		for name, replicas := range c.Prometheus.Backends {
+			if len(replicas) == 0 {
+				return fmt.Errorf("source.prometheus.backends.%s has no URL", name)
+			}
+		}
+		switch c.Prometheus.Failover {
+		case "", FailoverOrdered, FailoverRandom:
+		default:
+			return fmt.Errorf("source.prometheus.failover must be %s or %s: %q", FailoverOrdered, FailoverRandom, c.Prometheus.Failover)
+		}
+		if _, err := ParseSelector(c.Prometheus.Selector); err != nil {
+			return fmt.Errorf("source.prometheus.selector: %v", err)
+		}
+		if err := c.Prometheus.Auth.Validate(); err != nil {
+			return fmt.Errorf("source.prometheus.auth: %v", err)
+		}
+	case SourceExporter:
+		if len(c.Exporter.URLs) == 0 {
+			return fmt.Errorf("source.exporter.urls is required")
+		}
+	case SourceFile:
+		if c.File.Path == "" {
+			return fmt.Errorf("source.file.path is required")
+		}
+		if c.File.Interval < 0 {
+			return fmt.Errorf("source.file.interval must not be negative")
+		}
+	case SourceSimulate:
+		if err := c.Simulator.Validate(); err != nil {
+			return fmt.Errorf("source.simulator: %v", err)
+		}
+	default:
+		return fmt.Errorf("source.type must be %s, %s, %s or %s: %q", SourcePrometheus, SourceExporter, SourceFile, SourceSimulate, c.Type)
+	}
+
+	if err := c.Client.Validate(); err != nil {
+		return fmt.Errorf("source.client: %v", err)
+	}
+	return nil
+}
+
+// customFields returns the parsed custom fields
+func (c *Config) customFields() ([]CustomField, error) {
+	if len(c.Metrics.CustomFields) == 0 {
+		return nil, nil
+	}
+	data, err := yaml.Marshal(c.Metrics.CustomFields)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCustomFields(string(data))
+}
+
+// encoder returns the JSON encoder applying the non-finite value policies
+func (c *Config) encoder() *JSONEncoder {
+	return &JSONEncoder{Policy: c.Metrics.NonFinitePolicy, Fields: c.Metrics.NonFiniteFields}
+}
+
+// NewHandlersFromConfig creates the API handlers and their source from a validated configuration
+func NewHandlersFromConfig(cfg *Config) (*Handlers, error) {
+	source, err := cfg.Source.NewSource()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Cache.TTL > 0 {
+		source = &CachingSource{Source: source, TTL: cfg.Cache.TTL}
+	}
+
+	customFields, err := cfg.customFields()
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := cfg.Auth.newAuthenticator(cfg.Server.MetricsEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	h := NewHandlers(source, cfg.Metrics.Names)
+	h.Encoder = cfg.encoder()
+	h.CustomFields = customFields
+	h.Auth = auth
+	return h, nil
+}
+
+// ConfigFlags are the command line flags overriding the configuration
+type ConfigFlags struct {
+	ConfigFile      string
+	Listen          string
+	MetricsEndpoint string
+	Source          string
+	PrometheusURL   string
+	MetricNames     string
+	CacheTTL        time.Duration
+}
+
+// Register defines all the flags on fs
+func (f *ConfigFlags) Register(fs *flag.FlagSet) {
+	f.RegisterSource(fs)
+	fs.StringVar(&f.Listen, "listen", "", "address to listen on (default "+defaultListenAddress+")")
+	fs.StringVar(&f.MetricsEndpoint, "metrics-endpoint", "", "path of the metrics endpoint (default "+defaultEndpoint+")")
+	fs.DurationVar(&f.CacheTTL, "cache-ttl", 0, "how long fetched metrics are reused")
+}
+
+// RegisterSource defines the flags selecting the config file, the source and
+// the metrics on fs. The config file defaults to CONFIG_FILE.
+func (f *ConfigFlags) RegisterSource(fs *flag.FlagSet) {
+	fs.StringVar(&f.ConfigFile, "config", os.Getenv("CONFIG_FILE"), "path of the YAML config file")
+	fs.StringVar(&f.Source, "source", "", "metric source: prometheus, exporter, file or simulate")
+	fs.StringVar(&f.PrometheusURL, "prometheus-url", "", "comma-separated Prometheus replica URLs")
+	fs.StringVar(&f.MetricNames, "metric-names", "", "comma-separated DCGM metric names")
+}
+
+// apply overrides the configuration with the flags that were set
+func (f *ConfigFlags) apply(cfg *Config) {
+	if f.Listen != "" {
+		cfg.Server.Listen = f.Listen
+	}
+	if f.MetricsEndpoint != "" {
+		cfg.Server.MetricsEndpoint = f.MetricsEndpoint
+	}
+	if f.Source != "" {
+		cfg.Source.Type = f.Source
+	}
+	if f.PrometheusURL != "" {
+		cfg.Source.Prometheus.URLs = ParseReplicaURLs(f.PrometheusURL)
+	}
+	if f.MetricNames != "" {
+		var names []string
+		for _, name := range strings.Split(f.MetricNames, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		cfg.Metrics.Names = names
+	}
+	if f.CacheTTL != 0 {
+		cfg.Cache.TTL = f.CacheTTL
+	}
+}
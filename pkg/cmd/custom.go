@@ -0,0 +1,201 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CustomField is a per-GPU field computed by a PromQL expression,
+// e.g. rate(DCGM_FI_PROF_PCIE_TX_BYTES[1m]). The query results are joined
+// to GPUs by their UUID label.
+type CustomField struct {
+	Name  string
+	Query string
+}
+
+// ErrCustomFieldsUnsupported is reported for the custom fields of a source
+// that cannot evaluate PromQL expressions
+var ErrCustomFieldsUnsupported = errors.New("custom fields require the prometheus source")
+
+// customFieldName matches the names allowed for custom fields
+var customFieldName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// ParseCustomFields parses a YAML map of field names to PromQL expressions.
+// The fields are returned sorted by name.
+func ParseCustomFields(fieldsStr string) ([]CustomField, error) {
+	var queries map[string]string
+	if err := yaml.Unmarshal([]byte(fieldsStr), &queries); err != nil {
+		return nil, fmt.Errorf("failed to parse custom fields: %v", err)
+	}
+
+	builtin := gpuStatusFields()
+	fields := make([]CustomField, 0, len(queries))
+	for name, query := range queries {
+		if !customFieldName.MatchString(name) {
+			return nil, fmt.Errorf("invalid custom field name: %s", name)
+		}
+		if builtin[name] {
+			return nil, fmt.Errorf("custom field %s conflicts with a built-in field", name)
+		}
+		if strings.TrimSpace(query) == "" {
+			return nil, fmt.Errorf("custom field %s has an empty query", name)
+		}
+		fields = append(fields, CustomField{Name: name, Query: query})
+	}
+
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+	return fields, nil
+}
+
+// gpuStatusFields returns the JSON field names of GpuStatus
+func gpuStatusFields() map[string]bool {
+	names := make(map[string]bool)
+	t := reflect.TypeOf(GpuStatus{})
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// MarshalJSON writes the custom fields as top-level fields after the built-in ones
+func (s GpuStatus) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := (&JSONEncoder{}).encodeGpuStatus(&buf, s); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeGpuStatus writes the built-in fields of s followed by its custom fields
+func (e *JSONEncoder) encodeGpuStatus(buf *bytes.Buffer, s GpuStatus) error {
+	// plain has the fields of GpuStatus without its MarshalJSON method
+	type plain GpuStatus
+
+	buf.WriteByte('{')
+	first := true
+	if err := e.encodeFields(buf, reflect.ValueOf(plain(s)), &first); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(s.Custom))
+	for name := range s.Custom {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := e.encodeField(buf, name, reflect.ValueOf(s.Custom[name]), &first); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// UnmarshalCustomFields reads the values of fields from data, a GPU status
+// written by MarshalJSON. Top-level fields that are not one of fields are ignored.
+func (s *GpuStatus) UnmarshalCustomFields(data []byte, fields []CustomField) error {
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+
+	s.Custom = nil
+	for _, field := range fields {
+		raw, ok := values[field.Name]
+		if !ok || string(raw) == "null" {
+			continue
+		}
+		var val float64
+		if err := json.Unmarshal(raw, &val); err != nil {
+			// Non-finite values may be written as "NaN", "+Inf" or "-Inf"
+			var str string
+			if json.Unmarshal(raw, &str) != nil {
+				return fmt.Errorf("custom field %s is not a number: %s", field.Name, raw)
+			}
+			if val, err = strconv.ParseFloat(str, 64); err != nil {
+				return fmt.Errorf("custom field %s is not a number: %s", field.Name, raw)
+			}
+		}
+		if s.Custom == nil {
+			s.Custom = make(map[string]float64)
+		}
+		s.Custom[field.Name] = val
+	}
+	return nil
+}
+
+// evaluatesPromQL reports whether the queries sent to source are evaluated
+// as PromQL expressions, which custom fields need
+func evaluatesPromQL(source MetricSource) bool {
+	switch s := source.(type) {
+	case *PrometheusSource:
+		return true
+	case *CachingSource:
+		return evaluatesPromQL(s.Source)
+	case *MultiSource:
+		for _, backend := range s.Backends {
+			if !evaluatesPromQL(backend.Source) {
+				return false
+			}
+		}
+		return len(s.Backends) > 0
+	default:
+		return false
+	}
+}
+
+// FetchCustomFields runs the query of every custom field and merges the values
+// into the statuses with a matching UUID. Fields whose query failed are
+// returned by name and left unset. Sources that cannot evaluate PromQL are
+// not queried, and every field is returned with ErrCustomFieldsUnsupported.
+func FetchCustomFields(ctx context.Context, source MetricSource, fields []CustomField, statuses []GpuStatus) map[string]error {
+	failed := make(map[string]error)
+	if !evaluatesPromQL(source) {
+		for _, field := range fields {
+			failed[field.Name] = ErrCustomFieldsUnsupported
+		}
+		return failed
+	}
+
+	byUUID := make(map[string]*GpuStatus, len(statuses))
+	for i := range statuses {
+		byUUID[statuses[i].UUID] = &statuses[i]
+	}
+
+	for _, field := range fields {
+		results, err := source.FetchInstant(ctx, []string{field.Query})
+		if err != nil && len(results) == 0 {
+			failed[field.Name] = err
+			continue
+		}
+
+		for _, result := range results {
+			status, ok := byUUID[result.Metric["UUID"]]
+			if !ok {
+				continue
+			}
+			val, err := result.GetValue()
+			if err != nil {
+				continue
+			}
+			if status.Custom == nil {
+				status.Custom = make(map[string]float64)
+			}
+			status.Custom[field.Name] = val
+		}
+	}
+
+	return failed
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import "math"
+
+// Weights of the profiling metrics in the effective utilization score
+const (
+	smActiveWeight     = 0.5
+	smOccupancyWeight  = 0.25
+	tensorActiveWeight = 0.25
+)
+
+// EffectiveUtilization returns a utilization score between 0 and 1.
+// When SM activity is profiled, the score blends SM activity, SM occupancy
+// and tensor pipe activity, so a GPU that is "busy" with a single warp ranks
+// below one saturating its tensor cores. The weights are rescaled over the
+// fields collected, so that a fully active GPU scores 1 whichever of them are
+// missing. Otherwise it falls back to the graphics engine activity and
+// finally to DCGM_FI_DEV_GPU_UTIL.
+func (s *GpuStatus) EffectiveUtilization() float64 {
+	switch {
+	case s.hasSMActivity:
+		score, weights := smActiveWeight*s.SMActive, smActiveWeight
+		if s.hasSMOccupancy {
+			score += smOccupancyWeight * s.SMOccupancy
+			weights += smOccupancyWeight
+		}
+		if s.hasTensor {
+			score += tensorActiveWeight * s.TensorActive
+			weights += tensorActiveWeight
+		}
+		return score / weights
+	case s.hasGREngine:
+		return s.GREngineActive
+	default:
+		return s.GPUUtil / 100
+	}
+}
+
+// ByEffectiveUtilization implements sort.Interface for []GpuStatus, most effectively used GPUs first
+type ByEffectiveUtilization []GpuStatus
+
+func (a ByEffectiveUtilization) Len() int      { return len(a) }
+func (a ByEffectiveUtilization) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ByEffectiveUtilization) Less(i, j int) bool {
+	// NaN scores rank last
+	if iNaN, jNaN := math.IsNaN(a[i].EffectiveUtil), math.IsNaN(a[j].EffectiveUtil); iNaN != jNaN {
+		return jNaN
+	}
+	if a[i].EffectiveUtil != a[j].EffectiveUtil {
+		return a[i].EffectiveUtil > a[j].EffectiveUtil
+	}
+	return ByHostnameAndDeviceID(a).Less(i, j)
+}
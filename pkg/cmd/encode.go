@@ -0,0 +1,279 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// NonFinitePolicy says how NaN, +Inf and -Inf values are written to JSON,
+// which has no representation for them
+type NonFinitePolicy string
+
+const (
+	// NonFiniteDrop omits the field or map entry. Slice elements are written as null.
+	NonFiniteDrop NonFinitePolicy = "drop"
+	// NonFiniteNull writes null
+	NonFiniteNull NonFinitePolicy = "null"
+	// NonFiniteString writes "NaN", "+Inf" or "-Inf"
+	NonFiniteString NonFinitePolicy = "string"
+)
+
+// JSONEncoder encodes responses like encoding/json, but writes NaN and ±Inf
+// values according to a policy instead of failing
+type JSONEncoder struct {
+	// Policy applies to every field without an entry in Fields; null when empty
+	Policy NonFinitePolicy
+	// Fields overrides the policy by JSON field name
+	Fields map[string]NonFinitePolicy
+}
+
+// Validate checks that every policy is known
+func (e *JSONEncoder) Validate() error {
+	if e.Policy != "" && !e.Policy.valid() {
+		return fmt.Errorf("invalid non-finite policy: %s", e.Policy)
+	}
+	for field, policy := range e.Fields {
+		if !policy.valid() {
+			return fmt.Errorf("invalid non-finite policy for field %s: %s", field, policy)
+		}
+	}
+	return nil
+}
+
+// valid reports whether p is a known policy
+func (p NonFinitePolicy) valid() bool {
+	return p == NonFiniteDrop || p == NonFiniteNull || p == NonFiniteString
+}
+
+// Marshal returns the JSON encoding of v
+func (e *JSONEncoder) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := e.encode(&buf, reflect.ValueOf(v), e.policyFor("")); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// policyFor returns the policy of a JSON field
+func (e *JSONEncoder) policyFor(field string) NonFinitePolicy {
+	if policy, ok := e.Fields[field]; ok {
+		return policy
+	}
+	if e.Policy == "" {
+		return NonFiniteNull
+	}
+	return e.Policy
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	gpuStatusType     = reflect.TypeOf(GpuStatus{})
+)
+
+// encode writes v to buf. It returns false without writing anything
+// when v is a non-finite value dropped by policy.
+func (e *JSONEncoder) encode(buf *bytes.Buffer, v reflect.Value, policy NonFinitePolicy) (bool, error) {
+	if !v.IsValid() {
+		buf.WriteString("null")
+		return true, nil
+	}
+	// GpuStatus is written here rather than by its MarshalJSON method so
+	// that the policies also apply to its custom fields
+	if v.Type() == gpuStatusType {
+		return true, e.encodeGpuStatus(buf, v.Interface().(GpuStatus))
+	}
+	if v.Type().Implements(jsonMarshalerType) && v.Type() != reflect.PointerTo(gpuStatusType) {
+		return true, writeJSON(buf, v.Interface())
+	}
+
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if !math.IsNaN(f) && !math.IsInf(f, 0) {
+			return true, writeJSON(buf, v.Interface())
+		}
+		switch policy {
+		case NonFiniteDrop:
+			return false, nil
+		case NonFiniteString:
+			return true, writeJSON(buf, formatNonFinite(f))
+		default:
+			buf.WriteString("null")
+			return true, nil
+		}
+
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			buf.WriteString("null")
+			return true, nil
+		}
+		return e.encode(buf, v.Elem(), policy)
+
+	case reflect.Struct:
+		buf.WriteByte('{')
+		first := true
+		if err := e.encodeFields(buf, v, &first); err != nil {
+			return true, err
+		}
+		buf.WriteByte('}')
+		return true, nil
+
+	case reflect.Map:
+		if v.IsNil() {
+			buf.WriteString("null")
+			return true, nil
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+
+		buf.WriteByte('{')
+		first := true
+		for _, key := range keys {
+			var entry bytes.Buffer
+			ok, err := e.encode(&entry, v.MapIndex(key), policy)
+			if err != nil {
+				return true, err
+			}
+			if !ok {
+				continue
+			}
+			if !first {
+				buf.WriteByte(',')
+			}
+			first = false
+			if err := writeJSON(buf, fmt.Sprint(key)); err != nil {
+				return true, err
+			}
+			buf.WriteByte(':')
+			buf.Write(entry.Bytes())
+		}
+		buf.WriteByte('}')
+		return true, nil
+
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && (v.IsNil() || v.Type().Elem().Kind() == reflect.Uint8) {
+			return true, writeJSON(buf, v.Interface())
+		}
+		buf.WriteByte('[')
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			// Dropping an element would shift the ones after it
+			elemPolicy := policy
+			if elemPolicy == NonFiniteDrop {
+				elemPolicy = NonFiniteNull
+			}
+			if _, err := e.encode(buf, v.Index(i), elemPolicy); err != nil {
+				return true, err
+			}
+		}
+		buf.WriteByte(']')
+		return true, nil
+
+	default:
+		return true, writeJSON(buf, v.Interface())
+	}
+}
+
+// encodeFields writes the exported fields of a struct following the json tags.
+// Fields of embedded structs without a tag are inlined.
+func (e *JSONEncoder) encodeFields(buf *bytes.Buffer, v reflect.Value, first *bool) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+
+		value := v.Field(i)
+		if field.Anonymous && name == "" && value.Kind() == reflect.Struct {
+			if err := e.encodeFields(buf, value, first); err != nil {
+				return err
+			}
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if strings.Contains(opts, "omitempty") && isEmptyValue(value) {
+			continue
+		}
+
+		if err := e.encodeField(buf, name, value, first); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeField writes a single object member unless its value is dropped by policy
+func (e *JSONEncoder) encodeField(buf *bytes.Buffer, name string, value reflect.Value, first *bool) error {
+	var entry bytes.Buffer
+	ok, err := e.encode(&entry, value, e.policyFor(name))
+	if err != nil || !ok {
+		return err
+	}
+
+	if !*first {
+		buf.WriteByte(',')
+	}
+	*first = false
+	if err := writeJSON(buf, name); err != nil {
+		return err
+	}
+	buf.WriteByte(':')
+	buf.Write(entry.Bytes())
+	return nil
+}
+
+// isEmptyValue reports whether v is empty in the sense of the omitempty option
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
+
+// formatNonFinite returns the Prometheus spelling of a non-finite value
+func formatNonFinite(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	default:
+		return "NaN"
+	}
+}
+
+// writeJSON appends the encoding/json encoding of v to buf
+func writeJSON(buf *bytes.Buffer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf.Write(data)
+	return nil
+}
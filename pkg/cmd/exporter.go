@@ -0,0 +1,295 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FetchExporterMetrics scrapes dcgm-exporter /metrics endpoints directly
+// and returns the requested metrics in the same form as FetchPrometheusMetrics
+func FetchExporterMetrics(exporterURLs []string, metricNamesStr string) ([]Result, error) {
+	if len(exporterURLs) == 0 {
+		return nil, fmt.Errorf("exporter URLs are empty")
+	}
+
+	metricNames, err := parseMetricNames(metricNamesStr)
+	if err != nil {
+		return nil, err
+	}
+
+	source := &ExporterSource{URLs: exporterURLs}
+	return source.FetchInstant(context.Background(), metricNames)
+}
+
+// ExporterSource is a MetricSource that scrapes dcgm-exporter endpoints directly.
+// Client is used for every request, the shared default client when nil.
+type ExporterSource struct {
+	URLs   []string
+	Client *http.Client
+}
+
+// FetchInstant scrapes every exporter and keeps the requested metrics
+func (e *ExporterSource) FetchInstant(ctx context.Context, metricNames []string) ([]Result, error) {
+	var allResults []Result
+
+	for _, exporterURL := range e.URLs {
+		results, err := scrapeExporter(ctx, e.client(), exporterURL)
+		if err != nil {
+			return nil, err
+		}
+		allResults = append(allResults, filterResults(results, metricNames)...)
+	}
+
+	if len(allResults) == 0 {
+		return nil, fmt.Errorf("no results returned from exporters")
+	}
+
+	return allResults, nil
+}
+
+// FetchRange is not supported since exporters only expose the current values
+func (e *ExporterSource) FetchRange(ctx context.Context, metricNames []string, start, end time.Time, step time.Duration) ([]Result, error) {
+	return nil, fmt.Errorf("range queries are not supported by the exporter source")
+}
+
+// HealthCheck checks that every exporter can be scraped
+func (e *ExporterSource) HealthCheck(ctx context.Context) error {
+	for _, exporterURL := range e.URLs {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, exporterURL, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := e.client().Do(req)
+		if err != nil {
+			return fmt.Errorf("cannot scrape exporter %s", exporterURL)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("exporter %s returned non-200 status", exporterURL)
+		}
+	}
+	return nil
+}
+
+// client returns the HTTP client used for scrapes
+func (e *ExporterSource) client() *http.Client {
+	if e.Client != nil {
+		return e.Client
+	}
+	return defaultClient
+}
+
+// ParseExporterURLs parses the YAML list of exporter URLs
+func ParseExporterURLs(exporterURLsStr string) ([]string, error) {
+	var exporterURLs []string
+	if err := yaml.Unmarshal([]byte(exporterURLsStr), &exporterURLs); err != nil {
+		return nil, fmt.Errorf("failed to parse exporter URLs: %v", err)
+	}
+	if len(exporterURLs) == 0 {
+		return nil, fmt.Errorf("no exporter URLs provided")
+	}
+	return exporterURLs, nil
+}
+
+// scrapeExporter fetches and parses a single exporter endpoint
+func scrapeExporter(ctx context.Context, client *http.Client, exporterURL string) ([]Result, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, exporterURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scrape exporter %s: %v", exporterURL, err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scrape exporter %s: %v", exporterURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to scrape exporter %s: status %d, body: %s",
+			exporterURL, resp.StatusCode, string(body))
+	}
+
+	results, err := ParseExpositionFormat(resp.Body, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response from exporter %s: %v", exporterURL, err)
+	}
+
+	return results, nil
+}
+
+// ParseExpositionFormat parses the Prometheus text exposition format.
+// Samples without an explicit timestamp are stamped with scrapeTime.
+func ParseExpositionFormat(r io.Reader, scrapeTime time.Time) ([]Result, error) {
+	var results []Result
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		result, err := parseSample(line, scrapeTime)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		results = append(results, result)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// parseSample parses a single `name{labels} value [timestamp]` line
+func parseSample(line string, scrapeTime time.Time) (Result, error) {
+	metric := make(map[string]string)
+
+	nameEnd := strings.IndexAny(line, "{ \t")
+	if nameEnd <= 0 {
+		return Result{}, fmt.Errorf("invalid sample: %q", line)
+	}
+	metric["__name__"] = line[:nameEnd]
+	rest := line[nameEnd:]
+
+	if strings.HasPrefix(rest, "{") {
+		consumed, err := parseLabels(rest[1:], metric)
+		if err != nil {
+			return Result{}, err
+		}
+		rest = rest[1+consumed:]
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 {
+		return Result{}, fmt.Errorf("invalid sample: %q", line)
+	}
+
+	if _, err := strconv.ParseFloat(fields[0], 64); err != nil {
+		return Result{}, fmt.Errorf("invalid value %q: %v", fields[0], err)
+	}
+
+	timestamp := float64(scrapeTime.UnixMilli()) / 1000
+	if len(fields) == 2 {
+		ms, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return Result{}, fmt.Errorf("invalid timestamp %q: %v", fields[1], err)
+		}
+		timestamp = float64(ms) / 1000
+	}
+
+	return Result{
+		Metric: metric,
+		Value:  []interface{}{timestamp, fields[0]},
+	}, nil
+}
+
+// parseLabels parses the label set following the opening brace into metric.
+// It returns the number of bytes consumed including the closing brace.
+func parseLabels(s string, metric map[string]string) (int, error) {
+	i := 0
+	for {
+		for i < len(s) && (s[i] == ' ' || s[i] == ',') {
+			i++
+		}
+		if i >= len(s) {
+			return 0, fmt.Errorf("unterminated label set")
+		}
+		if s[i] == '}' {
+			return i + 1, nil
+		}
+
+		eq := strings.IndexByte(s[i:], '=')
+		if eq < 0 {
+			return 0, fmt.Errorf("invalid label set")
+		}
+		name := strings.TrimSpace(s[i : i+eq])
+		i += eq + 1
+		if i >= len(s) || s[i] != '"' {
+			return 0, fmt.Errorf("label %s: expected quoted value", name)
+		}
+		i++
+
+		var value strings.Builder
+		for {
+			if i >= len(s) {
+				return 0, fmt.Errorf("label %s: unterminated value", name)
+			}
+			c := s[i]
+			if c == '"' {
+				i++
+				break
+			}
+			if c == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(s[i])
+				}
+			} else {
+				value.WriteByte(c)
+			}
+			i++
+		}
+		metric[name] = value.String()
+	}
+}
+
+// WriteExpositionFormat writes instant results in the Prometheus text exposition format
+func WriteExpositionFormat(w io.Writer, results []Result) error {
+	lastName := ""
+	for _, result := range results {
+		name := result.Metric["__name__"]
+		if name != lastName {
+			if _, err := fmt.Fprintf(w, "# TYPE %s gauge\n", name); err != nil {
+				return err
+			}
+			lastName = name
+		}
+
+		labelNames := make([]string, 0, len(result.Metric))
+		for label := range result.Metric {
+			if label != "__name__" {
+				labelNames = append(labelNames, label)
+			}
+		}
+		sort.Strings(labelNames)
+
+		labels := make([]string, 0, len(labelNames))
+		for _, label := range labelNames {
+			labels = append(labels, fmt.Sprintf("%s=\"%s\"", label, escapeLabelValue(result.Metric[label])))
+		}
+
+		value := ""
+		if len(result.Value) == 2 {
+			value, _ = result.Value[1].(string)
+		}
+		if _, err := fmt.Fprintf(w, "%s{%s} %s\n", name, strings.Join(labels, ","), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// escapeLabelValue escapes a label value for the text exposition format
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
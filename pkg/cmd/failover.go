@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"iter"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Circuit breaker defaults for Prometheus replicas
+const (
+	defaultBreakerThreshold = 3
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// circuitBreaker stops sending queries to a replica after consecutive failures
+// until a cooldown has passed, after which a single probe query is let through
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	// probing is set while the probe query of a half-open breaker is in flight
+	probing bool
+}
+
+// replicaBreakers holds the circuit breaker of every replica URL, shared by all sources
+var replicaBreakers = struct {
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}{breakers: make(map[string]*circuitBreaker)}
+
+// breakerFor returns the circuit breaker of a replica URL
+func breakerFor(replicaURL string) *circuitBreaker {
+	replicaBreakers.mu.Lock()
+	defer replicaBreakers.mu.Unlock()
+
+	b, exists := replicaBreakers.breakers[replicaURL]
+	if !exists {
+		b = &circuitBreaker{}
+		replicaBreakers.breakers[replicaURL] = b
+	}
+	return b
+}
+
+// allow reports whether a query may be sent to the replica. Once the cooldown
+// has passed, only the first caller is allowed until its result is recorded.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// success closes the breaker
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+	b.probing = false
+}
+
+// failure records a failed query and opens the breaker once threshold is reached.
+// A failed probe after the cooldown reopens it immediately.
+func (b *circuitBreaker) failure(now time.Time, threshold int, cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.failures >= threshold {
+		b.openUntil = now.Add(cooldown)
+	}
+}
+
+// ParseReplicaURLs splits a comma-separated list of equivalent Prometheus URLs
+func ParseReplicaURLs(urlsStr string) []string {
+	var urls []string
+	for _, u := range strings.Split(urlsStr, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// replicas yields the replicas to try, in configured or random order.
+// Replicas with an open breaker are skipped unless every breaker is open,
+// in which case all replicas are tried rather than failing without a query.
+// The breakers are checked as the replicas are reached, so that a half-open
+// breaker only lets its probe through when the replica is actually queried.
+func (p *PrometheusSource) replicas() iter.Seq[string] {
+	return func(yield func(string) bool) {
+		replicas := append([]string(nil), p.URLs...)
+		if p.Randomize {
+			rand.Shuffle(len(replicas), func(i, j int) {
+				replicas[i], replicas[j] = replicas[j], replicas[i]
+			})
+		}
+
+		now := time.Now()
+		skipped := 0
+		for _, replica := range replicas {
+			if !breakerFor(replica).allow(now) {
+				skipped++
+				continue
+			}
+			if !yield(replica) {
+				return
+			}
+		}
+		if skipped < len(replicas) {
+			return
+		}
+		for _, replica := range replicas {
+			if !yield(replica) {
+				return
+			}
+		}
+	}
+}
+
+// recordResult updates the breaker of a replica after a query
+func (p *PrometheusSource) recordResult(replica string, failed bool) {
+	b := breakerFor(replica)
+	if !failed {
+		b.success()
+		return
+	}
+
+	threshold, cooldown := p.BreakerThreshold, p.BreakerCooldown
+	if threshold <= 0 {
+		threshold = defaultBreakerThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	b.failure(time.Now(), threshold, cooldown)
+}
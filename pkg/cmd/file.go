@@ -0,0 +1,237 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileSource is a MetricSource that replays recorded Prometheus query responses.
+// Path is either a single snapshot or a directory of snapshots (*.json) that are
+// played back in file name order, so timestamped names replay chronologically.
+type FileSource struct {
+	Path string
+
+	// Interval is how long each snapshot of a directory is served.
+	// When zero, every request advances to the next snapshot; the queries
+	// of one request (e.g. its custom fields) share the same snapshot.
+	Interval time.Duration
+
+	// Rebase rewrites the sample timestamps to the fetch time so replayed data looks current
+	Rebase bool
+
+	mu      sync.Mutex
+	started time.Time
+	fetches int
+}
+
+// FetchInstant returns the requested metrics from the current snapshot
+func (f *FileSource) FetchInstant(ctx context.Context, metricNames []string) ([]Result, error) {
+	files, err := f.snapshotFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	path := files[f.nextSnapshot(ctx, len(files))]
+	results, err := readPrometheusFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := filterResults(results, metricNames)
+	if len(filtered) == 0 {
+		return nil, fmt.Errorf("no results found in %s", path)
+	}
+
+	if f.Rebase {
+		now := float64(time.Now().UnixMilli()) / 1000
+		for i, result := range filtered {
+			if len(result.Value) == 2 {
+				filtered[i].Value = []interface{}{now, result.Value[1]}
+			}
+		}
+	}
+
+	return filtered, nil
+}
+
+// FetchRange returns the recorded samples of the requested metrics between start and end,
+// combining the samples of every snapshot in a directory into one series per label set
+func (f *FileSource) FetchRange(ctx context.Context, metricNames []string, start, end time.Time, step time.Duration) ([]Result, error) {
+	files, err := f.snapshotFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	seriesMap := make(map[string]*Result)
+	var keys []string
+	for _, path := range files {
+		results, err := readPrometheusFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, result := range filterResults(results, metricNames) {
+			// Clone the samples so that appending never writes to the recorded results
+			samples := slices.Clone(result.Values)
+			if len(result.Value) > 0 {
+				samples = append(samples, result.Value)
+			}
+
+			for _, sample := range samples {
+				sampleResult := Result{Value: sample}
+				timestamp, err := sampleResult.GetTimestamp()
+				if err != nil || timestamp.Before(start) || timestamp.After(end) {
+					continue
+				}
+
+				key := seriesKey(result.Metric)
+				series, exists := seriesMap[key]
+				if !exists {
+					series = &Result{Metric: result.Metric}
+					seriesMap[key] = series
+					keys = append(keys, key)
+				}
+				series.Values = append(series.Values, sample)
+			}
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no results found in %s between %s and %s", f.Path, start, end)
+	}
+
+	ranged := make([]Result, 0, len(keys))
+	for _, key := range keys {
+		ranged = append(ranged, *seriesMap[key])
+	}
+	return ranged, nil
+}
+
+// HealthCheck checks that every snapshot can be read
+func (f *FileSource) HealthCheck(ctx context.Context) error {
+	files, err := f.snapshotFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, path := range files {
+		if _, err := readPrometheusFile(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotFiles returns the snapshot files in playback order
+func (f *FileSource) snapshotFiles() ([]string, error) {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metrics file: %v", err)
+	}
+	if !info.IsDir() {
+		return []string{f.Path}, nil
+	}
+
+	entries, err := os.ReadDir(f.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metrics directory: %v", err)
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			files = append(files, filepath.Join(f.Path, entry.Name()))
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no snapshots found in %s", f.Path)
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// snapshotPin is the snapshot served to every query of a request
+type snapshotPin struct {
+	once  sync.Once
+	index int
+}
+
+// snapshotPinKey is the context key of the snapshot pin of a request
+type snapshotPinKey struct{}
+
+// withSnapshotPin returns a context whose queries are served the same snapshot
+func withSnapshotPin(ctx context.Context) context.Context {
+	return context.WithValue(ctx, snapshotPinKey{}, &snapshotPin{})
+}
+
+// nextSnapshot returns the index of the snapshot to serve, looping over the
+// sequence, or the snapshot already chosen for the request of ctx
+func (f *FileSource) nextSnapshot(ctx context.Context, count int) int {
+	if pin, ok := ctx.Value(snapshotPinKey{}).(*snapshotPin); ok {
+		pin.once.Do(func() {
+			pin.index = f.advance(count)
+		})
+		return pin.index % count
+	}
+	return f.advance(count)
+}
+
+// advance returns the index of the next snapshot to serve
+func (f *FileSource) advance(count int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Interval > 0 {
+		if f.started.IsZero() {
+			f.started = time.Now()
+		}
+		return int(time.Since(f.started)/f.Interval) % count
+	}
+
+	index := f.fetches % count
+	f.fetches++
+	return index
+}
+
+// readPrometheusFile reads the results of a recorded Prometheus query response
+func readPrometheusFile(path string) ([]Result, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metrics file: %v", err)
+	}
+
+	var pResp PrometheusResponse
+	if err := json.Unmarshal(data, &pResp); err != nil {
+		return nil, fmt.Errorf("failed to decode metrics file %s: %v", path, err)
+	}
+
+	if pResp.Status != "success" {
+		return nil, fmt.Errorf("metrics file %s has non-success status: %s", path, pResp.Status)
+	}
+
+	return pResp.Data.Result, nil
+}
+
+// seriesKey returns a string identifying the label set of a series
+func seriesKey(metric map[string]string) string {
+	names := make([]string, 0, len(metric))
+	for name := range metric {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s=%q,", name, metric[name])
+	}
+	return b.String()
+}
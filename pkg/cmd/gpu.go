@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"math"
 	"sort"
 	"time"
 )
@@ -13,10 +14,29 @@ const (
 	MetricGPUMemoryUsed = "DCGM_FI_DEV_FB_USED"
 	MetricGPUUtil       = "DCGM_FI_DEV_GPU_UTIL"
 	MetricGPUMemoryUtil = "DCGM_FI_DEV_MEM_COPY_UTIL"
+
+	MetricClockThrottleReasons = "DCGM_FI_DEV_CLOCK_THROTTLE_REASONS"
+	MetricClocksEventReasons   = "DCGM_FI_DEV_CLOCKS_EVENT_REASONS"
+	MetricXIDErrors            = "DCGM_FI_DEV_XID_ERRORS"
+
+	MetricPCIeTxBytes      = "DCGM_FI_PROF_PCIE_TX_BYTES"
+	MetricPCIeRxBytes      = "DCGM_FI_PROF_PCIE_RX_BYTES"
+	MetricPCIeTxThroughput = "DCGM_FI_DEV_PCIE_TX_THROUGHPUT"
+	MetricPCIeRxThroughput = "DCGM_FI_DEV_PCIE_RX_THROUGHPUT"
+	MetricNVLinkTxBytes    = "DCGM_FI_PROF_NVLINK_TX_BYTES"
+	MetricNVLinkRxBytes    = "DCGM_FI_PROF_NVLINK_RX_BYTES"
+	MetricNVLinkBandwidth  = "DCGM_FI_DEV_NVLINK_BANDWIDTH_TOTAL"
+
+	MetricSMActive       = "DCGM_FI_PROF_SM_ACTIVE"
+	MetricSMOccupancy    = "DCGM_FI_PROF_SM_OCCUPANCY"
+	MetricTensorActive   = "DCGM_FI_PROF_PIPE_TENSOR_ACTIVE"
+	MetricDRAMActive     = "DCGM_FI_PROF_DRAM_ACTIVE"
+	MetricGREngineActive = "DCGM_FI_PROF_GR_ENGINE_ACTIVE"
 )
 
 // GpuStatus represents the status of a GPU
 type GpuStatus struct {
+	Cluster   string    `json:"cluster,omitempty"`
 	Hostname  string    `json:"Hostname"`
 	DeviceID  string    `json:"gpu"`
 	UUID      string    `json:"uuid"`
@@ -28,6 +48,40 @@ type GpuStatus struct {
 	GPUUtil   float64   `json:"gpu_utilization"`
 	MemUtil   float64   `json:"gpu_memory_utilization"`
 	GPUTemp   float64   `json:"gpu_temp"`
+
+	// Kubernetes pod using the GPU, when dcgm-exporter maps GPUs to pods
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+
+	ThrottleMask    uint64   `json:"throttle_reasons_mask,omitempty"`
+	ThrottleReasons []string `json:"throttle_reasons,omitempty"`
+	XIDError        float64  `json:"xid_error,omitempty"`
+
+	// Throughput in bytes/sec
+	PCIeTxBytes   float64            `json:"pcie_tx_bytes_per_sec,omitempty"`
+	PCIeRxBytes   float64            `json:"pcie_rx_bytes_per_sec,omitempty"`
+	NVLinkTxBytes float64            `json:"nvlink_tx_bytes_per_sec,omitempty"`
+	NVLinkRxBytes float64            `json:"nvlink_rx_bytes_per_sec,omitempty"`
+	NVLinkBytes   float64            `json:"nvlink_bytes_per_sec,omitempty"`
+	NVLinkLinks   map[string]float64 `json:"nvlink_link_bytes_per_sec,omitempty"`
+
+	// Profiling metrics as fractions between 0 and 1
+	SMActive       float64 `json:"sm_active,omitempty"`
+	SMOccupancy    float64 `json:"sm_occupancy,omitempty"`
+	TensorActive   float64 `json:"tensor_active,omitempty"`
+	DRAMActive     float64 `json:"dram_active,omitempty"`
+	GREngineActive float64 `json:"gr_engine_active,omitempty"`
+	EffectiveUtil  float64 `json:"effective_utilization"`
+
+	// Custom holds the values of the configured custom fields by name,
+	// written as top-level fields by MarshalJSON
+	Custom map[string]float64 `json:"-"`
+
+	// has* record whether the profiling metrics were collected
+	hasSMActivity  bool
+	hasSMOccupancy bool
+	hasTensor      bool
+	hasGREngine    bool
 }
 
 // ByHostnameAndDeviceID implements sort.Interface for []GpuStatus based on Hostname and DeviceID
@@ -48,6 +102,15 @@ func ConvertUTCToJST(utcTime time.Time) time.Time {
 	return utcTime.In(jst)
 }
 
+// podLabel returns a pod label added by dcgm-exporter. Prometheus renames it to
+// exported_<name> when it clashes with the label of the scraped target.
+func podLabel(metric map[string]string, name string) string {
+	if value := metric["exported_"+name]; value != "" {
+		return value
+	}
+	return metric[name]
+}
+
 // MergeGpuMetrics merges Prometheus metrics into GPU status
 func MergeGpuMetrics(results []Result) ([]GpuStatus, error) {
 	if len(results) == 0 {
@@ -65,6 +128,7 @@ func MergeGpuMetrics(results []Result) ([]GpuStatus, error) {
 		status, exists := gpuMap[uuid]
 		if !exists {
 			status = &GpuStatus{
+				Cluster:  result.Metric[clusterLabel],
 				Hostname: result.Metric["Hostname"],
 				DeviceID: result.Metric["gpu"],
 				Name:     result.Metric["modelName"],
@@ -72,6 +136,10 @@ func MergeGpuMetrics(results []Result) ([]GpuStatus, error) {
 			}
 			gpuMap[uuid] = status
 		}
+		if pod := podLabel(result.Metric, "pod"); status.Pod == "" && pod != "" {
+			status.Namespace = podLabel(result.Metric, "namespace")
+			status.Pod = pod
+		}
 
 		timestamp, err := result.GetTimestamp()
 		if err == nil {
@@ -95,8 +163,48 @@ func MergeGpuMetrics(results []Result) ([]GpuStatus, error) {
 			status.MemUtil = val
 		case MetricGPUTemp:
 			status.GPUTemp = val
+		case MetricClockThrottleReasons, MetricClocksEventReasons:
+			if math.IsNaN(val) || math.IsInf(val, 0) {
+				// A non-finite bitmask has no reasons to decode
+				continue
+			}
+			status.ThrottleMask = uint64(val)
+			status.ThrottleReasons = DecodeThrottleReasons(status.ThrottleMask)
+		case MetricXIDErrors:
+			status.XIDError = val
+		case MetricPCIeTxBytes:
+			status.PCIeTxBytes = val
+		case MetricPCIeRxBytes:
+			status.PCIeRxBytes = val
+		case MetricPCIeTxThroughput:
+			status.PCIeTxBytes = val * bytesPerKiB
+		case MetricPCIeRxThroughput:
+			status.PCIeRxBytes = val * bytesPerKiB
+		case MetricNVLinkTxBytes:
+			status.NVLinkTxBytes = val
+		case MetricNVLinkRxBytes:
+			status.NVLinkRxBytes = val
+		case MetricSMActive:
+			status.SMActive = val
+			status.hasSMActivity = true
+		case MetricSMOccupancy:
+			status.SMOccupancy = val
+			status.hasSMOccupancy = true
+		case MetricTensorActive:
+			status.TensorActive = val
+			status.hasTensor = true
+		case MetricDRAMActive:
+			status.DRAMActive = val
+		case MetricGREngineActive:
+			status.GREngineActive = val
+			status.hasGREngine = true
+		case MetricNVLinkBandwidth:
+			setNVLinkRate(status, metricName, val)
 		default:
-			return nil, fmt.Errorf("invalid metric name: %s", metricName)
+			if _, ok := nvlinkLane(metricName); !ok {
+				return nil, fmt.Errorf("invalid metric name: %s", metricName)
+			}
+			setNVLinkRate(status, metricName, val)
 		}
 		if status.MemFree != 0 && status.MemUsed != 0 {
 			status.MemTotal = status.MemFree + status.MemUsed
@@ -109,6 +217,7 @@ func MergeGpuMetrics(results []Result) ([]GpuStatus, error) {
 
 	statuses := make([]GpuStatus, 0, len(gpuMap))
 	for _, s := range gpuMap {
+		s.EffectiveUtil = s.EffectiveUtilization()
 		statuses = append(statuses, *s)
 	}
 
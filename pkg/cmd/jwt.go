@@ -0,0 +1,603 @@
+package cmd
+
+import (
+	"cmp"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultNamespacesClaim     = "namespaces"
+	defaultGroupsClaim         = "groups"
+	defaultJWKSRefreshInterval = 5 * time.Minute
+
+	// jwksMinRefetch limits the fetches of the JWKS URL for tokens signed by unknown keys
+	jwksMinRefetch = 10 * time.Second
+	// jwtLeeway tolerates clock skew with the token issuer
+	jwtLeeway = time.Minute
+)
+
+// JWTConfig configures the authentication of clients by JWT bearer tokens, e.g.
+// issued by an OIDC provider. Admins see every GPU, other clients only the GPUs
+// allocated to the namespaces granted by their claims.
+type JWTConfig struct {
+	// JWKSURL or JWKSFile is the JSON Web Key Set verifying the token signatures
+	JWKSURL  string `yaml:"jwks_url"`
+	JWKSFile string `yaml:"jwks_file"`
+	// JWKSRefreshInterval is how often the JWKS URL is fetched again (default 5m);
+	// a token signed by an unknown key also fetches it
+	JWKSRefreshInterval time.Duration `yaml:"jwks_refresh_interval"`
+	// Issuer and Audience, when set, must match the iss and aud claims
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	// NamespacesClaim (default namespaces) and GroupsClaim (default groups) name
+	// the claims listing the namespaces and groups of the client, with dots
+	// separating nested claims as in realm_access.roles
+	NamespacesClaim string `yaml:"namespaces_claim"`
+	GroupsClaim     string `yaml:"groups_claim"`
+	// AdminGroups see every GPU; GroupNamespaces grants namespaces to the members of a group
+	AdminGroups     []string            `yaml:"admin_groups"`
+	GroupNamespaces map[string][]string `yaml:"group_namespaces"`
+}
+
+// Enabled reports whether JWT bearer tokens are accepted
+func (c *JWTConfig) Enabled() bool {
+	return c.JWKSURL != "" || c.JWKSFile != ""
+}
+
+// applyEnv overrides the JWT settings with the environment variables
+func (c *JWTConfig) applyEnv() error {
+	strs := []struct {
+		name  string
+		value *string
+	}{
+		{"JWT_JWKS_URL", &c.JWKSURL},
+		{"JWT_JWKS_FILE", &c.JWKSFile},
+		{"JWT_ISSUER", &c.Issuer},
+		{"JWT_AUDIENCE", &c.Audience},
+		{"JWT_NAMESPACES_CLAIM", &c.NamespacesClaim},
+		{"JWT_GROUPS_CLAIM", &c.GroupsClaim},
+	}
+	for _, s := range strs {
+		if v := os.Getenv(s.name); v != "" {
+			*s.value = v
+		}
+	}
+
+	if v := os.Getenv("JWT_JWKS_REFRESH_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid JWT_JWKS_REFRESH_INTERVAL: %v", err)
+		}
+		c.JWKSRefreshInterval = interval
+	}
+	if v := os.Getenv("JWT_ADMIN_GROUPS"); v != "" {
+		if err := yaml.Unmarshal([]byte(v), &c.AdminGroups); err != nil {
+			return fmt.Errorf("failed to parse JWT_ADMIN_GROUPS: %v", err)
+		}
+	}
+	if v := os.Getenv("JWT_GROUP_NAMESPACES"); v != "" {
+		if err := yaml.Unmarshal([]byte(v), &c.GroupNamespaces); err != nil {
+			return fmt.Errorf("failed to parse JWT_GROUP_NAMESPACES: %v", err)
+		}
+	}
+	return nil
+}
+
+// Validate checks that the settings are consistent
+func (c *JWTConfig) Validate() error {
+	if !c.Enabled() {
+		if c.Issuer != "" || c.Audience != "" || len(c.AdminGroups) > 0 || len(c.GroupNamespaces) > 0 {
+			return fmt.Errorf("jwks_url or jwks_file is required")
+		}
+		return nil
+	}
+	if c.JWKSURL != "" && c.JWKSFile != "" {
+		return fmt.Errorf("jwks_url and jwks_file are mutually exclusive")
+	}
+	if c.JWKSURL != "" {
+		u, err := url.Parse(c.JWKSURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid jwks_url: %s", c.JWKSURL)
+		}
+	}
+	if c.JWKSRefreshInterval < 0 {
+		return fmt.Errorf("jwks_refresh_interval must not be negative")
+	}
+	return nil
+}
+
+// tenantEndpoints are the data endpoints, besides the metrics endpoint,
+// that clients outside the admin groups may call
+var tenantEndpoints = []string{"/gpus/*", "/hosts", "/hosts/*", "/throttling"}
+
+// newJWTAuth returns the verifier of the tokens. A JWKS file is read at once;
+// a JWKS URL is only fetched for the first token, so that an unreachable
+// issuer does not prevent the server from starting.
+func (c *JWTConfig) newJWTAuth(metricsEndpoint string) (*JWTAuth, error) {
+	a := &JWTAuth{
+		config:    *c,
+		endpoints: append([]string{metricsEndpoint}, tenantEndpoints...),
+		now:       time.Now,
+	}
+	if c.JWKSFile != "" {
+		file := &fileJWKS{path: c.JWKSFile}
+		if _, err := file.load(context.Background(), false); err != nil {
+			return nil, err
+		}
+		a.keys = file
+	} else {
+		a.keys = &urlJWKS{
+			url:      c.JWKSURL,
+			client:   defaultClient,
+			interval: cmp.Or(c.JWKSRefreshInterval, defaultJWKSRefreshInterval),
+		}
+	}
+	return a, nil
+}
+
+// JWTAuth authenticates clients by JWT bearer tokens signed with RS256, RS384,
+// RS512, ES256, ES384 or ES512
+type JWTAuth struct {
+	config JWTConfig
+	keys   jwksSource
+	// endpoints are the paths clients outside the admin groups may call
+	endpoints []string
+	now       func() time.Time
+}
+
+// jwtAlgorithm is a supported signature algorithm
+type jwtAlgorithm struct {
+	hash  crypto.Hash
+	curve elliptic.Curve // nil for RSA
+}
+
+// jwtAlgorithms are the supported signature algorithms by name
+var jwtAlgorithms = map[string]jwtAlgorithm{
+	"RS256": {hash: crypto.SHA256},
+	"RS384": {hash: crypto.SHA384},
+	"RS512": {hash: crypto.SHA512},
+	"ES256": {hash: crypto.SHA256, curve: elliptic.P256()},
+	"ES384": {hash: crypto.SHA384, curve: elliptic.P384()},
+	"ES512": {hash: crypto.SHA512, curve: elliptic.P521()},
+}
+
+// isJWT reports whether a bearer token is a JWT rather than an API key
+func isJWT(token string) bool {
+	// The header of a JWT is a JSON object, which always encodes to eyJ
+	return strings.Count(token, ".") == 2 && strings.HasPrefix(token, "eyJ")
+}
+
+// Authenticate verifies the token and returns the client with the namespaces its
+// claims grant. Only admins may call the admin and simulator endpoints.
+func (a *JWTAuth) Authenticate(ctx context.Context, token string) (*Identity, error) {
+	claims, err := a.verify(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	id := &Identity{ID: "jwt"}
+	if sub, _ := claims["sub"].(string); sub != "" {
+		id.ID = "jwt:" + sub
+	}
+
+	groups := claimStrings(claims, cmp.Or(a.config.GroupsClaim, defaultGroupsClaim))
+	for _, group := range groups {
+		if slices.Contains(a.config.AdminGroups, group) {
+			id.Admin = true
+			return id, nil
+		}
+	}
+
+	namespaces := claimStrings(claims, cmp.Or(a.config.NamespacesClaim, defaultNamespacesClaim))
+	for _, group := range groups {
+		namespaces = append(namespaces, a.config.GroupNamespaces[group]...)
+	}
+	if len(namespaces) == 0 {
+		return nil, fmt.Errorf("%w: token of %s grants no namespaces", ErrAccessDenied, id.ID)
+	}
+	slices.Sort(namespaces)
+	id.Namespaces = slices.Compact(namespaces)
+	id.Endpoints = a.endpoints
+	return id, nil
+}
+
+// verify checks the signature and the registered claims of the token and returns its claims
+func (a *JWTAuth) verify(ctx context.Context, token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: malformed header", ErrInvalidToken)
+	}
+	alg, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrInvalidToken)
+	}
+
+	key, err := a.key(ctx, header.Kid, header.Alg)
+	if err != nil {
+		return nil, err
+	}
+	h := alg.hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if !verifySignature(key.key, alg, h.Sum(nil), signature) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed claims", ErrInvalidToken)
+	}
+	if err := a.checkClaims(claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return claims, nil
+}
+
+// key returns the key of the JWKS that signed a token, fetching the JWKS
+// again when the key is unknown in case the issuer rotated its keys
+func (a *JWTAuth) key(ctx context.Context, kid, alg string) (*jsonWebKey, error) {
+	for _, refresh := range []bool{false, true} {
+		keys, err := a.keys.load(ctx, refresh)
+		if err != nil {
+			return nil, err
+		}
+		for i := range keys {
+			k := &keys[i]
+			if (kid == "" || k.kid == kid) && k.accepts(alg) {
+				return k, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: no key %q for %s in the JWKS", ErrInvalidToken, kid, alg)
+}
+
+// checkClaims checks the expiry, issuer and audience of a token
+func (a *JWTAuth) checkClaims(claims map[string]any) error {
+	now := a.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return fmt.Errorf("token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("token is not valid yet")
+	}
+	if a.config.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != a.config.Issuer {
+			return fmt.Errorf("unexpected issuer %q", iss)
+		}
+	}
+	if a.config.Audience != "" && !slices.Contains(claimStrings(claims, "aud"), a.config.Audience) {
+		return fmt.Errorf("token is not intended for audience %s", a.config.Audience)
+	}
+	return nil
+}
+
+// decodeSegment decodes a base64url-encoded JSON segment of a token
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifySignature checks a PKCS #1 v1.5 or ECDSA signature of digest
+func verifySignature(key crypto.PublicKey, alg jwtAlgorithm, digest, signature []byte) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return alg.curve == nil && rsa.VerifyPKCS1v15(key, alg.hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		// JWS encodes ECDSA signatures as the fixed-size concatenation of r and s
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg.curve != key.Curve || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+// claimStrings returns a claim holding a string or a list of strings, with
+// dots in name separating nested claims
+func claimStrings(claims map[string]any, name string) []string {
+	var value any = claims
+	for _, part := range strings.Split(name, ".") {
+		m, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = m[part]
+	}
+
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// jsonWebKey is a public signing key of a JWKS
+type jsonWebKey struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+// accepts reports whether the key may verify a signature made with alg
+func (k *jsonWebKey) accepts(alg string) bool {
+	if k.alg != "" && k.alg != alg {
+		return false
+	}
+	_, isRSA := k.key.(*rsa.PublicKey)
+	return isRSA == (jwtAlgorithms[alg].curve == nil)
+}
+
+// parseJWKS returns the RSA and EC signing keys of a JSON Web Key Set,
+// ignoring the keys of other types and uses
+func parseJWKS(data []byte) ([]jsonWebKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Alg string `json:"alg"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	var keys []jsonWebKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil || len(e) > 4 {
+				return nil, fmt.Errorf("invalid RSA key %q", k.Kid)
+			}
+			key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+			curve, ok := curves[k.Crv]
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if !ok || errX != nil || errY != nil {
+				return nil, fmt.Errorf("invalid EC key %q", k.Kid)
+			}
+			pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !curve.IsOnCurve(pub.X, pub.Y) {
+				return nil, fmt.Errorf("invalid EC key %q", k.Kid)
+			}
+			key = pub
+		default:
+			continue
+		}
+		keys = append(keys, jsonWebKey{kid: k.Kid, alg: k.Alg, key: key})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no RSA or EC signing keys")
+	}
+	return keys, nil
+}
+
+// jwksSource provides the keys of a JWKS; refresh asks for the keys to be
+// read again when a token is signed by an unknown key
+type jwksSource interface {
+	load(ctx context.Context, refresh bool) ([]jsonWebKey, error)
+}
+
+// fileJWKS is a JWKS file re-read when it changes
+type fileJWKS struct {
+	path string
+
+	mu sync.Mutex
+	// modTime is the modification time of the last read, even a failed one,
+	// so that a broken file is read and reported once per change
+	modTime time.Time
+	keys    []jsonWebKey
+	err     error
+}
+
+// load returns the current keys, re-reading the file if it was modified.
+// Once keys were read, failures to re-read the file keep the previous keys.
+func (f *fileJWKS) load(ctx context.Context, refresh bool) ([]jsonWebKey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	switch {
+	case err != nil:
+		err = fmt.Errorf("failed to read JWKS file: %v", err)
+		if f.err == nil || f.err.Error() != err.Error() {
+			f.fail(err)
+		}
+		f.modTime = time.Time{}
+	case !info.ModTime().Equal(f.modTime):
+		f.modTime = info.ModTime()
+		if keys, err := f.read(); err != nil {
+			f.fail(err)
+		} else {
+			f.keys, f.err = keys, nil
+		}
+	}
+
+	if f.keys == nil {
+		return nil, f.err
+	}
+	return f.keys, nil
+}
+
+// fail records the error of a read, which is logged when previous keys are kept
+func (f *fileJWKS) fail(err error) {
+	f.err = err
+	if f.keys != nil {
+		log.Printf("Warning: %v, keeping the previous keys", err)
+	}
+}
+
+// read reads and parses the keys of the file
+func (f *fileJWKS) read() ([]jsonWebKey, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWKS file: %v", err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWKS file %s: %v", f.path, err)
+	}
+	return keys, nil
+}
+
+// urlJWKS is a JWKS fetched from the issuer and refreshed periodically
+type urlJWKS struct {
+	url      string
+	client   *http.Client
+	interval time.Duration
+
+	mu        sync.Mutex
+	fetched   time.Time
+	refreshed time.Time
+	keys      []jsonWebKey
+	// failed and err record the last failed fetch while no keys were ever fetched
+	failed time.Time
+	err    error
+	// fetching is closed when the fetch in flight completes
+	fetching chan struct{}
+}
+
+// load returns the keys, fetching them again when they are older than the
+// refresh interval, or on refresh at most every jwksMinRefetch so that tokens
+// with made-up key IDs cannot flood the issuer. The previous keys are kept
+// when a fetch fails, and until a first fetch succeeds, fetches are retried
+// at most every jwksMinRefetch. Concurrent requests wait for a single fetch,
+// without holding the lock during it.
+func (u *urlJWKS) load(ctx context.Context, refresh bool) ([]jsonWebKey, error) {
+	u.mu.Lock()
+	stale := u.keys == nil || time.Since(u.fetched) >= u.interval
+	if refresh && time.Since(u.refreshed) >= jwksMinRefetch {
+		u.refreshed = time.Now()
+		stale = true
+	}
+	if !stale || (u.keys == nil && time.Since(u.failed) < jwksMinRefetch) {
+		keys, err := u.keys, u.err
+		u.mu.Unlock()
+		return keys, err
+	}
+
+	if wait := u.fetching; wait != nil {
+		u.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		if u.keys == nil {
+			return nil, u.err
+		}
+		return u.keys, nil
+	}
+	done := make(chan struct{})
+	u.fetching = done
+	u.mu.Unlock()
+
+	// The fetch is shared, so it must not fail because this client went away
+	keys, err := u.fetch(context.WithoutCancel(ctx))
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.fetching = nil
+	close(done)
+	if err != nil {
+		if u.keys == nil {
+			u.failed, u.err = time.Now(), err
+			return nil, err
+		}
+		log.Printf("Warning: %v, keeping the previous keys", err)
+		u.fetched = time.Now()
+		return u.keys, nil
+	}
+	u.keys, u.err = keys, nil
+	u.fetched = time.Now()
+	return u.keys, nil
+}
+
+// fetch downloads and parses the JWKS
+func (u *urlJWKS) fetch(ctx context.Context) ([]jsonWebKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JWKS request: %v", err)
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWKS: %v", err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWKS from %s: %v", u.url, err)
+	}
+	return keys, nil
+}
@@ -0,0 +1,291 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// clusterLabel is the label holding the name of the backend a result came from
+const clusterLabel = "cluster"
+
+// NamedSource is a MetricSource identified by a cluster name
+type NamedSource struct {
+	Name   string
+	Source MetricSource
+}
+
+// MultiSource queries several backends concurrently and merges their results.
+// Every result is tagged with the cluster label of its backend, and GPUs seen
+// by more than one backend (e.g. HA pairs) are reported once.
+type MultiSource struct {
+	Backends []NamedSource
+}
+
+// PartialError reports the backends that failed while others succeeded
+type PartialError struct {
+	Errors map[string]error
+}
+
+// Error implements the error interface
+func (e *PartialError) Error() string {
+	names := e.Backends()
+	messages := make([]string, 0, len(names))
+	for _, name := range names {
+		messages = append(messages, fmt.Sprintf("%s: %v", name, e.Errors[name]))
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Unwrap returns the backend errors in the order of Backends
+func (e *PartialError) Unwrap() []error {
+	names := e.Backends()
+	errs := make([]error, 0, len(names))
+	for _, name := range names {
+		errs = append(errs, e.Errors[name])
+	}
+	return errs
+}
+
+// Backends returns the names of the failed backends in sorted order
+func (e *PartialError) Backends() []string {
+	names := make([]string, 0, len(e.Errors))
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// replicaList is a list of replica URLs that can also be written as a single
+// (optionally comma-separated) string in YAML
+type replicaList []string
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (l *replicaList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = ParseReplicaURLs(value.Value)
+		return nil
+	}
+	var urls []string
+	if err := value.Decode(&urls); err != nil {
+		return err
+	}
+	*l = urls
+	return nil
+}
+
+// ParsePrometheusBackends parses the YAML map of cluster names to Prometheus URLs.
+// A cluster may list several equivalent replicas for failover.
+func ParsePrometheusBackends(backendsStr string) ([]NamedSource, error) {
+	urls, err := parseBackendURLs(backendsStr)
+	if err != nil {
+		return nil, err
+	}
+
+	backends := make([]NamedSource, 0, len(urls))
+	for name, replicas := range urls {
+		backends = append(backends, NamedSource{Name: name, Source: &PrometheusSource{URLs: replicas}})
+	}
+	sort.Slice(backends, func(i, j int) bool {
+		return backends[i].Name < backends[j].Name
+	})
+	return backends, nil
+}
+
+// parseBackendURLs parses the YAML map of cluster names to replica URLs
+func parseBackendURLs(backendsStr string) (map[string]replicaList, error) {
+	var urls map[string]replicaList
+	if err := yaml.Unmarshal([]byte(backendsStr), &urls); err != nil {
+		return nil, fmt.Errorf("failed to parse Prometheus backends: %v", err)
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no Prometheus backends provided")
+	}
+	for name, replicas := range urls {
+		if len(replicas) == 0 {
+			return nil, fmt.Errorf("prometheus backend %s has an empty URL", name)
+		}
+	}
+	return urls, nil
+}
+
+// FetchInstant queries every backend and keeps the newest sample of every GPU metric
+func (m *MultiSource) FetchInstant(ctx context.Context, metricNames []string) ([]Result, error) {
+	ctx, backends := m.scope(ctx)
+	perBackend, err := m.fetchAll(backends, func(source MetricSource) ([]Result, error) {
+		return source.FetchInstant(ctx, metricNames)
+	})
+
+	newest := make(map[string]int)
+	var merged []Result
+	for _, results := range perBackend {
+		for _, result := range results {
+			uuid := result.Metric["UUID"]
+			if uuid == "" {
+				merged = append(merged, result)
+				continue
+			}
+
+			key := uuid + "/" + result.Metric["__name__"]
+			i, exists := newest[key]
+			if !exists {
+				newest[key] = len(merged)
+				merged = append(merged, result)
+				continue
+			}
+			if resultTime(result).After(resultTime(merged[i])) {
+				merged[i] = result
+			}
+		}
+	}
+
+	return merged, err
+}
+
+// FetchRange queries every backend and keeps one series per GPU metric
+func (m *MultiSource) FetchRange(ctx context.Context, metricNames []string, start, end time.Time, step time.Duration) ([]Result, error) {
+	ctx, backends := m.scope(ctx)
+	perBackend, err := m.fetchAll(backends, func(source MetricSource) ([]Result, error) {
+		return source.FetchRange(ctx, metricNames, start, end, step)
+	})
+
+	seen := make(map[string]bool)
+	var merged []Result
+	for _, results := range perBackend {
+		for _, result := range results {
+			if uuid := result.Metric["UUID"]; uuid != "" {
+				key := uuid + "/" + result.Metric["__name__"]
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+			}
+			merged = append(merged, result)
+		}
+	}
+
+	return merged, err
+}
+
+// HealthCheck succeeds when at least one backend is healthy
+func (m *MultiSource) HealthCheck(ctx context.Context) error {
+	_, err := m.fetchAll(m.Backends, func(source MetricSource) ([]Result, error) {
+		return nil, source.HealthCheck(ctx)
+	})
+
+	var partial *PartialError
+	if err != nil && !errors.As(err, &partial) {
+		return err
+	}
+	return nil
+}
+
+// scope selects the backends matching the per-request matchers on the cluster
+// label and returns a context with the remaining matchers to push down
+func (m *MultiSource) scope(ctx context.Context) (context.Context, []NamedSource) {
+	var clusterMatchers, others []LabelMatcher
+	renamed := false
+	for _, matcher := range matchersFrom(ctx) {
+		switch matcher.Name {
+		case clusterLabel:
+			clusterMatchers = append(clusterMatchers, matcher)
+		case "exported_" + clusterLabel:
+			// The backends know the label by its original name
+			matcher.Name = clusterLabel
+			others = append(others, matcher)
+			renamed = true
+		default:
+			others = append(others, matcher)
+		}
+	}
+	if renamed {
+		ctx = withMatchers(ctx, others)
+	}
+	if len(clusterMatchers) == 0 {
+		return ctx, m.Backends
+	}
+
+	var backends []NamedSource
+	for _, backend := range m.Backends {
+		if matchAll(clusterMatchers, map[string]string{clusterLabel: backend.Name}) {
+			backends = append(backends, backend)
+		}
+	}
+	return withMatchers(ctx, others), backends
+}
+
+// fetchAll runs fetch against the backends concurrently and tags the results.
+// It returns a *PartialError when some backends failed and a plain error when all did.
+func (m *MultiSource) fetchAll(backends []NamedSource, fetch func(MetricSource) ([]Result, error)) ([][]Result, error) {
+	perBackend := make([][]Result, len(backends))
+	errs := make([]error, len(backends))
+
+	var wg sync.WaitGroup
+	for i, backend := range backends {
+		wg.Add(1)
+		go func(i int, backend NamedSource) {
+			defer wg.Done()
+			results, err := fetch(backend.Source)
+			if errors.Is(err, ErrNoResults) {
+				// A cluster without matching GPUs has not failed
+				return
+			}
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			for _, result := range results {
+				result.Metric = withClusterLabel(result.Metric, backend.Name)
+				perBackend[i] = append(perBackend[i], result)
+			}
+		}(i, backend)
+	}
+	wg.Wait()
+
+	failed := make(map[string]error)
+	for i, err := range errs {
+		if err != nil {
+			failed[backends[i].Name] = err
+		}
+	}
+
+	switch {
+	case len(failed) == 0:
+		return perBackend, nil
+	case len(failed) == len(backends):
+		return nil, fmt.Errorf("all backends failed: %w", &PartialError{Errors: failed})
+	default:
+		return perBackend, &PartialError{Errors: failed}
+	}
+}
+
+// withClusterLabel returns a copy of metric with the cluster label set to cluster.
+// A cluster label the backend already had is kept as exported_cluster, the way
+// Prometheus renames scraped labels that clash with target labels.
+func withClusterLabel(metric map[string]string, cluster string) map[string]string {
+	labels := make(map[string]string, len(metric)+2)
+	for k, v := range metric {
+		labels[k] = v
+	}
+	if existing, ok := metric[clusterLabel]; ok {
+		labels["exported_"+clusterLabel] = existing
+	}
+	labels[clusterLabel] = cluster
+	return labels
+}
+
+// resultTime returns the timestamp of an instant result, or the zero time if it has none
+func resultTime(result Result) time.Time {
+	timestamp, err := result.GetTimestamp()
+	if err != nil {
+		return time.Time{}
+	}
+	return timestamp
+}
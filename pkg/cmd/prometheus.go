@@ -1,20 +1,37 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"slices"
 	"strconv"
+	"sync"
 	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+// Result types of the Prometheus query API
+const (
+	ResultTypeVector = "vector"
+	ResultTypeMatrix = "matrix"
+	ResultTypeScalar = "scalar"
+	ResultTypeString = "string"
+)
+
 // PrometheusResponse represents the response from Prometheus API
 type PrometheusResponse struct {
-	Status string         `json:"status"`
-	Data   PrometheusData `json:"data"`
+	Status    string         `json:"status"`
+	Data      PrometheusData `json:"data"`
+	ErrorType string         `json:"errorType,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	Warnings  []string       `json:"warnings,omitempty"`
+	Infos     []string       `json:"infos,omitempty"`
 }
 
 // PrometheusData represents the data part of Prometheus response
@@ -23,19 +40,91 @@ type PrometheusData struct {
 	Result     []Result `json:"result"`
 }
 
+// UnmarshalJSON decodes every result type of the Prometheus API.
+// Scalar and string results are returned as a single Result without labels.
+func (d *PrometheusData) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	d.ResultType = raw.ResultType
+	d.Result = nil
+	if len(raw.Result) == 0 || string(raw.Result) == "null" {
+		return nil
+	}
+
+	switch raw.ResultType {
+	case ResultTypeVector, ResultTypeMatrix, "":
+		return json.Unmarshal(raw.Result, &d.Result)
+	case ResultTypeScalar, ResultTypeString:
+		var sample []interface{}
+		if err := json.Unmarshal(raw.Result, &sample); err != nil {
+			return fmt.Errorf("invalid %s result: %v", raw.ResultType, err)
+		}
+		d.Result = []Result{{Metric: map[string]string{}, Value: sample}}
+		return nil
+	default:
+		return fmt.Errorf("unsupported result type: %s", raw.ResultType)
+	}
+}
+
+// PrometheusError is an error reported by the Prometheus API
+type PrometheusError struct {
+	Type    string
+	Message string
+}
+
+// Error implements the error interface
+func (e *PrometheusError) Error() string {
+	return fmt.Sprintf("prometheus %s error: %s", e.Type, e.Message)
+}
+
+// StatusCode returns the HTTP status reporting the error to our clients
+func (e *PrometheusError) StatusCode() int {
+	switch e.Type {
+	case "bad_data":
+		return http.StatusBadRequest
+	case "execution":
+		return http.StatusUnprocessableEntity
+	case "not_found":
+		return http.StatusNotFound
+	case "timeout":
+		return http.StatusGatewayTimeout
+	case "canceled", "unavailable":
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
+	}
+}
+
 // Result represents a single metric result
+// Value holds the sample of an instant query and Values the samples of a range query
 type Result struct {
 	Metric map[string]string `json:"metric"`
 	Value  []interface{}     `json:"value"`
+	Values [][]interface{}   `json:"values,omitempty"`
+}
+
+// sample returns the instant sample, or the latest sample of a range result
+func (r *Result) sample() []interface{} {
+	if len(r.Value) == 0 && len(r.Values) > 0 {
+		return r.Values[len(r.Values)-1]
+	}
+	return r.Value
 }
 
 // GetTimestamp returns the timestamp as time.Time
 func (r *Result) GetTimestamp() (time.Time, error) {
-	if len(r.Value) < 1 {
+	sample := r.sample()
+	if len(sample) < 1 {
 		return time.Time{}, fmt.Errorf("no timestamp in value")
 	}
 
-	timestamp, ok := r.Value[0].(float64)
+	timestamp, ok := sample[0].(float64)
 	if !ok {
 		return time.Time{}, fmt.Errorf("invalid timestamp format: expected float64")
 	}
@@ -48,11 +137,12 @@ func (r *Result) GetTimestamp() (time.Time, error) {
 
 // GetValue returns the metric value as float64
 func (r *Result) GetValue() (float64, error) {
-	if len(r.Value) < 2 {
+	sample := r.sample()
+	if len(sample) < 2 {
 		return 0, fmt.Errorf("no value in result")
 	}
 
-	valStr, ok := r.Value[1].(string)
+	valStr, ok := sample[1].(string)
 	if !ok {
 		return 0, fmt.Errorf("invalid value format: expected string")
 	}
@@ -65,58 +155,293 @@ func (r *Result) GetValue() (float64, error) {
 	return val, nil
 }
 
+// ErrNoResults is returned when no query returned any series
+var ErrNoResults = errors.New("no results returned from Prometheus")
+
 // FetchPrometheusMetrics fetches metrics from Prometheus API
 func FetchPrometheusMetrics(promURL string, metricNamesStr string) ([]Result, error) {
 	if promURL == "" {
 		return nil, fmt.Errorf("prometheus URL is empty")
 	}
 
-	if metricNamesStr == "" {
-		return nil, fmt.Errorf("metric names string is empty")
+	metricNames, err := parseMetricNames(metricNamesStr)
+	if err != nil {
+		return nil, err
 	}
 
-	var metricNames []string
-	if err := yaml.Unmarshal([]byte(metricNamesStr), &metricNames); err != nil {
-		return nil, fmt.Errorf("failed to parse metric names: %v", err)
+	source := &PrometheusSource{URLs: ParseReplicaURLs(promURL)}
+	return source.FetchInstant(context.Background(), metricNames)
+}
+
+// PrometheusSource is a MetricSource backed by the Prometheus HTTP API.
+// URLs lists equivalent replicas of one Prometheus, tried in order (or in
+// random order with Randomize) until one answers. A replica that fails
+// BreakerThreshold times in a row is skipped for BreakerCooldown.
+// Client is used for every request, the shared default client when nil.
+// Selector matchers, together with the per-request matchers of the context,
+// are added to every query.
+type PrometheusSource struct {
+	URLs      []string
+	Randomize bool
+	Client    *http.Client
+	Selector  []LabelMatcher
+
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// FetchInstant runs an instant query for every metric
+func (p *PrometheusSource) FetchInstant(ctx context.Context, metricNames []string) ([]Result, error) {
+	var allResults []Result
+
+	for _, metric := range metricNames {
+		query, err := p.scopedQuery(ctx, metricQuery(metric))
+		if err != nil {
+			return nil, err
+		}
+		params := url.Values{}
+		params.Set("query", query)
+
+		results, err := p.query(ctx, "/api/v1/query", metric, params)
+		if err != nil {
+			return nil, err
+		}
+		allResults = append(allResults, nameResults(results, metric)...)
 	}
 
-	if len(metricNames) == 0 {
-		return nil, fmt.Errorf("no metric names provided")
+	if len(allResults) == 0 {
+		return nil, ErrNoResults
 	}
 
+	return allResults, nil
+}
+
+// FetchRange runs a range query for every metric
+func (p *PrometheusSource) FetchRange(ctx context.Context, metricNames []string, start, end time.Time, step time.Duration) ([]Result, error) {
 	var allResults []Result
 
 	for _, metric := range metricNames {
-		url := fmt.Sprintf("%s/api/v1/query?query=%s", promURL, metric)
+		query, err := p.scopedQuery(ctx, metricQuery(metric))
+		if err != nil {
+			return nil, err
+		}
+		params := url.Values{}
+		params.Set("query", query)
+		params.Set("start", formatPrometheusTime(start))
+		params.Set("end", formatPrometheusTime(end))
+		params.Set("step", strconv.FormatFloat(step.Seconds(), 'f', -1, 64))
 
-		resp, err := http.Get(url)
+		results, err := p.query(ctx, "/api/v1/query_range", metric, params)
 		if err != nil {
-			return nil, fmt.Errorf("failed to fetch metric %s: %v", metric, err)
+			return nil, err
 		}
-		defer resp.Body.Close()
+		allResults = append(allResults, nameResults(results, metric)...)
+	}
+
+	if len(allResults) == 0 {
+		return nil, ErrNoResults
+	}
+
+	return allResults, nil
+}
 
-		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			return nil, fmt.Errorf("failed to fetch metric %s: status %d, body: %s",
-				metric, resp.StatusCode, string(body))
+// nameResults names the series of a metric query, whose name rate() drops
+func nameResults(results []Result, metric string) []Result {
+	if metric != metricQuery(metric) {
+		for i := range results {
+			if results[i].Metric == nil {
+				results[i].Metric = make(map[string]string)
+			}
+			results[i].Metric["__name__"] = metric
 		}
+	}
+	return results
+}
+
+// scopedQuery adds the selector and the per-request matchers to a query
+func (p *PrometheusSource) scopedQuery(ctx context.Context, query string) (string, error) {
+	matchers := append(append([]LabelMatcher(nil), p.Selector...), matchersFrom(ctx)...)
+	scoped, err := InjectMatchers(query, matchers)
+	if err != nil {
+		return "", fmt.Errorf("failed to scope query %s: %v", query, err)
+	}
+	return scoped, nil
+}
 
+// HealthCheck checks that at least one replica answers queries
+func (p *PrometheusSource) HealthCheck(ctx context.Context) error {
+	var lastErr error
+	for replica := range p.replicas() {
+		err := checkPrometheus(ctx, p.client(), replica)
+		p.recordResult(replica, err != nil)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		return fmt.Errorf("no Prometheus replicas configured")
+	}
+	return lastErr
+}
+
+// client returns the HTTP client used for requests to Prometheus
+func (p *PrometheusSource) client() *http.Client {
+	if p.Client != nil {
+		return p.Client
+	}
+	return defaultClient
+}
+
+// checkPrometheus checks that a single replica answers queries
+func checkPrometheus(ctx context.Context, client *http.Client, replica string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, replica+"/api/v1/query?query=up", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot connect to Prometheus")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("prometheus returned non-200 status")
+	}
+
+	return nil
+}
+
+// query sends a query to the replicas until one answers.
+// Errors caused by the query itself are returned without trying other replicas.
+func (p *PrometheusSource) query(ctx context.Context, path, metric string, params url.Values) ([]Result, error) {
+	var lastErr error
+	tried := 0
+	for replica := range p.replicas() {
+		tried++
+		results, replicaFailed, err := queryReplica(ctx, p.client(), replica, path, metric, params)
+		p.recordResult(replica, replicaFailed)
+		if err == nil || !replicaFailed || ctx.Err() != nil {
+			return results, err
+		}
+		lastErr = err
+	}
+
+	switch tried {
+	case 0:
+		return nil, fmt.Errorf("no Prometheus replicas configured")
+	case 1:
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("all %d Prometheus replicas failed, last error: %w", tried, lastErr)
+}
+
+// queryReplica sends a query to a single replica and decodes the results.
+// replicaFailed reports whether the failure is specific to the replica
+// (connection error, 5xx or undecodable response) and another one should be tried.
+func queryReplica(ctx context.Context, client *http.Client, replica, path, metric string, params url.Values) (results []Result, replicaFailed bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, replica+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to fetch metric %s: %v", metric, err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to fetch metric %s: %v", metric, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
 		var pResp PrometheusResponse
-		if err := json.NewDecoder(resp.Body).Decode(&pResp); err != nil {
-			return nil, fmt.Errorf("failed to decode response for metric %s: %v", metric, err)
+		if json.Unmarshal(body, &pResp) == nil && pResp.Status == "error" {
+			return nil, resp.StatusCode >= 500, fmt.Errorf("failed to fetch metric %s: %w", metric, pResp.err())
 		}
+		return nil, resp.StatusCode >= 500, fmt.Errorf("failed to fetch metric %s: status %d, body: %s",
+			metric, resp.StatusCode, string(body))
+	}
+
+	var pResp PrometheusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&pResp); err != nil {
+		return nil, true, fmt.Errorf("failed to decode response for metric %s: %v", metric, err)
+	}
 
-		if pResp.Status != "success" {
-			return nil, fmt.Errorf("prometheus returned non-success status for metric %s: %s",
-				metric, pResp.Status)
+	if pResp.Status == "error" {
+		return nil, false, fmt.Errorf("failed to fetch metric %s: %w", metric, pResp.err())
+	}
+	if pResp.Status != "success" {
+		return nil, false, fmt.Errorf("prometheus returned non-success status for metric %s: %s",
+			metric, pResp.Status)
+	}
+
+	addQueryNotes(ctx, pResp.Warnings, pResp.Infos)
+	return pResp.Data.Result, false, nil
+}
+
+// err returns the error reported in an error response
+func (r *PrometheusResponse) err() *PrometheusError {
+	return &PrometheusError{Type: r.ErrorType, Message: r.Error}
+}
+
+// queryNotes collects the warnings and infos Prometheus returned while serving a request
+type queryNotes struct {
+	mu       sync.Mutex
+	warnings []string
+	infos    []string
+}
+
+type queryNotesKey struct{}
+
+// withQueryNotes returns a context collecting the warnings and infos of the queries made with it
+func withQueryNotes(ctx context.Context) (context.Context, *queryNotes) {
+	notes := &queryNotes{}
+	return context.WithValue(ctx, queryNotesKey{}, notes), notes
+}
+
+// addQueryNotes records warnings and infos in the collector of ctx, if any, skipping duplicates
+func addQueryNotes(ctx context.Context, warnings, infos []string) {
+	notes, ok := ctx.Value(queryNotesKey{}).(*queryNotes)
+	if !ok || len(warnings)+len(infos) == 0 {
+		return
+	}
+
+	notes.mu.Lock()
+	defer notes.mu.Unlock()
+	notes.warnings = appendUnique(notes.warnings, warnings...)
+	notes.infos = appendUnique(notes.infos, infos...)
+}
+
+// appendUnique appends the values not already in list
+func appendUnique(list []string, values ...string) []string {
+	for _, value := range values {
+		if !slices.Contains(list, value) {
+			list = append(list, value)
 		}
+	}
+	return list
+}
+
+// formatPrometheusTime formats t as a Unix timestamp with fractional seconds
+func formatPrometheusTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixMilli())/1000, 'f', -1, 64)
+}
 
-		allResults = append(allResults, pResp.Data.Result...)
+// parseMetricNames parses the YAML list of metric names
+func parseMetricNames(metricNamesStr string) ([]string, error) {
+	if metricNamesStr == "" {
+		return nil, fmt.Errorf("metric names string is empty")
 	}
 
-	if len(allResults) == 0 {
-		return nil, fmt.Errorf("no results returned from Prometheus")
+	var metricNames []string
+	if err := yaml.Unmarshal([]byte(metricNamesStr), &metricNames); err != nil {
+		return nil, fmt.Errorf("failed to parse metric names: %v", err)
 	}
 
-	return allResults, nil
+	if len(metricNames) == 0 {
+		return nil, fmt.Errorf("no metric names provided")
+	}
+
+	return metricNames, nil
 }
@@ -0,0 +1,227 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RateLimitConfig configures the token buckets limiting the requests of each
+// IP address and, once authenticated, of each API key or token subject.
+// Rate limiting is disabled when neither a rate nor routes are configured.
+type RateLimitConfig struct {
+	// Rate is the sustained number of requests per second of a client, and Burst
+	// the number of requests it may make at once (default: the rate rounded up)
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+	// Routes override the rate and burst for the paths they match, each with a
+	// bucket of its own; the first matching route applies
+	Routes []RouteRateLimit `yaml:"routes"`
+}
+
+// RouteRateLimit is the rate limit of the paths matching Path, with * matching
+// one path segment as in /gpus/*
+type RouteRateLimit struct {
+	Path  string  `yaml:"path"`
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// Enabled reports whether requests are rate limited
+func (c *RateLimitConfig) Enabled() bool {
+	return c.Rate > 0 || len(c.Routes) > 0
+}
+
+// applyEnv overrides the settings with the environment variables
+func (c *RateLimitConfig) applyEnv() error {
+	if v := os.Getenv("RATE_LIMIT"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("invalid RATE_LIMIT: %s", v)
+		}
+		c.Rate = rate
+	}
+	if v := os.Getenv("RATE_LIMIT_BURST"); v != "" {
+		burst, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid RATE_LIMIT_BURST: %s", v)
+		}
+		c.Burst = burst
+	}
+	if v := os.Getenv("RATE_LIMIT_ROUTES"); v != "" {
+		if err := yaml.Unmarshal([]byte(v), &c.Routes); err != nil {
+			return fmt.Errorf("failed to parse RATE_LIMIT_ROUTES: %v", err)
+		}
+	}
+	return nil
+}
+
+// Validate checks the rates, bursts and route paths
+func (c *RateLimitConfig) Validate() error {
+	if c.Rate < 0 || math.IsInf(c.Rate, 0) || math.IsNaN(c.Rate) {
+		return fmt.Errorf("rate must be a non-negative number: %v", c.Rate)
+	}
+	if c.Burst < 0 {
+		return fmt.Errorf("burst must not be negative")
+	}
+	for i, route := range c.Routes {
+		if _, err := path.Match(route.Path, "/"); err != nil || !strings.HasPrefix(route.Path, "/") {
+			return fmt.Errorf("routes[%d]: invalid path %q", i, route.Path)
+		}
+		if route.Rate <= 0 || math.IsInf(route.Rate, 0) || math.IsNaN(route.Rate) {
+			return fmt.Errorf("routes[%d]: rate must be positive", i)
+		}
+		if route.Burst < 0 {
+			return fmt.Errorf("routes[%d]: burst must not be negative", i)
+		}
+	}
+	return nil
+}
+
+// newRateLimiter returns a limiter letting every request through until it is configured
+func newRateLimiter() *RateLimiter {
+	return &RateLimiter{buckets: make(map[bucketKey]*bucket), now: time.Now}
+}
+
+// RateLimiter limits the requests of each client with token buckets.
+// It outlives configuration reloads, so that clients keep their buckets.
+type RateLimiter struct {
+	config RateLimitConfig
+	now    func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[bucketKey]*bucket
+	lastSweep time.Time
+}
+
+// bucketKey identifies the bucket of a client for a route, -1 for the default rate
+type bucketKey struct {
+	client string
+	route  int
+}
+
+// bucket is a token bucket, refilled at the rate up to the burst
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// setConfig replaces the rates and bursts. The buckets of the routes are
+// dropped when the routes change, since they are identified by position.
+func (l *RateLimiter) setConfig(c RateLimitConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !slices.Equal(l.config.Routes, c.Routes) {
+		for key := range l.buckets {
+			if key.route >= 0 {
+				delete(l.buckets, key)
+			}
+		}
+	}
+	l.config = c
+}
+
+// limit returns the route index, rate and burst applying to urlPath; a zero rate is unlimited.
+// It is called with l.mu held.
+func (l *RateLimiter) limit(urlPath string) (int, float64, int) {
+	for i, route := range l.config.Routes {
+		if ok, _ := path.Match(route.Path, urlPath); ok {
+			return i, route.Rate, route.Burst
+		}
+	}
+	return -1, l.config.Rate, l.config.Burst
+}
+
+// Allow takes a token from the bucket of the client for urlPath. When it is
+// empty, Allow returns false and how long until a token is available.
+func (l *RateLimiter) Allow(client, urlPath string) (bool, time.Duration) {
+	return l.take(client, urlPath, true)
+}
+
+// Peek reports, like Allow, whether the bucket of the client for urlPath has
+// a token, without taking it
+func (l *RateLimiter) Peek(client, urlPath string) (bool, time.Duration) {
+	return l.take(client, urlPath, false)
+}
+
+// take refills the bucket of the client for urlPath and, when consume is set,
+// takes a token from it
+func (l *RateLimiter) take(client, urlPath string, consume bool) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	route, rate, burst := l.limit(urlPath)
+	if rate <= 0 {
+		return true, 0
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+
+	now := l.now()
+	l.sweep(now)
+	key := bucketKey{client: client, route: route}
+	b, ok := l.buckets[key]
+	if !ok {
+		if !consume {
+			return true, 0
+		}
+		b = &bucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	if consume {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// sweep drops, at most once a minute, the buckets idle long enough to be full
+// again, so that clients that went away do not accumulate
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		rate, burst := l.config.Rate, l.config.Burst
+		if key.route >= 0 {
+			rate, burst = l.config.Routes[key.route].Rate, l.config.Routes[key.route].Burst
+		}
+		if burst <= 0 {
+			burst = int(math.Ceil(rate))
+		}
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= float64(burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// remoteClient returns the client a request is accounted to when it is not
+// authenticated: the IP address of the peer. Only RemoteAddr is used, since
+// clients can set X-Forwarded-For and the other proxy headers to anything;
+// behind a reverse proxy, the requests failing authentication share its address.
+func remoteClient(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return "ip:" + host
+}
@@ -0,0 +1,250 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ReloadStatus is the outcome of the configuration reloads
+type ReloadStatus struct {
+	ConfigFile  string    `json:"config_file,omitempty"`
+	LastAttempt time.Time `json:"last_attempt"`
+	LastSuccess time.Time `json:"last_success"`
+	Success     bool      `json:"success"`
+	Error       string    `json:"error,omitempty"`
+	Reloads     int       `json:"reloads"`
+}
+
+// Reloader holds the handlers built from the current configuration and
+// rebuilds them when the configuration changes. Requests already being
+// served keep the handlers they started with.
+type Reloader struct {
+	path string
+	load func() (*Config, error)
+
+	handlers atomic.Pointer[Handlers]
+	config   atomic.Pointer[Config]
+	// hooks are called with every configuration swapped in
+	hooks []func(*Config)
+
+	mu sync.Mutex
+	// fileHash is the hash of the config file at the last reload attempt,
+	// so that a file that failed to load is not retried until it changes
+	fileHash [sha256.Size]byte
+	status   ReloadStatus
+}
+
+// NewReloader loads the configuration from path (if any), the environment and
+// flags (if any) and builds the initial handlers
+func NewReloader(path string, flags *ConfigFlags) (*Reloader, error) {
+	return newReloader(path, func() (*Config, error) {
+		return LoadConfig(path, flags)
+	})
+}
+
+// newReloader builds the initial handlers from the configuration returned by load
+func newReloader(path string, load func() (*Config, error)) (*Reloader, error) {
+	r := &Reloader{path: path, load: load, status: ReloadStatus{ConfigFile: path}}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	r.status.Reloads = 0
+	return r, nil
+}
+
+// Handlers returns the handlers of the current configuration
+func (r *Reloader) Handlers() *Handlers {
+	return r.handlers.Load()
+}
+
+// Config returns the current configuration
+func (r *Reloader) Config() *Config {
+	return r.config.Load()
+}
+
+// Status returns the outcome of the last reloads
+func (r *Reloader) Status() ReloadStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+// Reload reads the configuration again and swaps in new handlers.
+// On failure the current handlers are kept.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	hash, _ := r.hashFile()
+	err := r.reload()
+
+	r.fileHash = hash
+	r.status.LastAttempt = time.Now()
+	r.status.Success = err == nil
+	r.status.Error = ""
+	if err != nil {
+		r.status.Error = err.Error()
+		return err
+	}
+	r.status.LastSuccess = r.status.LastAttempt
+	r.status.Reloads++
+	return nil
+}
+
+// reload builds the handlers of the new configuration and swaps them in
+func (r *Reloader) reload() error {
+	cfg, err := r.load()
+	if err != nil {
+		return err
+	}
+
+	// The routes and listeners are set up at startup, so the running server
+	// settings are kept for the handlers to match them
+	old := r.config.Load()
+	serverChanged := old != nil && old.Server != cfg.Server
+	if serverChanged {
+		cfg.Server = old.Server
+	}
+	h, err := NewHandlersFromConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	if serverChanged {
+		log.Printf("Server settings changed in the configuration; restart to apply them")
+	}
+	r.config.Store(cfg)
+	if old := r.handlers.Swap(h); old != nil {
+		closeIdleConnections(old.Source)
+	}
+	for _, hook := range r.hooks {
+		hook(cfg)
+	}
+	return nil
+}
+
+// onReload calls hook with the current configuration and then with every
+// configuration swapped in, for state that outlives the handlers
+func (r *Reloader) onReload(hook func(*Config)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hooks = append(r.hooks, hook)
+	hook(r.config.Load())
+}
+
+// closeIdleConnections closes the idle connections of the clients of a replaced
+// source. Requests in flight finish on their connections.
+func closeIdleConnections(source MetricSource) {
+	switch s := source.(type) {
+	case *PrometheusSource:
+		if s.Client != nil {
+			s.Client.CloseIdleConnections()
+		}
+	case *ExporterSource:
+		if s.Client != nil {
+			s.Client.CloseIdleConnections()
+		}
+	case *MultiSource:
+		for _, backend := range s.Backends {
+			closeIdleConnections(backend.Source)
+		}
+	case *CachingSource:
+		closeIdleConnections(s.Source)
+	}
+}
+
+// hashFile returns the hash of the config file contents
+func (r *Reloader) hashFile() ([sha256.Size]byte, error) {
+	if r.path == "" {
+		return [sha256.Size]byte{}, nil
+	}
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(data), nil
+}
+
+// changed reports whether the config file contents differ from the last reload attempt
+func (r *Reloader) changed() bool {
+	hash, err := r.hashFile()
+	if err != nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return hash != r.fileHash
+}
+
+// Watch reloads the configuration on SIGHUP and, when interval is positive,
+// whenever the config file contents change, until ctx is done. Comparing
+// contents rather than modification times also catches ConfigMap updates,
+// which swap a symlink.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 && r.path != "" {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.logReload("SIGHUP")
+		case <-tick:
+			if r.changed() {
+				r.logReload("config file change")
+			}
+		}
+	}
+}
+
+// logReload reloads the configuration and logs the outcome
+func (r *Reloader) logReload(trigger string) {
+	if err := r.Reload(); err != nil {
+		log.Printf("Failed to reload configuration after %s: %v", trigger, err)
+		return
+	}
+	log.Printf("Reloaded configuration after %s", trigger)
+}
+
+// ConfigStatus returns the outcome of the configuration reloads
+func (r *Reloader) ConfigStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		sendError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sendJSON(w, nil, r.Status())
+}
+
+// ReloadConfig reloads the configuration and returns the outcome
+func (r *Reloader) ReloadConfig(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		sendError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.logReload("admin request")
+	status := r.Status()
+	if !status.Success {
+		sendError(w, fmt.Sprintf("reload failed: %s", status.Error), http.StatusUnprocessableEntity)
+		return
+	}
+	sendJSON(w, nil, status)
+}
@@ -0,0 +1,375 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Label matcher operators
+const (
+	MatchEqual     = "="
+	MatchNotEqual  = "!="
+	MatchRegexp    = "=~"
+	MatchNotRegexp = "!~"
+)
+
+// labelName matches valid Prometheus label names
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// LabelMatcher is a single PromQL label matcher such as job="dcgm-exporter"
+type LabelMatcher struct {
+	Name  string
+	Op    string
+	Value string
+
+	re *regexp.Regexp
+}
+
+// NewLabelMatcher validates the label name, operator and regular expression of a matcher
+func NewLabelMatcher(name, op, value string) (LabelMatcher, error) {
+	if !labelName.MatchString(name) {
+		return LabelMatcher{}, fmt.Errorf("invalid label name: %q", name)
+	}
+
+	m := LabelMatcher{Name: name, Op: op, Value: value}
+	switch op {
+	case MatchEqual, MatchNotEqual:
+	case MatchRegexp, MatchNotRegexp:
+		// Prometheus anchors label regular expressions
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return LabelMatcher{}, fmt.Errorf("invalid regular expression for label %s: %v", name, err)
+		}
+		m.re = re
+	default:
+		return LabelMatcher{}, fmt.Errorf("invalid matcher operator: %q", op)
+	}
+	return m, nil
+}
+
+// String returns the matcher in PromQL syntax with the value quoted and escaped
+func (m LabelMatcher) String() string {
+	return m.Name + m.Op + strconv.Quote(m.Value)
+}
+
+// Matches reports whether the labels satisfy the matcher.
+// A missing label matches like an empty value, as in Prometheus.
+func (m LabelMatcher) Matches(labels map[string]string) bool {
+	value := labels[m.Name]
+	switch m.Op {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(value)
+	case MatchNotRegexp:
+		return !m.re.MatchString(value)
+	}
+	return false
+}
+
+// ParseSelector parses a label selector such as {cluster="prod", job="dcgm-exporter"}.
+// The braces are optional.
+func ParseSelector(selector string) ([]LabelMatcher, error) {
+	s := strings.TrimSpace(selector)
+	if strings.HasPrefix(s, "{") {
+		if !strings.HasSuffix(s, "}") {
+			return nil, fmt.Errorf("unterminated selector: %s", selector)
+		}
+		s = s[1 : len(s)-1]
+	}
+
+	var matchers []LabelMatcher
+	for {
+		s = strings.TrimLeft(s, " \t\n")
+		if s == "" {
+			return matchers, nil
+		}
+
+		nameEnd := strings.IndexAny(s, "=!")
+		if nameEnd < 0 {
+			return nil, fmt.Errorf("invalid selector: %s", selector)
+		}
+		name := strings.TrimSpace(s[:nameEnd])
+		s = s[nameEnd:]
+
+		op := MatchEqual
+		for _, candidate := range []string{MatchRegexp, MatchNotRegexp, MatchNotEqual} {
+			if strings.HasPrefix(s, candidate) {
+				op = candidate
+				break
+			}
+		}
+		s = strings.TrimLeft(s[len(op):], " \t\n")
+
+		quoted, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for label %s in selector: %s", name, selector)
+		}
+		value, _ := strconv.Unquote(quoted)
+		s = strings.TrimLeft(s[len(quoted):], " \t\n")
+
+		matcher, err := NewLabelMatcher(name, op, value)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, matcher)
+
+		if s != "" {
+			if s[0] != ',' {
+				return nil, fmt.Errorf("invalid selector: %s", selector)
+			}
+			s = s[1:]
+		}
+	}
+}
+
+// ParseMatcher parses an unquoted matcher such as Hostname=node-a or
+// modelName=~H100.*. Everything after the operator is taken as the value,
+// so no escaping is needed.
+func ParseMatcher(matcher string) (LabelMatcher, error) {
+	i := strings.IndexAny(matcher, "=!")
+	if i < 0 {
+		return LabelMatcher{}, fmt.Errorf("invalid matcher: %q", matcher)
+	}
+
+	name, rest := matcher[:i], matcher[i:]
+	op := MatchEqual
+	for _, candidate := range []string{MatchRegexp, MatchNotRegexp, MatchNotEqual} {
+		if strings.HasPrefix(rest, candidate) {
+			op = candidate
+			break
+		}
+	}
+	return NewLabelMatcher(name, op, rest[len(op):])
+}
+
+// matchAll reports whether the labels satisfy every matcher
+func matchAll(matchers []LabelMatcher, labels map[string]string) bool {
+	for _, m := range matchers {
+		if !m.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterMatching returns the results whose labels satisfy every matcher
+func filterMatching(results []Result, matchers []LabelMatcher) []Result {
+	if len(matchers) == 0 {
+		return results
+	}
+
+	var filtered []Result
+	for _, result := range results {
+		if matchAll(matchers, result.Metric) {
+			filtered = append(filtered, result)
+		}
+	}
+	return filtered
+}
+
+type matchersKey struct{}
+
+// withMatchers returns a context carrying per-request matchers that sources
+// push down into their queries
+func withMatchers(ctx context.Context, matchers []LabelMatcher) context.Context {
+	return context.WithValue(ctx, matchersKey{}, matchers)
+}
+
+// matchersFrom returns the per-request matchers of ctx
+func matchersFrom(ctx context.Context) []LabelMatcher {
+	matchers, _ := ctx.Value(matchersKey{}).([]LabelMatcher)
+	return matchers
+}
+
+// promqlKeywords are identifiers that are never metric names, in lower case
+// as PromQL keywords are case-insensitive
+var promqlKeywords = map[string]bool{
+	"and": true, "or": true, "unless": true, "atan2": true, "bool": true,
+	"offset": true, "inf": true, "nan": true,
+	"start": true, "end": true,
+}
+
+// promqlAggregations take an optional by/without clause before their arguments
+var promqlAggregations = map[string]bool{
+	"sum": true, "min": true, "max": true, "avg": true, "group": true,
+	"stddev": true, "stdvar": true, "count": true, "count_values": true,
+	"bottomk": true, "topk": true, "quantile": true, "limitk": true, "limit_ratio": true,
+}
+
+// promqlLabelLists are followed by a parenthesized list of label names
+var promqlLabelLists = map[string]bool{
+	"by": true, "without": true, "on": true, "ignoring": true,
+	"group_left": true, "group_right": true,
+}
+
+// InjectMatchers adds the matchers to every vector selector of a PromQL query,
+// so that rate(DCGM_FI_PROF_PCIE_TX_BYTES[1m]) becomes
+// rate(DCGM_FI_PROF_PCIE_TX_BYTES{job="dcgm-exporter"}[1m]).
+// Matchers already in the query are kept; both must hold.
+func InjectMatchers(query string, matchers []LabelMatcher) (string, error) {
+	if len(matchers) == 0 {
+		return query, nil
+	}
+
+	injected := make([]string, len(matchers))
+	for i, m := range matchers {
+		injected[i] = m.String()
+	}
+	extra := strings.Join(injected, ",")
+
+	var out strings.Builder
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '"' || c == '\'' || c == '`':
+			end, err := skipString(query, i)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(query[i:end])
+			i = end
+
+		case c == '#':
+			// Comment until the end of the line
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			out.WriteString(query[i : i+end])
+			i += end
+
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9':
+			// Numbers and durations such as 1e3, 0x1f or 5m
+			end := i + 1
+			for end < len(query) && isIdentChar(query[end]) || end < len(query) && query[end] == '.' {
+				end++
+			}
+			out.WriteString(query[i:end])
+			i = end
+
+		case c == '[':
+			// Range or subquery durations
+			end := strings.IndexByte(query[i:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated range in query: %s", query)
+			}
+			out.WriteString(query[i : i+end+1])
+			i += end + 1
+
+		case c == '{':
+			// Selector without a metric name
+			end, err := injectIntoBraces(&out, query, i, extra)
+			if err != nil {
+				return "", err
+			}
+			i = end
+
+		case isIdentStart(c):
+			end := i + 1
+			for end < len(query) && (isIdentChar(query[end]) || query[end] == ':') {
+				end++
+			}
+			ident := query[i:end]
+			out.WriteString(ident)
+			i = end
+
+			next := skipSpaces(query, i)
+			keyword := strings.ToLower(ident)
+			switch {
+			case promqlLabelLists[keyword]:
+				if next < len(query) && query[next] == '(' {
+					close := strings.IndexByte(query[next:], ')')
+					if close < 0 {
+						return "", fmt.Errorf("unterminated label list in query: %s", query)
+					}
+					out.WriteString(query[i : next+close+1])
+					i = next + close + 1
+				}
+			case promqlKeywords[keyword], promqlAggregations[keyword]:
+			case next < len(query) && query[next] == '(':
+				// Function call
+			case next < len(query) && query[next] == '{':
+				out.WriteString(query[i:next])
+				end, err := injectIntoBraces(&out, query, next, extra)
+				if err != nil {
+					return "", err
+				}
+				i = end
+			default:
+				out.WriteString("{" + extra + "}")
+			}
+
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+
+	return out.String(), nil
+}
+
+// injectIntoBraces copies the selector braces starting at query[start],
+// adding the extra matchers, and returns the index after the closing brace
+func injectIntoBraces(out *strings.Builder, query string, start int, extra string) (int, error) {
+	i := start + 1
+	for i < len(query) && query[i] != '}' {
+		if c := query[i]; c == '"' || c == '\'' || c == '`' {
+			end, err := skipString(query, i)
+			if err != nil {
+				return 0, err
+			}
+			i = end
+			continue
+		}
+		i++
+	}
+	if i >= len(query) {
+		return 0, fmt.Errorf("unterminated selector in query: %s", query)
+	}
+
+	existing := strings.TrimRight(strings.TrimSpace(query[start+1:i]), ",")
+	out.WriteByte('{')
+	if existing != "" {
+		out.WriteString(existing + ",")
+	}
+	out.WriteString(extra + "}")
+	return i + 1, nil
+}
+
+// skipString returns the index after the string literal starting at query[start]
+func skipString(query string, start int) (int, error) {
+	quote := query[start]
+	for i := start + 1; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			if quote != '`' {
+				i++
+			}
+		case quote:
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated string in query: %s", query)
+}
+
+// skipSpaces returns the index of the first non-space character at or after i
+func skipSpaces(query string, i int) int {
+	for i < len(query) && (query[i] == ' ' || query[i] == '\t' || query[i] == '\n' || query[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == ':' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9'
+}
@@ -0,0 +1,353 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Server is the API as an http.Handler with its own routes, so that it can be
+// embedded in other programs. Every request is served with the handlers of the
+// configuration current when it arrives.
+type Server struct {
+	reloader     *Reloader
+	mux          *http.ServeMux
+	limiter      *RateLimiter
+	shuttingDown atomic.Bool
+}
+
+// NewServer creates the API for a configuration, which is validated first
+func NewServer(cfg *Config) (*Server, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	r, err := newReloader("", func() (*Config, error) { return cfg, nil })
+	if err != nil {
+		return nil, err
+	}
+	return newServer(r), nil
+}
+
+// newServer registers the routes of the API serving the handlers of r
+func newServer(r *Reloader) *Server {
+	s := &Server{reloader: r, mux: http.NewServeMux(), limiter: newRateLimiter()}
+	r.onReload(func(cfg *Config) {
+		s.limiter.setConfig(cfg.RateLimit)
+	})
+	s.registerRoutes(r.Config().Server.MetricsEndpoint)
+	return s
+}
+
+// registerRoutes registers the routes of the API on the mux of s.
+// Like ServeMux, it panics when a pattern is invalid or conflicts with another.
+func (s *Server) registerRoutes(metricsEndpoint string) {
+	r := s.reloader
+	handle := func(pattern string, handler func(*Handlers, http.ResponseWriter, *http.Request)) {
+		s.mux.HandleFunc(pattern, func(w http.ResponseWriter, req *http.Request) {
+			handler(r.Handlers(), w, req)
+		})
+	}
+
+	handle("GET "+metricsEndpoint, (*Handlers).Metrics)
+	handle("GET /gpus/{uuid}", (*Handlers).GPU)
+	handle("GET /throttling", (*Handlers).Throttling)
+	handle("GET /hosts", (*Handlers).Hosts)
+	handle("GET /hosts/{hostname}", (*Handlers).Host)
+	handle("GET /health", (*Handlers).Health)
+	s.mux.HandleFunc("GET /ready", s.ready)
+	s.mux.HandleFunc("GET /admin/config", r.ConfigStatus)
+	s.mux.HandleFunc("POST /admin/reload", r.ReloadConfig)
+	s.mux.HandleFunc("GET /simulator/metrics", s.simulatorMetrics)
+}
+
+// checkMetricsEndpoint reports an error when the routes of the API cannot be
+// registered with endpoint, because it is invalid or taken by another route
+func checkMetricsEndpoint(endpoint string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			// Conflicts are explained on the last line, after the source
+			// locations of the patterns
+			msg := fmt.Sprint(r)
+			if i := strings.LastIndex(msg, "\n"); i >= 0 {
+				msg = strings.TrimSpace(msg[i+1:])
+			}
+			err = errors.New(msg)
+		}
+	}()
+	(&Server{mux: http.NewServeMux()}).registerRoutes(endpoint)
+	return nil
+}
+
+// ServeHTTP rate limits, authenticates and routes the request, answering
+// unknown paths and methods with JSON errors. Authenticated requests are
+// limited by client. Without authentication, and for the requests failing
+// it, the IP address is the client, so that guessing credentials is limited
+// without clients sharing an address limiting each other.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h := s.reloader.Handlers()
+	probe := isProbe(req.URL.Path)
+
+	if auth := h.Auth; auth != nil && !probe {
+		remote := remoteClient(req)
+		if ok, wait := s.limiter.Peek(remote, req.URL.Path); !ok {
+			tooManyRequests(w, wait)
+			return
+		}
+		id, ok := s.authenticate(w, req, auth)
+		if !ok {
+			s.limiter.Allow(remote, req.URL.Path)
+			return
+		}
+		req = req.WithContext(withIdentity(req.Context(), id))
+		aw := &auditWriter{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			log.Printf("audit: client=%s method=%s path=%s status=%d remote=%s", id.ID, req.Method, req.URL.Path, aw.status, req.RemoteAddr)
+		}()
+		w = aw
+
+		if !s.allow(w, req, "client:"+id.ID) {
+			return
+		}
+	} else if !probe && !s.allow(w, req, remoteClient(req)) {
+		return
+	}
+
+	if _, pattern := s.mux.Handler(req); pattern == "" {
+		// Let the mux pick the status and the Allow header, then write a JSON error
+		rec := &statusRecorder{header: make(http.Header)}
+		s.mux.ServeHTTP(rec, req)
+		if allow := rec.header.Get("Allow"); allow != "" {
+			w.Header().Set("Allow", allow)
+		}
+		sendError(w, strings.ToLower(http.StatusText(rec.code)), rec.code)
+		return
+	}
+	s.mux.ServeHTTP(w, req)
+}
+
+// allow takes a token from the bucket of client for the request path.
+// When it is empty, allow writes a 429 response and returns false.
+func (s *Server) allow(w http.ResponseWriter, req *http.Request, client string) bool {
+	ok, wait := s.limiter.Allow(client, req.URL.Path)
+	if !ok {
+		tooManyRequests(w, wait)
+	}
+	return ok
+}
+
+// tooManyRequests writes a 429 response asking to retry after wait
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	retryAfter := max(1, int(math.Ceil(wait.Seconds())))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	sendError(w, fmt.Sprintf("rate limit exceeded, retry in %ds", retryAfter), http.StatusTooManyRequests)
+}
+
+// isProbe reports whether the path is a probe, which needs no authentication
+func isProbe(urlPath string) bool {
+	return urlPath == "/health" || urlPath == "/ready"
+}
+
+// authenticate checks the credentials of the request and its access to the endpoint.
+// On failure it writes an error response and returns false.
+func (s *Server) authenticate(w http.ResponseWriter, req *http.Request, auth *Authenticator) (*Identity, bool) {
+	id, err := auth.Authenticate(req)
+	if err != nil {
+		log.Printf("audit: rejected method=%s path=%s remote=%s: %v", req.Method, req.URL.Path, req.RemoteAddr, err)
+		switch {
+		case errors.Is(err, ErrMissingCredentials), errors.Is(err, ErrInvalidCredentials), errors.Is(err, ErrInvalidToken):
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			sendError(w, err.Error(), http.StatusUnauthorized)
+		case errors.Is(err, ErrAccessDenied):
+			sendError(w, err.Error(), http.StatusForbidden)
+		default:
+			sendError(w, "failed to authenticate request", http.StatusInternalServerError)
+		}
+		return nil, false
+	}
+
+	if !id.AllowsEndpoint(req.URL.Path) {
+		log.Printf("audit: rejected client=%s method=%s path=%s remote=%s: endpoint not allowed", id.ID, req.Method, req.URL.Path, req.RemoteAddr)
+		sendError(w, "client is not allowed to access "+req.URL.Path, http.StatusForbidden)
+		return nil, false
+	}
+	return id, true
+}
+
+// auditWriter records the status of a response for the audit log
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *auditWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *auditWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// ready fails readiness while the server shuts down
+func (s *Server) ready(w http.ResponseWriter, req *http.Request) {
+	if s.shuttingDown.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("shutting down"))
+		return
+	}
+	s.reloader.Handlers().Ready(w, req)
+}
+
+// simulatorMetrics exposes the simulated fleet for Prometheus to scrape in simulate mode
+func (s *Server) simulatorMetrics(w http.ResponseWriter, req *http.Request) {
+	source := s.reloader.Handlers().Source
+	if cached, ok := source.(*CachingSource); ok {
+		source = cached.Source
+	}
+	sim, ok := source.(*SimulatorSource)
+	if !ok {
+		sendError(w, "not found", http.StatusNotFound)
+		return
+	}
+	sim.ServeHTTP(w, req)
+}
+
+// statusRecorder captures the status and headers of a response, discarding the body
+type statusRecorder struct {
+	header http.Header
+	code   int
+}
+
+func (r *statusRecorder) Header() http.Header         { return r.header }
+func (r *statusRecorder) Write(b []byte) (int, error) { return len(b), nil }
+func (r *statusRecorder) WriteHeader(code int)        { r.code = code }
+
+// Serve listens on the configured address and serves until ctx is done or the
+// process receives SIGTERM or SIGINT
+func Serve(ctx context.Context, r *Reloader) error {
+	ln, err := net.Listen("tcp", r.Config().Server.Listen)
+	if err != nil {
+		return err
+	}
+	return ServeListener(ctx, r, ln)
+}
+
+// ServeListener serves on ln like Serve, with HTTPS when TLS is configured and
+// the probes also on the plaintext probe address if any. On shutdown, readiness
+// fails for the shutdown delay, then in-flight requests are given the shutdown
+// timeout to complete.
+func ServeListener(ctx context.Context, r *Reloader, ln net.Listener) error {
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	cfg := r.Config()
+	tlsConfig, err := cfg.Server.TLS.serverConfig()
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	s := newServer(r)
+	servers := []*http.Server{newHTTPServer(cfg, s)}
+	servers[0].TLSConfig = tlsConfig
+	listeners := []net.Listener{ln}
+
+	if cfg.Server.ProbeListen != "" {
+		probeLn, err := net.Listen("tcp", cfg.Server.ProbeListen)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		servers = append(servers, newHTTPServer(cfg, s.probes()))
+		listeners = append(listeners, probeLn)
+	}
+
+	go r.Watch(ctx, cfg.Server.ReloadInterval)
+
+	// Start servers
+	errCh := make(chan error, len(servers))
+	for i, srv := range servers {
+		go func() {
+			if srv.TLSConfig != nil {
+				errCh <- srv.ServeTLS(listeners[i], "", "")
+			} else {
+				errCh <- srv.Serve(listeners[i])
+			}
+		}()
+	}
+	scheme := "HTTP"
+	if tlsConfig != nil {
+		scheme = "HTTPS"
+	}
+	log.Printf("Starting %s server on %s with endpoint %s", scheme, ln.Addr(), cfg.Server.MetricsEndpoint)
+	if len(listeners) > 1 {
+		log.Printf("Serving probes on %s", listeners[1].Addr())
+	}
+
+	select {
+	case err := <-errCh:
+		for _, srv := range servers {
+			srv.Close()
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	// Fail readiness first so that load balancers stop sending new requests
+	log.Printf("Shutting down server")
+	s.shuttingDown.Store(true)
+	if cfg.Server.ShutdownDelay > 0 {
+		time.Sleep(cfg.Server.ShutdownDelay)
+	}
+
+	shutdownCtx := context.Background()
+	if cfg.Server.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		shutdownCtx, cancel = context.WithTimeout(shutdownCtx, cfg.Server.ShutdownTimeout)
+		defer cancel()
+	}
+	// The probe server stops last, so that it reports the shutdown until the end
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			for _, srv := range servers {
+				srv.Close()
+			}
+			return fmt.Errorf("failed to drain in-flight requests: %v", err)
+		}
+	}
+	log.Printf("Server stopped")
+	return nil
+}
+
+// newHTTPServer creates an HTTP server for handler with the configured timeouts
+func newHTTPServer(cfg *Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
+}
+
+// probes returns the routes of the plaintext probe listener
+func (s *Server) probes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, req *http.Request) {
+		s.reloader.Handlers().Health(w, req)
+	})
+	mux.HandleFunc("GET /ready", s.ready)
+	return mux
+}
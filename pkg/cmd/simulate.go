@@ -0,0 +1,364 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Utilization patterns of the simulated GPUs
+const (
+	PatternDiurnal = "diurnal"
+	PatternBursty  = "bursty"
+	PatternIdle    = "idle"
+	PatternMixed   = "mixed"
+)
+
+// simulatedModels maps the known GPU models to their framebuffer size in MiB
+var simulatedModels = map[string]float64{
+	"NVIDIA A100-SXM4-40GB": 40960,
+	"NVIDIA A100-SXM4-80GB": 81920,
+	"NVIDIA H100 80GB HBM3": 81559,
+	"NVIDIA L4":             23034,
+	"Tesla V100-SXM2-32GB":  32768,
+}
+
+// defaultSimulatedMemory is the framebuffer size of models missing from simulatedModels
+const defaultSimulatedMemory = 40960
+
+// simulatedXIDs are the XID errors the simulator injects
+var simulatedXIDs = []float64{13, 31, 43, 48, 63, 79}
+
+// SimulatorSource is a MetricSource generating a synthetic GPU fleet.
+// Values are a deterministic function of Seed, the GPU and the time, so
+// instant and range queries agree with each other.
+type SimulatorSource struct {
+	Hosts        int      `yaml:"hosts"`
+	GPUsPerHost  int      `yaml:"gpus_per_host"`
+	Models       []string `yaml:"models"`
+	Pattern      string   `yaml:"pattern"`
+	XIDRate      float64  `yaml:"xid_rate"`
+	ThrottleRate float64  `yaml:"throttle_rate"`
+	Seed         int64    `yaml:"seed"`
+}
+
+// defaultSimulator returns a simulator with the default fleet shape
+func defaultSimulator() SimulatorSource {
+	return SimulatorSource{
+		Hosts:        4,
+		GPUsPerHost:  8,
+		Pattern:      PatternMixed,
+		XIDRate:      0.001,
+		ThrottleRate: 0.01,
+		Seed:         1,
+	}
+}
+
+// applyEnv overrides the fleet shape with the SIM_* environment variables
+func (sim *SimulatorSource) applyEnv() error {
+	var err error
+	if v := os.Getenv("SIM_HOSTS"); v != "" {
+		if sim.Hosts, err = strconv.Atoi(v); err != nil || sim.Hosts <= 0 {
+			return fmt.Errorf("invalid SIM_HOSTS: %s", v)
+		}
+	}
+	if v := os.Getenv("SIM_GPUS_PER_HOST"); v != "" {
+		if sim.GPUsPerHost, err = strconv.Atoi(v); err != nil || sim.GPUsPerHost <= 0 {
+			return fmt.Errorf("invalid SIM_GPUS_PER_HOST: %s", v)
+		}
+	}
+	if v := os.Getenv("SIM_MODELS"); v != "" {
+		if err := yaml.Unmarshal([]byte(v), &sim.Models); err != nil {
+			return fmt.Errorf("failed to parse SIM_MODELS: %v", err)
+		}
+	}
+	if v := os.Getenv("SIM_PATTERN"); v != "" {
+		if !validPattern(v) {
+			return fmt.Errorf("invalid SIM_PATTERN: %s", v)
+		}
+		sim.Pattern = v
+	}
+	if v := os.Getenv("SIM_XID_RATE"); v != "" {
+		if sim.XIDRate, err = strconv.ParseFloat(v, 64); err != nil || sim.XIDRate < 0 || sim.XIDRate > 1 {
+			return fmt.Errorf("invalid SIM_XID_RATE: %s", v)
+		}
+	}
+	if v := os.Getenv("SIM_THROTTLE_RATE"); v != "" {
+		if sim.ThrottleRate, err = strconv.ParseFloat(v, 64); err != nil || sim.ThrottleRate < 0 || sim.ThrottleRate > 1 {
+			return fmt.Errorf("invalid SIM_THROTTLE_RATE: %s", v)
+		}
+	}
+	if v := os.Getenv("SIM_SEED"); v != "" {
+		if sim.Seed, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return fmt.Errorf("invalid SIM_SEED: %s", v)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks that the fleet shape is usable
+func (sim *SimulatorSource) Validate() error {
+	switch {
+	case sim.Hosts <= 0:
+		return fmt.Errorf("hosts must be positive")
+	case sim.GPUsPerHost <= 0:
+		return fmt.Errorf("gpus_per_host must be positive")
+	case !validPattern(sim.Pattern):
+		return fmt.Errorf("invalid pattern: %s", sim.Pattern)
+	case sim.XIDRate < 0 || sim.XIDRate > 1:
+		return fmt.Errorf("xid_rate must be between 0 and 1")
+	case sim.ThrottleRate < 0 || sim.ThrottleRate > 1:
+		return fmt.Errorf("throttle_rate must be between 0 and 1")
+	}
+	return nil
+}
+
+// validPattern reports whether pattern is a known load pattern
+func validPattern(pattern string) bool {
+	switch pattern {
+	case PatternDiurnal, PatternBursty, PatternIdle, PatternMixed:
+		return true
+	}
+	return false
+}
+
+// simulatedGpu is a GPU of the simulated fleet
+type simulatedGpu struct {
+	index    int
+	hostname string
+	device   string
+	uuid     string
+	model    string
+	memory   float64
+	pattern  string
+}
+
+// FetchInstant returns the current sample of the requested metrics for every simulated GPU
+func (s *SimulatorSource) FetchInstant(ctx context.Context, metricNames []string) ([]Result, error) {
+	filtered := filterResults(s.snapshot(time.Now()), metricNames)
+	if len(filtered) == 0 {
+		return nil, fmt.Errorf("no results returned from simulator")
+	}
+	sortResults(filtered)
+	return filtered, nil
+}
+
+// FetchRange returns the samples of the requested metrics every step between start and end
+func (s *SimulatorSource) FetchRange(ctx context.Context, metricNames []string, start, end time.Time, step time.Duration) ([]Result, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("step must be positive")
+	}
+
+	wanted := make(map[string]bool, len(metricNames))
+	for _, metric := range metricNames {
+		wanted[metric] = true
+	}
+
+	var results []Result
+	for _, gpu := range s.fleet() {
+		series := make(map[string]*Result)
+		for t := start; !t.After(end); t = t.Add(step) {
+			for name, value := range s.sample(gpu, t) {
+				if !wanted[name] {
+					continue
+				}
+				r, exists := series[name]
+				if !exists {
+					r = &Result{Metric: gpu.labels(name)}
+					series[name] = r
+				}
+				r.Values = append(r.Values, gpu.result(name, t, value).Value)
+			}
+		}
+		for _, r := range series {
+			results = append(results, *r)
+		}
+	}
+
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no results returned from simulator")
+	}
+	sortResults(results)
+	return results, nil
+}
+
+// HealthCheck checks that the simulated fleet is not empty
+func (s *SimulatorSource) HealthCheck(ctx context.Context) error {
+	if s.Hosts <= 0 || s.GPUsPerHost <= 0 {
+		return fmt.Errorf("simulated fleet is empty")
+	}
+	return nil
+}
+
+// ServeHTTP exposes the current state of the fleet in the Prometheus text format,
+// so Prometheus can scrape the simulator like a dcgm-exporter
+func (s *SimulatorSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	results := s.snapshot(time.Now())
+	sortResults(results)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := WriteExpositionFormat(w, results); err != nil {
+		sendError(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// snapshot returns every simulated metric of every GPU at time t
+func (s *SimulatorSource) snapshot(t time.Time) []Result {
+	var results []Result
+	for _, gpu := range s.fleet() {
+		for name, value := range s.sample(gpu, t) {
+			results = append(results, gpu.result(name, t, value))
+		}
+	}
+	return results
+}
+
+// fleet returns the simulated GPUs
+func (s *SimulatorSource) fleet() []simulatedGpu {
+	models := s.Models
+	if len(models) == 0 {
+		models = []string{"NVIDIA A100-SXM4-80GB"}
+	}
+	patterns := []string{PatternDiurnal, PatternBursty, PatternIdle}
+
+	var gpus []simulatedGpu
+	for h := 0; h < s.Hosts; h++ {
+		// All GPUs of a host share the same model
+		model := models[h%len(models)]
+		memory, ok := simulatedModels[model]
+		if !ok {
+			memory = defaultSimulatedMemory
+		}
+
+		for d := 0; d < s.GPUsPerHost; d++ {
+			index := h*s.GPUsPerHost + d
+			pattern := s.Pattern
+			if pattern == "" || pattern == PatternMixed {
+				pattern = patterns[index%len(patterns)]
+			}
+
+			id := s.hash(index, 0)
+			gpus = append(gpus, simulatedGpu{
+				index:    index,
+				hostname: fmt.Sprintf("sim-node-%02d", h),
+				device:   fmt.Sprintf("%d", d),
+				uuid: fmt.Sprintf("GPU-%08x-%04x-%04x-%04x-%012x",
+					uint32(id), uint16(id>>32), uint16(id>>48), uint16(index), uint64(s.Seed)&0xffffffffffff),
+				model:   model,
+				memory:  memory,
+				pattern: pattern,
+			})
+		}
+	}
+	return gpus
+}
+
+// sample returns the value of every simulated metric of gpu at time t
+func (s *SimulatorSource) sample(gpu simulatedGpu, t time.Time) map[string]float64 {
+	// Values change once per minute
+	minute := t.Unix() / 60
+	rng := rand.New(rand.NewSource(int64(s.hash(gpu.index, minute))))
+
+	var util float64
+	switch gpu.pattern {
+	case PatternDiurnal:
+		hour := float64(t.Hour()) + float64(t.Minute())/60
+		util = 50 - 40*math.Cos(2*math.Pi*(hour-3)/24) + rng.Float64()*10 - 5
+	case PatternBursty:
+		if rng.Float64() < 0.3 {
+			util = 90 + rng.Float64()*10
+		} else {
+			util = rng.Float64() * 10
+		}
+	default:
+		util = rng.Float64() * 3
+	}
+	util = math.Max(0, math.Min(100, math.Round(util)))
+	load := util / 100
+
+	memUsed := math.Round(gpu.memory * (0.05 + 0.85*load*(0.8+0.2*rng.Float64())))
+	temp := math.Round(30 + 50*load + rng.Float64()*4)
+
+	throttle := 0.0
+	if util == 0 {
+		throttle = float64(ThrottleGpuIdle)
+	}
+	if rng.Float64() < s.ThrottleRate {
+		reasons := []uint64{ThrottleSwPowerCap, ThrottleHwSlowdown, ThrottleSwThermalSlowdown, ThrottleHwThermalSlowdown}
+		throttle = float64(reasons[rng.Intn(len(reasons))])
+		temp = math.Max(temp, 85+math.Round(rng.Float64()*5))
+	}
+
+	xid := 0.0
+	if rng.Float64() < s.XIDRate {
+		xid = simulatedXIDs[rng.Intn(len(simulatedXIDs))]
+	}
+
+	smActive := load * (0.85 + 0.15*rng.Float64())
+	return map[string]float64{
+		MetricGPUTemp:              temp,
+		MetricGPUMemoryFree:        gpu.memory - memUsed,
+		MetricGPUMemoryUsed:        memUsed,
+		MetricGPUUtil:              util,
+		MetricGPUMemoryUtil:        math.Round(util * 0.6 * rng.Float64()),
+		MetricClockThrottleReasons: throttle,
+		MetricXIDErrors:            xid,
+		MetricSMActive:             smActive,
+		MetricSMOccupancy:          smActive * (0.3 + 0.4*rng.Float64()),
+		MetricTensorActive:         smActive * rng.Float64(),
+		MetricDRAMActive:           load * 0.5 * rng.Float64(),
+		MetricPCIeTxBytes:          math.Round(load * 2e9 * rng.Float64()),
+		MetricPCIeRxBytes:          math.Round(load * 8e9 * rng.Float64()),
+	}
+}
+
+// hash derives a deterministic value from the seed, a GPU index and a time bucket
+func (s *SimulatorSource) hash(index int, bucket int64) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d/%d/%d", s.Seed, index, bucket)
+	return h.Sum64()
+}
+
+// labels returns the dcgm-exporter style labels of a simulated metric
+func (g simulatedGpu) labels(name string) map[string]string {
+	return map[string]string{
+		"__name__":  name,
+		"Hostname":  g.hostname,
+		"gpu":       g.device,
+		"UUID":      g.uuid,
+		"modelName": g.model,
+		"device":    "nvidia" + g.device,
+	}
+}
+
+// result returns a simulated sample as a Prometheus result
+func (g simulatedGpu) result(name string, t time.Time, value float64) Result {
+	return Result{
+		Metric: g.labels(name),
+		Value:  []interface{}{float64(t.UnixMilli()) / 1000, fmt.Sprintf("%g", value)},
+	}
+}
+
+// sortResults orders results by metric name, hostname and GPU
+func sortResults(results []Result) {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i].Metric, results[j].Metric
+		if a["__name__"] != b["__name__"] {
+			return a["__name__"] < b["__name__"]
+		}
+		if a["Hostname"] != b["Hostname"] {
+			return a["Hostname"] < b["Hostname"]
+		}
+		return a["UUID"] < b["UUID"]
+	})
+}
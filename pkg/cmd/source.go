@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Source types selectable with METRICS_SOURCE
+const (
+	SourcePrometheus = "prometheus"
+	SourceExporter   = "exporter"
+	SourceFile       = "file"
+	SourceSimulate   = "simulate"
+)
+
+// Replica orders selectable with PROMETHEUS_FAILOVER
+const (
+	FailoverOrdered = "ordered"
+	FailoverRandom  = "random"
+)
+
+// MetricSource provides the raw metric results that are merged into GPU statuses
+type MetricSource interface {
+	// FetchInstant returns the latest sample of every requested metric
+	FetchInstant(ctx context.Context, metricNames []string) ([]Result, error)
+
+	// FetchRange returns the samples of every requested metric between start and end
+	FetchRange(ctx context.Context, metricNames []string, start, end time.Time, step time.Duration) ([]Result, error)
+
+	// HealthCheck returns an error when the source cannot serve requests
+	HealthCheck(ctx context.Context) error
+}
+
+// NewSourceFromEnv creates the metric source selected by METRICS_SOURCE.
+// When METRICS_SOURCE is not set, the exporter source is used if EXPORTER_URLS
+// is set and the Prometheus source otherwise. The Prometheus source queries
+// every cluster of PROMETHEUS_BACKENDS when set, and PROMETHEUS_URL otherwise.
+func NewSourceFromEnv() (MetricSource, error) {
+	cfg := DefaultConfig().Source
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	switch cfg.sourceType() {
+	case SourcePrometheus:
+		if len(cfg.Prometheus.URLs) == 0 && len(cfg.Prometheus.Backends) == 0 {
+			return nil, fmt.Errorf("PROMETHEUS_URL environment variable is not set")
+		}
+	case SourceExporter:
+		if len(cfg.Exporter.URLs) == 0 {
+			return nil, fmt.Errorf("EXPORTER_URLS environment variable is not set")
+		}
+	case SourceFile:
+		if cfg.File.Path == "" {
+			return nil, fmt.Errorf("METRICS_FILE environment variable is not set")
+		}
+	case SourceSimulate:
+	default:
+		return nil, fmt.Errorf("invalid METRICS_SOURCE: %s", cfg.Type)
+	}
+
+	return cfg.NewSource()
+}
+
+// NewSource creates the configured metric source
+func (c *SourceConfig) NewSource() (MetricSource, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch c.sourceType() {
+	case SourcePrometheus:
+		client, err := c.Client.NewClient(&c.Prometheus.Auth)
+		if err != nil {
+			return nil, err
+		}
+		selector, err := ParseSelector(c.Prometheus.Selector)
+		if err != nil {
+			return nil, err
+		}
+		randomize := c.Prometheus.Failover == FailoverRandom
+
+		if len(c.Prometheus.Backends) > 0 {
+			backends := make([]NamedSource, 0, len(c.Prometheus.Backends))
+			for name, replicas := range c.Prometheus.Backends {
+				backends = append(backends, NamedSource{Name: name, Source: &PrometheusSource{
+					URLs: replicas, Randomize: randomize, Client: client, Selector: selector,
+				}})
+			}
+			sort.Slice(backends, func(i, j int) bool {
+				return backends[i].Name < backends[j].Name
+			})
+			return &MultiSource{Backends: backends}, nil
+		}
+		return &PrometheusSource{URLs: c.Prometheus.URLs, Randomize: randomize, Client: client, Selector: selector}, nil
+	case SourceExporter:
+		client, err := c.Client.NewClient(nil)
+		if err != nil {
+			return nil, err
+		}
+		return &ExporterSource{URLs: c.Exporter.URLs, Client: client}, nil
+	case SourceFile:
+		return &FileSource{Path: c.File.Path, Interval: c.File.Interval, Rebase: c.File.Rebase}, nil
+	default:
+		sim := c.Simulator
+		return &sim, nil
+	}
+}
+
+// sourceEnvVars lists the environment variables that configure the metric source
+var sourceEnvVars = []string{
+	"METRICS_SOURCE",
+	"PROMETHEUS_URL",
+	"PROMETHEUS_BACKENDS",
+	"PROMETHEUS_FAILOVER",
+	"PROMETHEUS_SELECTOR",
+	"EXPORTER_URLS",
+	"METRICS_FILE",
+	"METRICS_FILE_INTERVAL",
+	"METRICS_FILE_REBASE",
+	"SIM_HOSTS",
+	"SIM_GPUS_PER_HOST",
+	"SIM_MODELS",
+	"SIM_PATTERN",
+	"SIM_XID_RATE",
+	"SIM_THROTTLE_RATE",
+	"SIM_SEED",
+}
+
+// envSource caches the source created from the environment, so stateful
+// sources such as snapshot playback keep their state across requests
+var envSource struct {
+	mu     sync.Mutex
+	key    string
+	source MetricSource
+}
+
+// cachedSourceFromEnv returns the source configured by the environment,
+// creating a new one only when the source environment variables change
+func cachedSourceFromEnv() (MetricSource, error) {
+	var key strings.Builder
+	envVars := append(append(append([]string(nil), sourceEnvVars...), authEnvVars...), clientEnvVars...)
+	for _, name := range envVars {
+		fmt.Fprintf(&key, "%s=%q;", name, os.Getenv(name))
+	}
+
+	envSource.mu.Lock()
+	defer envSource.mu.Unlock()
+
+	if envSource.source != nil && envSource.key == key.String() {
+		return envSource.source, nil
+	}
+
+	source, err := NewSourceFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	envSource.key = key.String()
+	envSource.source = source
+	return source, nil
+}
+
+// filterResults keeps the results whose metric name is one of metricNames
+func filterResults(results []Result, metricNames []string) []Result {
+	wanted := make(map[string]bool, len(metricNames))
+	for _, metric := range metricNames {
+		wanted[metric] = true
+	}
+
+	var filtered []Result
+	for _, result := range results {
+		if wanted[result.Metric["__name__"]] {
+			filtered = append(filtered, result)
+		}
+	}
+	return filtered
+}
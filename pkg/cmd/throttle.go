@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+)
+
+// Clock event (throttle) reason bits as reported by DCGM
+const (
+	ThrottleGpuIdle              uint64 = 0x1
+	ThrottleApplicationsClocks   uint64 = 0x2
+	ThrottleSwPowerCap           uint64 = 0x4
+	ThrottleHwSlowdown           uint64 = 0x8
+	ThrottleSyncBoost            uint64 = 0x10
+	ThrottleSwThermalSlowdown    uint64 = 0x20
+	ThrottleHwThermalSlowdown    uint64 = 0x40
+	ThrottleHwPowerBrakeSlowdown uint64 = 0x80
+	ThrottleDisplayClockSetting  uint64 = 0x100
+)
+
+// throttlingMask holds the reasons that actually slow a GPU down.
+// Idle and clock settings are informational and do not count as throttling.
+const throttlingMask = ThrottleSwPowerCap | ThrottleHwSlowdown | ThrottleSyncBoost |
+	ThrottleSwThermalSlowdown | ThrottleHwThermalSlowdown | ThrottleHwPowerBrakeSlowdown
+
+// throttleReasonNames maps each reason bit to its name, in bit order
+var throttleReasonNames = []struct {
+	bit  uint64
+	name string
+}{
+	{ThrottleGpuIdle, "gpu_idle"},
+	{ThrottleApplicationsClocks, "applications_clocks_setting"},
+	{ThrottleSwPowerCap, "sw_power_cap"},
+	{ThrottleHwSlowdown, "hw_slowdown"},
+	{ThrottleSyncBoost, "sync_boost"},
+	{ThrottleSwThermalSlowdown, "sw_thermal_slowdown"},
+	{ThrottleHwThermalSlowdown, "hw_thermal_slowdown"},
+	{ThrottleHwPowerBrakeSlowdown, "hw_power_brake_slowdown"},
+	{ThrottleDisplayClockSetting, "display_clock_setting"},
+}
+
+// ThrottleReport describes a GPU that is currently throttled
+type ThrottleReport struct {
+	Hostname string   `json:"Hostname"`
+	DeviceID string   `json:"gpu"`
+	UUID     string   `json:"uuid"`
+	Name     string   `json:"modelName"`
+	Mask     uint64   `json:"throttle_reasons_mask"`
+	Reasons  []string `json:"throttle_reasons"`
+	GPUUtil  float64  `json:"gpu_utilization"`
+	GPUTemp  float64  `json:"gpu_temp"`
+}
+
+// DecodeThrottleReasons decodes a clock event reasons bitmask into reason names.
+// Bits without a known name are reported as "unknown_0x<bit>".
+func DecodeThrottleReasons(mask uint64) []string {
+	var reasons []string
+	known := uint64(0)
+	for _, r := range throttleReasonNames {
+		known |= r.bit
+		if mask&r.bit != 0 {
+			reasons = append(reasons, r.name)
+		}
+	}
+	for rest := mask &^ known; rest != 0; rest &= rest - 1 {
+		reasons = append(reasons, fmt.Sprintf("unknown_0x%x", rest&-rest))
+	}
+	return reasons
+}
+
+// IsThrottled reports whether the GPU is being slowed down by at least one reason
+func (s *GpuStatus) IsThrottled() bool {
+	return s.ThrottleMask&throttlingMask != 0
+}
+
+// ThrottledGpus returns a report of the GPUs that are currently throttled and why
+func ThrottledGpus(statuses []GpuStatus) []ThrottleReport {
+	reports := make([]ThrottleReport, 0)
+	for _, s := range statuses {
+		if !s.IsThrottled() {
+			continue
+		}
+		reports = append(reports, ThrottleReport{
+			Hostname: s.Hostname,
+			DeviceID: s.DeviceID,
+			UUID:     s.UUID,
+			Name:     s.Name,
+			Mask:     s.ThrottleMask,
+			Reasons:  s.ThrottleReasons,
+			GPUUtil:  s.GPUUtil,
+			GPUTemp:  s.GPUTemp,
+		})
+	}
+	return reports
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// nvlinkLanePrefix is the prefix of the per-link NVLink bandwidth counters (L0, L1, ...)
+	nvlinkLanePrefix = "DCGM_FI_DEV_NVLINK_BANDWIDTH_L"
+
+	// nvlinkRateWindow is the range over which the NVLink counters are turned into rates
+	nvlinkRateWindow = "2m"
+
+	// bytesPerKiB converts the KiB based DCGM fields to bytes
+	bytesPerKiB = 1024
+)
+
+// HostSummary represents the aggregated throughput of all GPUs on a host
+type HostSummary struct {
+	Hostname      string  `json:"Hostname"`
+	GPUCount      int     `json:"gpu_count"`
+	PCIeTxBytes   float64 `json:"pcie_tx_bytes_per_sec"`
+	PCIeRxBytes   float64 `json:"pcie_rx_bytes_per_sec"`
+	NVLinkTxBytes float64 `json:"nvlink_tx_bytes_per_sec"`
+	NVLinkRxBytes float64 `json:"nvlink_rx_bytes_per_sec"`
+	NVLinkBytes   float64 `json:"nvlink_bytes_per_sec"`
+}
+
+// isNVLinkCounter reports whether a metric is a cumulative NVLink bandwidth
+// counter (in KiB), which is queried as a per-second rate
+func isNVLinkCounter(metricName string) bool {
+	_, isLane := nvlinkLane(metricName)
+	return isLane || metricName == MetricNVLinkBandwidth
+}
+
+// metricQuery returns the query of a metric: the metric itself, or its rate
+// over nvlinkRateWindow for the NVLink counters
+func metricQuery(metricName string) string {
+	if isNVLinkCounter(metricName) {
+		return fmt.Sprintf("rate(%s[%s])", metricName, nvlinkRateWindow)
+	}
+	return metricName
+}
+
+// nvlinkLane returns the lane number of a per-link NVLink bandwidth counter
+func nvlinkLane(metricName string) (int, bool) {
+	if !strings.HasPrefix(metricName, nvlinkLanePrefix) {
+		return 0, false
+	}
+	lane, err := strconv.Atoi(strings.TrimPrefix(metricName, nvlinkLanePrefix))
+	if err != nil || lane < 0 {
+		return 0, false
+	}
+	return lane, true
+}
+
+// setNVLinkRate sets the rate (in KiB/s) of a per-link or total NVLink counter in bytes/sec on the status
+func setNVLinkRate(status *GpuStatus, metricName string, val float64) {
+	if lane, isLane := nvlinkLane(metricName); isLane {
+		if status.NVLinkLinks == nil {
+			status.NVLinkLinks = make(map[string]float64)
+		}
+		status.NVLinkLinks[fmt.Sprintf("L%d", lane)] = val * bytesPerKiB
+		return
+	}
+	status.NVLinkBytes = val * bytesPerKiB
+}
+
+// SummarizeHosts sums the per-GPU throughput of every host
+func SummarizeHosts(statuses []GpuStatus) []HostSummary {
+	hostMap := make(map[string]*HostSummary)
+	for _, s := range statuses {
+		summary, exists := hostMap[s.Hostname]
+		if !exists {
+			summary = &HostSummary{Hostname: s.Hostname}
+			hostMap[s.Hostname] = summary
+		}
+		summary.GPUCount++
+		summary.PCIeTxBytes += s.PCIeTxBytes
+		summary.PCIeRxBytes += s.PCIeRxBytes
+		summary.NVLinkTxBytes += s.NVLinkTxBytes
+		summary.NVLinkRxBytes += s.NVLinkRxBytes
+		if s.NVLinkBytes != 0 {
+			summary.NVLinkBytes += s.NVLinkBytes
+		} else {
+			// Fall back to the per-link counters when the total is not collected
+			for _, rate := range s.NVLinkLinks {
+				summary.NVLinkBytes += rate
+			}
+		}
+	}
+
+	summaries := make([]HostSummary, 0, len(hostMap))
+	for _, s := range hostMap {
+		summaries = append(summaries, *s)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Hostname < summaries[j].Hostname
+	})
+	return summaries
+}
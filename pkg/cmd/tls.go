@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Client certificate policies of the API listener
+const (
+	ClientAuthRequire  = "require"
+	ClientAuthOptional = "optional"
+)
+
+// TLSConfig configures HTTPS on the API listener. The certificate, key and
+// client CA files are reloaded when they change, so rotated certificates are
+// picked up without a restart.
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ClientCAFile enables mTLS: client certificates are verified against it
+	ClientCAFile string `yaml:"client_ca_file"`
+	// ClientAuth is require (default) or optional, verifying client certificates only when presented
+	ClientAuth string `yaml:"client_auth"`
+}
+
+// Enabled reports whether HTTPS is configured
+func (c *TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// applyEnv overrides the TLS settings with the environment variables
+func (c *TLSConfig) applyEnv() {
+	if v := os.Getenv("TLS_CERT_FILE"); v != "" {
+		c.CertFile = v
+	}
+	if v := os.Getenv("TLS_KEY_FILE"); v != "" {
+		c.KeyFile = v
+	}
+	if v := os.Getenv("TLS_CLIENT_CA_FILE"); v != "" {
+		c.ClientCAFile = v
+	}
+	if v := os.Getenv("TLS_CLIENT_AUTH"); v != "" {
+		c.ClientAuth = v
+	}
+}
+
+// Validate checks that the settings are consistent
+func (c *TLSConfig) Validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("cert_file and key_file must be set together")
+	}
+	if c.ClientCAFile != "" && !c.Enabled() {
+		return fmt.Errorf("client_ca_file requires cert_file and key_file")
+	}
+	switch c.ClientAuth {
+	case "", ClientAuthRequire, ClientAuthOptional:
+	default:
+		return fmt.Errorf("client_auth must be require or optional: %q", c.ClientAuth)
+	}
+	if c.ClientAuth != "" && c.ClientCAFile == "" {
+		return fmt.Errorf("client_auth requires client_ca_file")
+	}
+	return nil
+}
+
+// serverConfig returns the TLS configuration of the API listener, or nil when HTTPS is disabled
+func (c *TLSConfig) serverConfig() (*tls.Config, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+
+	certs := &fileCertificate{certFile: c.CertFile, keyFile: c.KeyFile}
+	if _, err := certs.load(); err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return certs.load()
+		},
+	}
+	if c.ClientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	clientCAs := &fileCertPool{path: c.ClientCAFile}
+	if _, err := clientCAs.load(); err != nil {
+		return nil, err
+	}
+	clientAuth := tls.RequireAndVerifyClientCert
+	if c.ClientAuth == ClientAuthOptional {
+		clientAuth = tls.VerifyClientCertIfGiven
+	}
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		pool, err := clientCAs.load()
+		if err != nil {
+			return nil, err
+		}
+		cfg := tlsConfig.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.ClientAuth = clientAuth
+		cfg.ClientCAs = pool
+		return cfg, nil
+	}
+	return tlsConfig, nil
+}
+
+// fileCertPool is a CA bundle reloaded when the file changes
+type fileCertPool struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	pool    *x509.CertPool
+	failure reloadWarning
+}
+
+// load returns the current pool, re-reading the file if it was modified.
+// Once a pool was read, failures to re-read it keep the previous pool.
+func (f *fileCertPool) load() (*x509.CertPool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pool, err := f.reload()
+	if err != nil {
+		if f.pool == nil {
+			return nil, err
+		}
+		f.failure.warn("client CA file", err)
+		return f.pool, nil
+	}
+	f.failure = reloadWarning{}
+	return pool, nil
+}
+
+// reload re-reads the CA file if it was modified
+func (f *fileCertPool) reload() (*x509.CertPool, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file: %v", err)
+	}
+
+	if f.pool != nil && info.ModTime().Equal(f.modTime) {
+		return f.pool, nil
+	}
+
+	pem, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client CA file %s", f.path)
+	}
+
+	f.pool = pool
+	f.modTime = info.ModTime()
+	return f.pool, nil
+}
@@ -0,0 +1,366 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Sort keys of the top view
+const (
+	TopSortHost      = "host"
+	TopSortUtil      = "util"
+	TopSortMem       = "mem"
+	TopSortTemp      = "temp"
+	TopSortEffective = "effective"
+)
+
+// ANSI escape sequences used by the top view
+const (
+	ansiReset       = "\x1b[0m"
+	ansiBold        = "\x1b[1m"
+	ansiGreen       = "\x1b[32m"
+	ansiYellow      = "\x1b[33m"
+	ansiRed         = "\x1b[31m"
+	ansiClearScreen = "\x1b[H\x1b[2J"
+)
+
+// topMetricNames are the metrics shown by the top view, fetched when no metric names are configured
+var topMetricNames = []string{MetricGPUUtil, MetricGPUMemoryUtil, MetricGPUMemoryUsed, MetricGPUMemoryFree, MetricGPUTemp}
+
+// Thresholds are the values from which a metric is shown as a warning or as critical
+type Thresholds struct {
+	Warn, Crit float64
+}
+
+// String formats the thresholds as warn,crit
+func (t *Thresholds) String() string {
+	return strconv.FormatFloat(t.Warn, 'g', -1, 64) + "," + strconv.FormatFloat(t.Crit, 'g', -1, 64)
+}
+
+// Set parses thresholds formatted as warn,crit
+func (t *Thresholds) Set(s string) error {
+	warnStr, critStr, ok := strings.Cut(s, ",")
+	if !ok {
+		return fmt.Errorf("thresholds must be formatted as warn,crit: %s", s)
+	}
+	warn, err := strconv.ParseFloat(strings.TrimSpace(warnStr), 64)
+	if err != nil {
+		return fmt.Errorf("invalid warning threshold: %s", warnStr)
+	}
+	crit, err := strconv.ParseFloat(strings.TrimSpace(critStr), 64)
+	if err != nil {
+		return fmt.Errorf("invalid critical threshold: %s", critStr)
+	}
+	if crit < warn {
+		return fmt.Errorf("critical threshold %g is below warning threshold %g", crit, warn)
+	}
+	t.Warn, t.Crit = warn, crit
+	return nil
+}
+
+// color returns the color of value, or no color for NaN
+func (t Thresholds) color(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return ""
+	case value >= t.Crit:
+		return ansiRed
+	case value >= t.Warn:
+		return ansiYellow
+	default:
+		return ansiGreen
+	}
+}
+
+// TopOptions configure the top view
+type TopOptions struct {
+	Sort  string
+	Color bool
+	// Util, Mem and Temp color the utilization (%), the used memory (%) and the temperature (C)
+	Util, Mem, Temp Thresholds
+}
+
+// DefaultTopOptions returns the default sort key and color thresholds
+func DefaultTopOptions() TopOptions {
+	return TopOptions{
+		Sort:  TopSortHost,
+		Color: true,
+		Util:  Thresholds{Warn: 70, Crit: 90},
+		Mem:   Thresholds{Warn: 80, Crit: 95},
+		Temp:  Thresholds{Warn: 75, Crit: 85},
+	}
+}
+
+// validTopSort reports whether key is a sort key of the top view
+func validTopSort(key string) bool {
+	switch key {
+	case TopSortHost, TopSortUtil, TopSortMem, TopSortTemp, TopSortEffective:
+		return true
+	}
+	return false
+}
+
+// memPercent returns the share of the GPU memory in use
+func memPercent(gpu GpuStatus) float64 {
+	if gpu.MemTotal == 0 {
+		return math.NaN()
+	}
+	return gpu.MemUsed / gpu.MemTotal * 100
+}
+
+// sortTop sorts the GPUs by key, busiest first for metrics and then by host and device
+func sortTop(data []GpuStatus, key string) {
+	value := func(gpu GpuStatus) float64 {
+		switch key {
+		case TopSortUtil:
+			return gpu.GPUUtil
+		case TopSortMem:
+			return memPercent(gpu)
+		case TopSortTemp:
+			return gpu.GPUTemp
+		case TopSortEffective:
+			return gpu.EffectiveUtil
+		}
+		return 0
+	}
+
+	sort.SliceStable(data, func(i, j int) bool {
+		vi, vj := value(data[i]), value(data[j])
+		// NaN values rank last
+		if iNaN, jNaN := math.IsNaN(vi), math.IsNaN(vj); iNaN != jNaN {
+			return jNaN
+		}
+		if vi != vj && !math.IsNaN(vi) {
+			return vi > vj
+		}
+		return ByHostnameAndDeviceID(data).Less(i, j)
+	})
+}
+
+// topCell is a table cell with its color
+type topCell struct {
+	text, color string
+}
+
+// RenderTop writes one frame of the top view: a summary line and a table of the GPUs
+func RenderTop(w io.Writer, data []GpuStatus, opts TopOptions, now time.Time) error {
+	data = append([]GpuStatus(nil), data...)
+	sortTop(data, opts.Sort)
+
+	hosts := make(map[string]bool)
+	var utilSum float64
+	var utilCount int
+	for _, gpu := range data {
+		hosts[gpu.Hostname] = true
+		if !math.IsNaN(gpu.GPUUtil) {
+			utilSum += gpu.GPUUtil
+			utilCount++
+		}
+	}
+	avgUtil := math.NaN()
+	if utilCount > 0 {
+		avgUtil = utilSum / float64(utilCount)
+	}
+
+	rows := [][]topCell{{{text: "HOST"}, {text: "GPU"}, {text: "MODEL"}, {text: "UTIL"}, {text: "MEM USED/TOTAL"}, {text: "MEM"}, {text: "TEMP"}}}
+	for _, gpu := range data {
+		mem := memPercent(gpu)
+		rows = append(rows, []topCell{
+			{text: gpu.Hostname},
+			{text: gpu.DeviceID},
+			{text: gpu.Name},
+			{text: fmt.Sprintf("%.0f%%", gpu.GPUUtil), color: opts.Util.color(gpu.GPUUtil)},
+			{text: fmt.Sprintf("%.0f/%.0f MiB", gpu.MemUsed, gpu.MemTotal)},
+			{text: fmt.Sprintf("%.0f%%", mem), color: opts.Mem.color(mem)},
+			{text: fmt.Sprintf("%.0fC", gpu.GPUTemp), color: opts.Temp.color(gpu.GPUTemp)},
+		})
+	}
+
+	// Pad outside the colors so that escape sequences do not upset the alignment
+	widths := make([]int, len(rows[0]))
+	for _, row := range rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], len(cell.text))
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s - %d GPUs on %d hosts, average utilization %.0f%%\n\n",
+		now.Format(time.DateTime), len(data), len(hosts), avgUtil)
+	for r, row := range rows {
+		for i, cell := range row {
+			color := cell.color
+			if r == 0 {
+				color = ansiBold
+			}
+			if opts.Color && color != "" {
+				b.WriteString(color + cell.text + ansiReset)
+			} else {
+				b.WriteString(cell.text)
+			}
+			if i < len(row)-1 {
+				b.WriteString(strings.Repeat(" ", widths[i]-len(cell.text)+2))
+			}
+		}
+		b.WriteByte('\n')
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// fetchFunc fetches the GPU statuses of one refresh of the top view
+type fetchFunc func(ctx context.Context) ([]GpuStatus, error)
+
+// fetchFromAPI returns a fetchFunc reading the GPU statuses from the metrics endpoint of a running API server,
+// authenticating with apiKey if set
+func fetchFromAPI(client *http.Client, endpoint, apiKey string, matchers []LabelMatcher) (fetchFunc, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid API URL: %s", endpoint)
+	}
+	query := u.Query()
+	for _, m := range matchers {
+		query.Add("match", m.Name+m.Op+m.Value)
+	}
+	u.RawQuery = query.Encode()
+
+	return func(ctx context.Context) ([]GpuStatus, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if apiKey != "" {
+			req.Header.Set(APIKeyHeader, apiKey)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			var errResp ErrorResponse
+			if json.NewDecoder(resp.Body).Decode(&errResp) == nil && errResp.Error != "" {
+				return nil, fmt.Errorf("API returned %s: %s", resp.Status, errResp.Error)
+			}
+			return nil, fmt.Errorf("API returned %s", resp.Status)
+		}
+
+		var data []GpuStatus
+		if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+			return nil, fmt.Errorf("failed to decode API response: %v", err)
+		}
+		return data, nil
+	}, nil
+}
+
+// runTop polls the GPU statuses and renders them as a refreshing table
+func runTop(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("top", stderr)
+	var flags ConfigFlags
+	flags.RegisterSource(fs)
+	opts := DefaultTopOptions()
+	api := fs.String("api", "", "URL of the metrics endpoint of a running API server, e.g. http://dcgm-metrics-api:8080/metrics (default: query the configured source)")
+	apiKey := fs.String("api-key", os.Getenv("API_KEY"), "API key of the server (default from API_KEY)")
+	hostPattern := fs.String("host", "", "regular expression the host names must match")
+	interval := fs.Duration("interval", 2*time.Second, "refresh interval")
+	count := fs.Int("count", 0, "number of refreshes before exiting (default: until interrupted)")
+	noColor := fs.Bool("no-color", os.Getenv("NO_COLOR") != "", "disable colors (default true when NO_COLOR is set)")
+	fs.StringVar(&opts.Sort, "sort", opts.Sort, "sort key: host, util, mem, temp or effective")
+	fs.Var(&opts.Util, "util-thresholds", "warning and critical GPU utilization in %")
+	fs.Var(&opts.Mem, "mem-thresholds", "warning and critical memory usage in %")
+	fs.Var(&opts.Temp, "temp-thresholds", "warning and critical temperature in C")
+	if err := parseFlags(fs, args); err != nil {
+		return ignoreHelp(err)
+	}
+	opts.Color = !*noColor
+
+	if !validTopSort(opts.Sort) {
+		return fmt.Errorf("invalid sort key: %s", opts.Sort)
+	}
+	if *interval <= 0 {
+		return fmt.Errorf("interval must be positive: %v", *interval)
+	}
+	var matchers []LabelMatcher
+	if *hostPattern != "" {
+		matcher, err := NewLabelMatcher("Hostname", MatchRegexp, *hostPattern)
+		if err != nil {
+			return fmt.Errorf("invalid host pattern: %v", err)
+		}
+		matchers = append(matchers, matcher)
+	}
+
+	var fetch fetchFunc
+	if *api != "" {
+		var err error
+		if fetch, err = fetchFromAPI(defaultClient, *api, *apiKey, matchers); err != nil {
+			return err
+		}
+	} else {
+		// Fetch the displayed metrics unless other metrics are configured
+		if flags.MetricNames == "" && flags.ConfigFile == "" && os.Getenv("METRIC_NAMES") == "" {
+			flags.MetricNames = strings.Join(topMetricNames, ",")
+		}
+		cfg, err := LoadConfig(flags.ConfigFile, &flags)
+		if err != nil {
+			return err
+		}
+		h, err := NewHandlersFromConfig(cfg)
+		if err != nil {
+			return err
+		}
+		fetch = func(ctx context.Context) ([]GpuStatus, error) {
+			report, err := h.Fetch(ctx, matchers)
+			return report.Statuses, err
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	for i := 0; *count <= 0 || i < *count; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(*interval):
+			}
+		}
+
+		fetchCtx, cancel := context.WithTimeout(ctx, *interval+10*time.Second)
+		data, err := fetch(fetchCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if *count != 1 {
+			io.WriteString(stdout, ansiClearScreen)
+		}
+		if err != nil {
+			// Keep polling; the source may recover
+			fmt.Fprintf(stdout, "%s - failed to fetch GPU statuses: %v\n", time.Now().Format(time.DateTime), err)
+			if *count == 1 {
+				return err
+			}
+			continue
+		}
+		if err := RenderTop(stdout, data, opts, time.Now()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
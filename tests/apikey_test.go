@@ -0,0 +1,261 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
+)
+
+// podResult is a GPU temperature sample of a GPU used by a pod, with the pod
+// labels renamed by Prometheus as when scraping dcgm-exporter
+func podResult(host, uuid, namespace, pod string) cmd.Result {
+	result := throughputResult("DCGM_FI_DEV_GPU_TEMP", host, "0", uuid, 1743982065, "40")
+	result.Metric["namespace"] = "gpu-operator"
+	result.Metric["exported_namespace"] = namespace
+	result.Metric["exported_pod"] = pod
+	return result
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	prom := newPrometheusServer(t,
+		podResult("node-a", "key-uuid-1", "ml", "train-0"),
+		podResult("node-b", "key-uuid-2", "ml", "train-1"),
+		podResult("node-b", "key-uuid-3", "web", "infer-0"),
+	)
+
+	keysFile := filepath.Join(t.TempDir(), "keys.yaml")
+	if err := os.WriteFile(keysFile, []byte("- id: from-file\n  key: file-secret\n"), 0o600); err != nil {
+		t.Fatalf("failed to write keys file: %v", err)
+	}
+	teamDigest := sha256.Sum256([]byte("team-secret"))
+
+	cfg := cmd.DefaultConfig()
+	cfg.Source.Prometheus.URLs = cmd.ParseReplicaURLs(prom.URL)
+	cfg.Metrics.Names = []string{"DCGM_FI_DEV_GPU_TEMP"}
+	cfg.Auth = cmd.APIAuthConfig{
+		APIKeys: []cmd.APIKey{
+			{ID: "admin", Key: "admin-secret"},
+			{ID: "ops", Key: "ops-secret", Endpoints: []string{"/metrics", "/hosts/*"}, Hostnames: []string{"node-a"}},
+			{ID: "team", KeySHA256: hex.EncodeToString(teamDigest[:]), Namespaces: []string{"ml"}},
+			{ID: "operator", Key: "operator-secret", Admin: true},
+		},
+		APIKeysFile: keysFile,
+	}
+	handler, err := cmd.NewServer(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		name           string
+		path           string
+		header         string
+		value          string
+		expectedStatus int
+		expectedGPUs   []string
+	}{
+		{name: "Missing key", path: "/metrics", expectedStatus: http.StatusUnauthorized},
+		{name: "Invalid key", path: "/metrics", header: cmd.APIKeyHeader, value: "guess", expectedStatus: http.StatusUnauthorized},
+		{name: "Probe without key", path: "/health", expectedStatus: http.StatusOK},
+		{
+			name: "Unrestricted key as bearer token", path: "/metrics",
+			header: "Authorization", value: "Bearer admin-secret",
+			expectedStatus: http.StatusOK, expectedGPUs: []string{"key-uuid-1", "key-uuid-2", "key-uuid-3"},
+		},
+		{
+			name: "Key scoped to a host", path: "/metrics",
+			header: cmd.APIKeyHeader, value: "ops-secret",
+			expectedStatus: http.StatusOK, expectedGPUs: []string{"key-uuid-1"},
+		},
+		{
+			name: "Host outside the scope", path: "/hosts/node-b",
+			header: cmd.APIKeyHeader, value: "ops-secret",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name: "Endpoint outside the scope", path: "/throttling",
+			header: cmd.APIKeyHeader, value: "ops-secret",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name: "Key scoped to a namespace", path: "/metrics",
+			header: cmd.APIKeyHeader, value: "team-secret",
+			expectedStatus: http.StatusOK, expectedGPUs: []string{"key-uuid-1", "key-uuid-2"},
+		},
+		{
+			name: "Admin endpoint without the admin scope", path: "/admin/config",
+			header: cmd.APIKeyHeader, value: "admin-secret",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name: "Admin endpoint with a namespace scope", path: "/admin/config",
+			header: cmd.APIKeyHeader, value: "team-secret",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name: "Admin endpoint with the admin scope", path: "/admin/config",
+			header: cmd.APIKeyHeader, value: "operator-secret",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "Simulator endpoint with a namespace scope", path: "/simulator/metrics",
+			header: cmd.APIKeyHeader, value: "team-secret",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name: "Key from the keys file", path: "/gpus/key-uuid-3",
+			header: "Authorization", value: "Bearer file-secret",
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL+tt.path, nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+			if resp.StatusCode == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("expected a WWW-Authenticate challenge, got %q", resp.Header.Get("WWW-Authenticate"))
+			}
+			if tt.expectedGPUs == nil {
+				return
+			}
+
+			var statuses []cmd.GpuStatus
+			if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			var uuids []string
+			for _, s := range statuses {
+				uuids = append(uuids, s.UUID)
+			}
+			sort.Strings(uuids)
+			if strings.Join(uuids, ",") != strings.Join(tt.expectedGPUs, ",") {
+				t.Errorf("expected GPUs %v, got %v", tt.expectedGPUs, uuids)
+			}
+		})
+	}
+
+	// The audit log names the keys but never contains them
+	audit := logs.String()
+	for _, expected := range []string{"audit: client=ops method=GET path=/metrics status=200", "audit: rejected client=ops method=GET path=/throttling", "audit: client=from-file"} {
+		if !strings.Contains(audit, expected) {
+			t.Errorf("expected audit log containing %q, got %q", expected, audit)
+		}
+	}
+	if strings.Contains(audit, "secret") {
+		t.Errorf("expected no keys in the audit log, got %q", audit)
+	}
+}
+
+func TestAPIKeysFileReload(t *testing.T) {
+	prom := newPrometheusServer(t, podResult("node-a", "keys-file-uuid-1", "ml", "train-0"))
+
+	keysFile := filepath.Join(t.TempDir(), "keys.yaml")
+	writeKeys := func(content string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(keysFile, []byte(content), 0o600); err != nil {
+			t.Fatalf("failed to write keys file: %v", err)
+		}
+		if err := os.Chtimes(keysFile, modTime, modTime); err != nil {
+			t.Fatalf("failed to set the modification time: %v", err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	writeKeys("- id: from-file\n  key: file-secret\n", start)
+
+	cfg := cmd.DefaultConfig()
+	cfg.Source.Prometheus.URLs = cmd.ParseReplicaURLs(prom.URL)
+	cfg.Metrics.Names = []string{"DCGM_FI_DEV_GPU_TEMP"}
+	cfg.Auth = cmd.APIAuthConfig{
+		APIKeys:     []cmd.APIKey{{ID: "admin", Key: "admin-secret"}},
+		APIKeysFile: keysFile,
+	}
+	handler, err := cmd.NewServer(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	status := func(key string) int {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set(cmd.APIKeyHeader, key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// A broken file keeps the last good keys, and the configured keys still work
+	writeKeys("- id: from-file\n  key: [broken\n", start.Add(time.Minute))
+	for i := 0; i < 3; i++ {
+		for _, key := range []string{"file-secret", "admin-secret"} {
+			if code := status(key); code != http.StatusOK {
+				t.Errorf("request %d with %s: expected status %d, got %d", i, key, http.StatusOK, code)
+			}
+		}
+	}
+	if count := strings.Count(logs.String(), "Failed to reload API keys"); count != 1 {
+		t.Errorf("expected the broken file to be logged once, got %d times: %q", count, logs.String())
+	}
+
+	// A fixed file is read again
+	writeKeys("- id: rotated\n  key: rotated-secret\n", start.Add(2*time.Minute))
+	if code := status("rotated-secret"); code != http.StatusOK {
+		t.Errorf("expected status %d for the rotated key, got %d", http.StatusOK, code)
+	}
+	if code := status("file-secret"); code != http.StatusUnauthorized {
+		t.Errorf("expected status %d for the removed key, got %d", http.StatusUnauthorized, code)
+	}
+}
+
+func TestMergePodLabels(t *testing.T) {
+	statuses, err := cmd.MergeGpuMetrics([]cmd.Result{
+		podResult("node-a", "pod-uuid-1", "ml", "train-0"),
+		throughputResult("DCGM_FI_DEV_GPU_TEMP", "node-a", "1", "pod-uuid-2", 1743982065, "40"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sort.Sort(cmd.ByHostnameAndDeviceID(statuses))
+
+	if statuses[0].Namespace != "ml" || statuses[0].Pod != "train-0" {
+		t.Errorf("expected the exported pod labels, got namespace %q and pod %q", statuses[0].Namespace, statuses[0].Pod)
+	}
+	if statuses[1].Namespace != "" || statuses[1].Pod != "" {
+		t.Errorf("expected no pod for an idle GPU, got namespace %q and pod %q", statuses[1].Namespace, statuses[1].Pod)
+	}
+}
@@ -1,11 +1,14 @@
 package tests
 
 import (
+	"context"
 	"encoding/json"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
 )
@@ -435,45 +438,103 @@ func TestMetricsHandler(t *testing.T) {
 	}
 }
 
-func TestRun(t *testing.T) {
-	// Test cases
-	tests := []struct {
-		name          string
-		endpoint      string
-		expectedError bool
-	}{
-		{
-			name:          "Default endpoint",
-			endpoint:      "",
-			expectedError: false,
-		},
-		{
-			name:          "Custom endpoint",
-			endpoint:      "/custom-metrics",
-			expectedError: false,
-		},
+// freeAddress returns a local address with a port that is currently free
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
 	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			// Set environment variable
-			if tt.endpoint != "" {
-				os.Setenv("METRICS_ENDPOINT", tt.endpoint)
-			} else {
-				os.Unsetenv("METRICS_ENDPOINT")
+func TestRun(t *testing.T) {
+	clearConfigEnv(t)
+
+	// A Prometheus answering slowly, to have a request in flight during shutdown
+	received := make(chan struct{}, 1)
+	prom := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		time.Sleep(1500 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"DCGM_FI_DEV_GPU_TEMP","Hostname":"node-a","gpu":"0","UUID":"run-uuid"},"value":[1743982065,"40"]}]}}`))
+	}))
+	defer prom.Close()
+
+	addr := freeAddress(t)
+
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("LISTEN_ADDRESS", addr)
+	t.Setenv("PROMETHEUS_URL", prom.URL)
+	t.Setenv("METRIC_NAMES", "- DCGM_FI_DEV_GPU_TEMP")
+	t.Setenv("METRICS_ENDPOINT", "/custom-metrics")
+	t.Setenv("SHUTDOWN_DELAY", "1s")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Run(ctx)
+	}()
+
+	base := "http://" + addr
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get(base + "/health")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				break
 			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server did not become healthy: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
 
-			// Start server in a goroutine
-			go func() {
-				if err := cmd.Run(); err != nil {
-					t.Errorf("Run() error = %v", err)
-				}
-			}()
+	// Start a request, then shut down while it is in flight
+	metricsStatus := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(base + "/custom-metrics")
+		if err != nil {
+			t.Errorf("in-flight request failed: %v", err)
+			metricsStatus <- 0
+			return
+		}
+		resp.Body.Close()
+		metricsStatus <- resp.StatusCode
+	}()
+	<-received
+	cancel()
 
-			// Cleanup
-			defer func() {
-				os.Unsetenv("METRICS_ENDPOINT")
-			}()
-		})
+	// Readiness fails during the shutdown delay while the server still answers
+	deadline = time.Now().Add(500 * time.Millisecond)
+	for {
+		resp, err := http.Get(base + "/ready")
+		if err != nil {
+			t.Fatalf("expected the server to answer during the shutdown delay: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected readiness to fail during shutdown, got %d", resp.StatusCode)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if status := <-metricsStatus; status != http.StatusOK {
+		t.Errorf("expected the in-flight request to complete with 200, got %d", status)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after shutdown")
 	}
 }
@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
+)
+
+func TestPrometheusAuthentication(t *testing.T) {
+	var lastRequest *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastRequest = r
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("first-token\n"), 0o600); err != nil {
+		t.Fatalf("failed to write token file: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		config         cmd.AuthConfig
+		rotateToken    string
+		expectedAuth   string
+		expectedHeader string
+	}{
+		{
+			name:         "Bearer token",
+			config:       cmd.AuthConfig{BearerToken: "static-token"},
+			expectedAuth: "Bearer static-token",
+		},
+		{
+			name:         "Bearer token file",
+			config:       cmd.AuthConfig{BearerTokenFile: tokenFile},
+			expectedAuth: "Bearer first-token",
+		},
+		{
+			name:         "Bearer token file after rotation",
+			config:       cmd.AuthConfig{BearerTokenFile: tokenFile},
+			rotateToken:  "second-token",
+			expectedAuth: "Bearer second-token",
+		},
+		{
+			name:         "Basic auth",
+			config:       cmd.AuthConfig{BasicAuthUsername: "user", BasicAuthPassword: "pass"},
+			expectedAuth: "Basic dXNlcjpwYXNz",
+		},
+		{
+			name:           "Tenant header",
+			config:         cmd.AuthConfig{Headers: map[string]string{"X-Scope-OrgID": "gpu-team"}},
+			expectedHeader: "gpu-team",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := tt.config.Client()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			source := &cmd.PrometheusSource{URLs: []string{server.URL}, Client: client}
+
+			if tt.rotateToken != "" {
+				if err := source.HealthCheck(t.Context()); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				future := time.Now().Add(time.Minute)
+				if err := os.WriteFile(tokenFile, []byte(tt.rotateToken), 0o600); err != nil {
+					t.Fatalf("failed to rotate token: %v", err)
+				}
+				os.Chtimes(tokenFile, future, future)
+			}
+
+			if err := source.HealthCheck(t.Context()); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := lastRequest.Header.Get("Authorization"); got != tt.expectedAuth {
+				t.Errorf("expected Authorization %q, got %q", tt.expectedAuth, got)
+			}
+			if got := lastRequest.Header.Get("X-Scope-OrgID"); got != tt.expectedHeader {
+				t.Errorf("expected X-Scope-OrgID %q, got %q", tt.expectedHeader, got)
+			}
+		})
+	}
+
+	invalid := cmd.AuthConfig{BearerToken: "token", BasicAuthUsername: "user"}
+	if _, err := invalid.Client(); err == nil {
+		t.Error("expected error for bearer token combined with basic auth")
+	}
+	passwordOnly := cmd.AuthConfig{BasicAuthPassword: "pass"}
+	if _, err := passwordOnly.Client(); err == nil {
+		t.Error("expected error for a basic auth password without a username")
+	}
+}
+
+func TestPrometheusCustomCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer server.Close()
+
+	// Without the CA bundle the self-signed certificate is rejected
+	untrusted := &cmd.PrometheusSource{URLs: []string{server.URL}}
+	if err := untrusted.HealthCheck(t.Context()); err == nil {
+		t.Error("expected error for an untrusted certificate")
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatalf("failed to write CA file: %v", err)
+	}
+
+	auth := cmd.AuthConfig{CAFile: caFile}
+	client, err := auth.Client()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	trusted := &cmd.PrometheusSource{URLs: []string{server.URL}, Client: client}
+	if err := trusted.HealthCheck(t.Context()); err != nil {
+		t.Errorf("expected the CA bundle to be trusted, got %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
+)
+
+func TestExecuteQuery(t *testing.T) {
+	clearConfigEnv(t)
+
+	server := newPrometheusServer(t,
+		throughputResult("DCGM_FI_DEV_GPU_TEMP", "node-b", "0", "cli-uuid-2", 1743982065, "41"),
+		throughputResult("DCGM_FI_DEV_GPU_TEMP", "node-a", "0", "cli-uuid-1", 1743982065, "40"),
+	)
+	base := []string{"query", "-prometheus-url", server.URL, "-metric-names", "DCGM_FI_DEV_GPU_TEMP"}
+
+	tests := []struct {
+		name          string
+		args          []string
+		check         func(t *testing.T, output string)
+		expectedError string
+	}{
+		{
+			name: "Table",
+			args: base,
+			check: func(t *testing.T, output string) {
+				lines := strings.Split(strings.TrimSpace(output), "\n")
+				if len(lines) != 3 {
+					t.Fatalf("expected a header and 2 rows, got %q", output)
+				}
+				if !strings.HasPrefix(lines[0], "HOST") || !strings.HasPrefix(lines[1], "node-a") || !strings.Contains(lines[2], "41C") {
+					t.Errorf("unexpected table: %q", output)
+				}
+			},
+		},
+		{
+			name: "JSON with matcher",
+			args: append(append([]string{}, base...), "-output", "json", "-match", "Hostname=node-b"),
+			check: func(t *testing.T, output string) {
+				var statuses []cmd.GpuStatus
+				if err := json.Unmarshal([]byte(output), &statuses); err != nil {
+					t.Fatalf("failed to decode output: %v", err)
+				}
+				if len(statuses) != 1 || statuses[0].UUID != "cli-uuid-2" {
+					t.Errorf("expected only node-b, got %+v", statuses)
+				}
+			},
+		},
+		{
+			name:          "Invalid output",
+			args:          append(append([]string{}, base...), "-output", "yaml"),
+			expectedError: "invalid output format: yaml",
+		},
+		{
+			name:          "Missing metric names",
+			args:          []string{"query", "-prometheus-url", server.URL},
+			expectedError: "metrics.names must list at least one metric",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			err := cmd.Execute(tt.args, &stdout, &stderr)
+			if tt.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+					t.Errorf("expected error containing %q, got %v", tt.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			tt.check(t, stdout.String())
+		})
+	}
+}
+
+func TestExecuteCommands(t *testing.T) {
+	clearConfigEnv(t)
+
+	tests := []struct {
+		name           string
+		args           []string
+		expectedOutput string
+		expectedError  string
+		expectUsage    bool
+	}{
+		{
+			name:           "Version",
+			args:           []string{"version"},
+			expectedOutput: "dcgm-metrics-api ",
+		},
+		{
+			name:           "Valid config",
+			args:           []string{"validate-config", "-config", writeConfig(t, "source:\n  type: simulate\nmetrics:\n  names: [DCGM_FI_DEV_GPU_TEMP]\n")},
+			expectedOutput: "is valid: simulate source, 1 metrics",
+		},
+		{
+			name:          "Invalid config",
+			args:          []string{"validate-config", "-config", writeConfig(t, "metrics:\n  names: [DCGM_FI_DEV_GPU_TEMP]\n")},
+			expectedError: "source.prometheus.urls or source.prometheus.backends is required",
+		},
+		{
+			name:        "Unknown command",
+			args:        []string{"status"},
+			expectUsage: true,
+		},
+		{
+			name:        "Unknown flag",
+			args:        []string{"validate-config", "-verbose"},
+			expectUsage: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			err := cmd.Execute(tt.args, &stdout, &stderr)
+			switch {
+			case tt.expectUsage:
+				if !errors.Is(err, cmd.ErrUsage) || stderr.Len() == 0 {
+					t.Errorf("expected a usage error, got %v with output %q", err, stderr.String())
+				}
+			case tt.expectedError != "":
+				if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+					t.Errorf("expected error containing %q, got %v", tt.expectedError, err)
+				}
+			default:
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !strings.Contains(stdout.String(), tt.expectedOutput) {
+					t.Errorf("expected output containing %q, got %q", tt.expectedOutput, stdout.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
+)
+
+func TestClientRetries(t *testing.T) {
+	tests := []struct {
+		name           string
+		failures       int32
+		status         int
+		retryAfter     string
+		expectedStatus int
+		expectedHits   int32
+	}{
+		{
+			name:           "Success after 503 with Retry-After",
+			failures:       2,
+			status:         http.StatusServiceUnavailable,
+			retryAfter:     "0",
+			expectedStatus: http.StatusOK,
+			expectedHits:   3,
+		},
+		{
+			name:           "Success after 429 without Retry-After",
+			failures:       1,
+			status:         http.StatusTooManyRequests,
+			expectedStatus: http.StatusOK,
+			expectedHits:   2,
+		},
+		{
+			name:           "Retry-After longer than the max delay",
+			failures:       1,
+			status:         http.StatusServiceUnavailable,
+			retryAfter:     "3600",
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedHits:   1,
+		},
+		{
+			name:           "Retries exhausted",
+			failures:       10,
+			status:         http.StatusBadGateway,
+			expectedStatus: http.StatusBadGateway,
+			expectedHits:   3,
+		},
+		{
+			name:           "Client errors are not retried",
+			failures:       1,
+			status:         http.StatusBadRequest,
+			expectedStatus: http.StatusBadRequest,
+			expectedHits:   1,
+		},
+	}
+
+	config := cmd.DefaultClientConfig()
+	config.RetryBaseDelay = time.Millisecond
+	config.RetryMaxDelay = 10 * time.Millisecond
+	client, err := config.NewClient(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&hits, 1) <= tt.failures {
+					if tt.retryAfter != "" {
+						w.Header().Set("Retry-After", tt.retryAfter)
+					}
+					w.WriteHeader(tt.status)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+			if got := atomic.LoadInt32(&hits); got != tt.expectedHits {
+				t.Errorf("expected %d attempts, got %d", tt.expectedHits, got)
+			}
+		})
+	}
+}
+
+func TestClientRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	config := cmd.DefaultClientConfig()
+	config.RequestTimeout = 50 * time.Millisecond
+	client, err := config.NewClient(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	source := &cmd.PrometheusSource{URLs: []string{server.URL}, Client: client}
+	start := time.Now()
+	if err := source.HealthCheck(t.Context()); err == nil {
+		t.Error("expected error for a hung Prometheus")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the request to time out quickly, took %v", elapsed)
+	}
+}
@@ -0,0 +1,242 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
+)
+
+// writeConfig writes a config file into a temporary directory and returns its path
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	return path
+}
+
+// clearConfigEnv unsets the environment variables left behind by other tests
+func clearConfigEnv(t *testing.T) {
+	t.Helper()
+	for _, name := range []string{"PROMETHEUS_URL", "METRIC_NAMES", "METRICS_ENDPOINT", "METRICS_SOURCE", "EXPORTER_URLS", "CACHE_TTL"} {
+		t.Setenv(name, "")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	clearConfigEnv(t)
+
+	path := writeConfig(t, `
+server:
+  listen: ":9095"
+source:
+  prometheus:
+    urls: http://prom-a:9090,http://prom-b:9090
+    failover: random
+    selector: '{job="dcgm-exporter"}'
+  client:
+    request_timeout: 10s
+metrics:
+  names:
+    - DCGM_FI_DEV_GPU_TEMP
+    - DCGM_FI_DEV_GPU_UTIL
+  custom_fields:
+    avg_util: avg_over_time(DCGM_FI_DEV_GPU_UTIL[10m])
+cache:
+  ttl: 5s
+`)
+
+	cfg, err := cmd.LoadConfig(path, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Server.Listen != ":9095" {
+		t.Errorf("expected listen :9095, got %s", cfg.Server.Listen)
+	}
+	if cfg.Server.MetricsEndpoint != "/metrics" {
+		t.Errorf("expected the default metrics endpoint, got %s", cfg.Server.MetricsEndpoint)
+	}
+	if len(cfg.Source.Prometheus.URLs) != 2 {
+		t.Errorf("expected 2 Prometheus replicas, got %v", cfg.Source.Prometheus.URLs)
+	}
+	if cfg.Source.Client.RequestTimeout != 10*time.Second {
+		t.Errorf("expected request timeout 10s, got %v", cfg.Source.Client.RequestTimeout)
+	}
+	if cfg.Source.Client.MaxRetries != cmd.DefaultClientConfig().MaxRetries {
+		t.Errorf("expected the default max retries, got %d", cfg.Source.Client.MaxRetries)
+	}
+	if cfg.Cache.TTL != 5*time.Second {
+		t.Errorf("expected cache TTL 5s, got %v", cfg.Cache.TTL)
+	}
+
+	// Environment variables override the file, and flags override both
+	t.Setenv("METRICS_ENDPOINT", "/gpus")
+	t.Setenv("PROMETHEUS_URL", "http://prom-env:9090")
+	flags := &cmd.ConfigFlags{Listen: ":7000", MetricNames: "DCGM_FI_DEV_FB_FREE, DCGM_FI_DEV_FB_USED"}
+	cfg, err = cmd.LoadConfig(path, flags)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Server.MetricsEndpoint != "/gpus" {
+		t.Errorf("expected endpoint from the environment, got %s", cfg.Server.MetricsEndpoint)
+	}
+	if len(cfg.Source.Prometheus.URLs) != 1 || cfg.Source.Prometheus.URLs[0] != "http://prom-env:9090" {
+		t.Errorf("expected Prometheus URL from the environment, got %v", cfg.Source.Prometheus.URLs)
+	}
+	if cfg.Server.Listen != ":7000" {
+		t.Errorf("expected listen address from the flags, got %s", cfg.Server.Listen)
+	}
+	if len(cfg.Metrics.Names) != 2 || cfg.Metrics.Names[1] != "DCGM_FI_DEV_FB_USED" {
+		t.Errorf("expected metric names from the flags, got %v", cfg.Metrics.Names)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	clearConfigEnv(t)
+
+	tests := []struct {
+		name          string
+		config        string
+		expectedError string
+	}{
+		{
+			name:          "Unknown field",
+			config:        "server:\n  listen: \":8080\"\n  lisen: \":9090\"\n",
+			expectedError: "line 3: field lisen not found",
+		},
+		{
+			name:          "Missing metric names",
+			config:        "source:\n  prometheus:\n    urls: http://prom:9090\n",
+			expectedError: "metrics.names must list at least one metric",
+		},
+		{
+			name:          "Missing Prometheus URL",
+			config:        "metrics:\n  names: [DCGM_FI_DEV_GPU_TEMP]\n",
+			expectedError: "source.prometheus.urls or source.prometheus.backends is required",
+		},
+		{
+			name:          "Invalid source type",
+			config:        "source:\n  type: influx\nmetrics:\n  names: [DCGM_FI_DEV_GPU_TEMP]\n",
+			expectedError: `source.type must be prometheus, exporter, file or simulate: "influx"`,
+		},
+		{
+			name:          "Invalid duration",
+			config:        "cache:\n  ttl: soon\n",
+			expectedError: "line 2",
+		},
+		{
+			name:          "Invalid selector",
+			config:        "source:\n  prometheus:\n    urls: http://prom:9090\n    selector: '{job=dcgm}'\nmetrics:\n  names: [DCGM_FI_DEV_GPU_TEMP]\n",
+			expectedError: "source.prometheus.selector",
+		},
+		{
+			name:          "Invalid simulator",
+			config:        "source:\n  type: simulate\n  simulator:\n    pattern: spiky\nmetrics:\n  names: [DCGM_FI_DEV_GPU_TEMP]\n",
+			expectedError: "source.simulator: invalid pattern: spiky",
+		},
+		{
+			name:          "Custom field conflicting with a built-in field",
+			config:        "source:\n  type: simulate\nmetrics:\n  names: [DCGM_FI_DEV_GPU_TEMP]\n  custom_fields:\n    gpu_temp: max(DCGM_FI_DEV_GPU_TEMP)\n",
+			expectedError: "metrics.custom_fields: custom field gpu_temp conflicts with a built-in field",
+		},
+		{
+			name:          "Custom fields without Prometheus",
+			config:        "source:\n  type: simulate\nmetrics:\n  names: [DCGM_FI_DEV_GPU_TEMP]\n  custom_fields:\n    avg_util: avg_over_time(DCGM_FI_DEV_GPU_UTIL[10m])\n",
+			expectedError: "metrics.custom_fields: custom fields require the prometheus source, not simulate",
+		},
+		{
+			name:          "NVLink counter without Prometheus",
+			config:        "source:\n  type: simulate\nmetrics:\n  names: [DCGM_FI_DEV_NVLINK_BANDWIDTH_TOTAL]\n",
+			expectedError: "metrics.names[0]: DCGM_FI_DEV_NVLINK_BANDWIDTH_TOTAL is a counter, which only the prometheus source turns into a rate; use DCGM_FI_PROF_NVLINK_TX_BYTES and DCGM_FI_PROF_NVLINK_RX_BYTES instead",
+		},
+		{
+			name:          "API key without secret",
+			config:        "source:\n  type: simulate\nmetrics:\n  names: [DCGM_FI_DEV_GPU_TEMP]\nauth:\n  api_keys:\n    - id: ops\n",
+			expectedError: "auth: api key ops: key or key_sha256 is required",
+		},
+		{
+			name:          "JWT issuer without JWKS",
+			config:        "source:\n  type: simulate\nmetrics:\n  names: [DCGM_FI_DEV_GPU_TEMP]\nauth:\n  jwt:\n    issuer: https://idp.example.com\n",
+			expectedError: "auth: jwt: jwks_url or jwks_file is required",
+		},
+		{
+			name:          "Metrics endpoint taken by another route",
+			config:        "server:\n  metrics_endpoint: /health\nsource:\n  type: simulate\nmetrics:\n  names: [DCGM_FI_DEV_GPU_TEMP]\n",
+			expectedError: `server.metrics_endpoint "/health" is not usable`,
+		},
+		{
+			name:          "Metrics endpoint with a path parameter of another route",
+			config:        "server:\n  metrics_endpoint: /gpus/{uuid}\nsource:\n  type: simulate\nmetrics:\n  names: [DCGM_FI_DEV_GPU_TEMP]\n",
+			expectedError: `server.metrics_endpoint "/gpus/{uuid}" is not usable`,
+		},
+		{
+			name:          "Invalid metrics endpoint pattern",
+			config:        "server:\n  metrics_endpoint: /metrics {x\nsource:\n  type: simulate\nmetrics:\n  names: [DCGM_FI_DEV_GPU_TEMP]\n",
+			expectedError: `server.metrics_endpoint "/metrics {x" is not usable`,
+		},
+		{
+			name:          "Route rate limit without rate",
+			config:        "source:\n  type: simulate\nmetrics:\n  names: [DCGM_FI_DEV_GPU_TEMP]\nrate_limit:\n  routes:\n    - path: /metrics\n",
+			expectedError: "rate_limit: routes[0]: rate must be positive",
+		},
+		{
+			name:          "Route rate limit not a number",
+			config:        "source:\n  type: simulate\nmetrics:\n  names: [DCGM_FI_DEV_GPU_TEMP]\nrate_limit:\n  routes:\n    - path: /metrics\n      rate: .nan\n",
+			expectedError: "rate_limit: routes[0]: rate must be positive",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := cmd.LoadConfig(writeConfig(t, tt.config), nil)
+			if err == nil {
+				t.Fatal("expected error but got nil")
+			}
+			if !strings.Contains(err.Error(), tt.expectedError) {
+				t.Errorf("expected error containing %q, got %q", tt.expectedError, err.Error())
+			}
+		})
+	}
+}
+
+func TestCachingSource(t *testing.T) {
+	calls := 0
+	source := &countingSource{fakeSource: fakeSource{results: []cmd.Result{
+		throughputResult("DCGM_FI_DEV_GPU_TEMP", "node-a", "0", "cache-uuid", 1743982065, "40"),
+	}}, calls: &calls}
+	cached := &cmd.CachingSource{Source: source, TTL: time.Hour}
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if _, err := cached.FetchInstant(ctx, []string{"DCGM_FI_DEV_GPU_TEMP"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 fetch from the source, got %d", calls)
+	}
+
+	if _, err := cached.FetchInstant(ctx, []string{"DCGM_FI_DEV_GPU_UTIL"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("expected other metric names to be fetched, got %d fetches", calls)
+	}
+}
+
+// countingSource is a fakeSource counting instant fetches
+type countingSource struct {
+	fakeSource
+	calls *int
+}
+
+func (c *countingSource) FetchInstant(ctx context.Context, metricNames []string) ([]cmd.Result, error) {
+	*c.calls++
+	return c.fakeSource.FetchInstant(ctx, metricNames)
+}
@@ -0,0 +1,183 @@
+package tests
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
+)
+
+func TestParseCustomFields(t *testing.T) {
+	tests := []struct {
+		name          string
+		fields        string
+		expected      []string
+		expectedError bool
+	}{
+		{
+			name:     "Sorted by name",
+			fields:   "pcie_tx_rate: rate(DCGM_FI_PROF_PCIE_TX_BYTES[1m])\navg_util: avg_over_time(DCGM_FI_DEV_GPU_UTIL[10m])",
+			expected: []string{"avg_util", "pcie_tx_rate"},
+		},
+		{
+			name:          "Conflicts with a built-in field",
+			fields:        "gpu_temp: max_over_time(DCGM_FI_DEV_GPU_TEMP[5m])",
+			expectedError: true,
+		},
+		{
+			name:          "Invalid name",
+			fields:        "\"bad name\": up",
+			expectedError: true,
+		},
+		{
+			name:          "Empty query",
+			fields:        "avg_util: \"\"",
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, err := cmd.ParseCustomFields(tt.fields)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("expected error but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(fields) != len(tt.expected) {
+				t.Fatalf("expected %d fields, got %d", len(tt.expected), len(fields))
+			}
+			for i, name := range tt.expected {
+				if fields[i].Name != name {
+					t.Errorf("expected field %d to be %s, got %s", i, name, fields[i].Name)
+				}
+			}
+		})
+	}
+}
+
+func TestMetricsHandlerCustomFields(t *testing.T) {
+	responses := map[string][]cmd.Result{
+		"DCGM_FI_DEV_GPU_TEMP": {
+			throughputResult("DCGM_FI_DEV_GPU_TEMP", "node-a", "0", "custom-uuid-1", 1743982065, "40"),
+			throughputResult("DCGM_FI_DEV_GPU_TEMP", "node-a", "1", "custom-uuid-2", 1743982065, "45"),
+		},
+		"avg_over_time(DCGM_FI_DEV_GPU_UTIL[10m])": {
+			{Metric: map[string]string{"UUID": "custom-uuid-1"}, Value: []interface{}{1743982065.0, "37.5"}},
+			{Metric: map[string]string{"UUID": "unknown-uuid"}, Value: []interface{}{1743982065.0, "99"}},
+		},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		results, ok := responses[r.URL.Query().Get("query")]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"parse error"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(cmd.PrometheusResponse{
+			Status: "success",
+			Data:   cmd.PrometheusData{ResultType: "vector", Result: results},
+		})
+	}))
+	defer server.Close()
+
+	fields, err := cmd.ParseCustomFields("avg_util: avg_over_time(DCGM_FI_DEV_GPU_UTIL[10m])\nbroken: rate(")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	handlers := cmd.NewHandlers(&cmd.PrometheusSource{URLs: []string{server.URL}}, []string{"DCGM_FI_DEV_GPU_TEMP"})
+	handlers.CustomFields = fields
+
+	rr := httptest.NewRecorder()
+	handlers.Metrics(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var statuses []map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &statuses); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(statuses) != 2 {
+		t.Fatalf("expected 2 GPUs, got %d", len(statuses))
+	}
+	if got := statuses[0]["avg_util"]; got != 37.5 {
+		t.Errorf("expected avg_util 37.5 on the first GPU, got %v", got)
+	}
+	if _, ok := statuses[1]["avg_util"]; ok {
+		t.Error("expected no avg_util on a GPU without a matching series")
+	}
+
+	errors := rr.Header().Values("X-Custom-Field-Error")
+	if len(errors) != 1 {
+		t.Fatalf("expected 1 custom field error, got %v", errors)
+	}
+}
+
+func TestGpuStatusCustomFieldsJSON(t *testing.T) {
+	status := cmd.GpuStatus{
+		UUID:    "custom-uuid-1",
+		GPUTemp: 40,
+		Custom:  map[string]float64{"avg_util": 37.5, "power_per_util": math.NaN()},
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("failed to decode %s: %v", data, err)
+	}
+	if fields["avg_util"] != 37.5 {
+		t.Errorf("expected avg_util as a top-level field, got %s", data)
+	}
+	if _, ok := fields["Custom"]; ok {
+		t.Errorf("expected no Custom field, got %s", data)
+	}
+
+	// The encoder policies apply to the custom fields, also behind a pointer
+	enc := &cmd.JSONEncoder{Fields: map[string]cmd.NonFinitePolicy{"power_per_util": cmd.NonFiniteString}}
+	for _, v := range []interface{}{status, &status} {
+		encoded, err := enc.Marshal(v)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !strings.Contains(string(encoded), `"power_per_util":"NaN"`) {
+			t.Errorf("expected power_per_util as a NaN string, got %s", encoded)
+		}
+	}
+
+	// Only the configured custom fields are read back, including non-finite strings
+	var decoded cmd.GpuStatus
+	body := `{"uuid":"custom-uuid-1","gpu_temp":40,"modelName":"H100","avg_util":37.5,"power_per_util":"NaN","other":1}`
+	if err := json.Unmarshal([]byte(body), &decoded); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if decoded.UUID != "custom-uuid-1" || decoded.GPUTemp != 40 || decoded.Name != "H100" {
+		t.Errorf("expected the built-in fields to be decoded, got %+v", decoded)
+	}
+	if decoded.Custom != nil {
+		t.Errorf("expected no custom fields without their names, got %v", decoded.Custom)
+	}
+
+	customFields := []cmd.CustomField{{Name: "avg_util"}, {Name: "power_per_util"}, {Name: "missing"}}
+	if err := decoded.UnmarshalCustomFields([]byte(body), customFields); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(decoded.Custom) != 2 || decoded.Custom["avg_util"] != 37.5 || !math.IsNaN(decoded.Custom["power_per_util"]) {
+		t.Errorf("expected the configured custom fields to be decoded, got %v", decoded.Custom)
+	}
+
+	if err := decoded.UnmarshalCustomFields([]byte(`{"avg_util":"high"}`), customFields); err == nil {
+		t.Errorf("expected an error for a custom field that is not a number")
+	}
+}
@@ -0,0 +1,53 @@
+package tests
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
+)
+
+func TestEffectiveUtilization(t *testing.T) {
+	results := []cmd.Result{
+		// Profiled GPU saturating its tensor cores
+		throughputResult("DCGM_FI_PROF_SM_ACTIVE", "host-a", "0", "eff-uuid-1", 1743982065, "0.9"),
+		throughputResult("DCGM_FI_PROF_SM_OCCUPANCY", "host-a", "0", "eff-uuid-1", 1743982065, "0.6"),
+		throughputResult("DCGM_FI_PROF_PIPE_TENSOR_ACTIVE", "host-a", "0", "eff-uuid-1", 1743982065, "0.8"),
+		// Profiled GPU that is busy but barely occupied
+		throughputResult("DCGM_FI_PROF_SM_ACTIVE", "host-a", "1", "eff-uuid-2", 1743982065, "0.9"),
+		throughputResult("DCGM_FI_PROF_SM_OCCUPANCY", "host-a", "1", "eff-uuid-2", 1743982065, "0.05"),
+		throughputResult("DCGM_FI_DEV_GPU_UTIL", "host-a", "1", "eff-uuid-2", 1743982065, "100"),
+		// Only SM activity
+		throughputResult("DCGM_FI_PROF_SM_ACTIVE", "host-a", "2", "eff-uuid-5", 1743982065, "0.5"),
+		// Only graphics engine activity
+		throughputResult("DCGM_FI_PROF_GR_ENGINE_ACTIVE", "host-b", "0", "eff-uuid-3", 1743982065, "0.4"),
+		// Only coarse utilization
+		throughputResult("DCGM_FI_DEV_GPU_UTIL", "host-b", "1", "eff-uuid-4", 1743982065, "30"),
+	}
+
+	statuses, err := cmd.MergeGpuMetrics(results)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]float64{
+		"eff-uuid-1": 0.5*0.9 + 0.25*0.6 + 0.25*0.8,
+		"eff-uuid-2": (0.5*0.9 + 0.25*0.05) / 0.75,
+		"eff-uuid-5": 0.5,
+		"eff-uuid-3": 0.4,
+		"eff-uuid-4": 0.3,
+	}
+	for _, s := range statuses {
+		if diff := s.EffectiveUtil - expected[s.UUID]; diff > 1e-9 || diff < -1e-9 {
+			t.Errorf("expected effective utilization %v for %s, got %v", expected[s.UUID], s.UUID, s.EffectiveUtil)
+		}
+	}
+
+	sort.Sort(cmd.ByEffectiveUtilization(statuses))
+	order := []string{"eff-uuid-1", "eff-uuid-2", "eff-uuid-5", "eff-uuid-3", "eff-uuid-4"}
+	for i, uuid := range order {
+		if statuses[i].UUID != uuid {
+			t.Errorf("expected %s at position %d, got %s", uuid, i, statuses[i].UUID)
+		}
+	}
+}
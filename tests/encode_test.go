@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
+)
+
+func TestJSONEncoderNonFinite(t *testing.T) {
+	status := cmd.GpuStatus{
+		Hostname:    "node-a",
+		DeviceID:    "0",
+		UUID:        "nan-uuid",
+		GPUTemp:     math.NaN(),
+		GPUUtil:     math.Inf(1),
+		MemUtil:     math.Inf(-1),
+		NVLinkLinks: map[string]float64{"0": 1, "1": math.NaN()},
+	}
+
+	tests := []struct {
+		name     string
+		encoder  cmd.JSONEncoder
+		contains []string
+		excludes []string
+	}{
+		{
+			name:     "Null by default",
+			contains: []string{`"gpu_temp":null`, `"gpu_utilization":null`, `"gpu_memory_utilization":null`, `"1":null`},
+		},
+		{
+			name:     "String",
+			encoder:  cmd.JSONEncoder{Policy: cmd.NonFiniteString},
+			contains: []string{`"gpu_temp":"NaN"`, `"gpu_utilization":"+Inf"`, `"gpu_memory_utilization":"-Inf"`},
+		},
+		{
+			name:     "Drop",
+			encoder:  cmd.JSONEncoder{Policy: cmd.NonFiniteDrop},
+			contains: []string{`"nvlink_link_bytes_per_sec":{"0":1}`},
+			excludes: []string{`"gpu_temp"`, `"gpu_utilization"`, `"gpu_memory_utilization"`},
+		},
+		{
+			name: "Per-field overrides",
+			encoder: cmd.JSONEncoder{
+				Policy: cmd.NonFiniteDrop,
+				Fields: map[string]cmd.NonFinitePolicy{"gpu_temp": cmd.NonFiniteString, "gpu_utilization": cmd.NonFiniteNull},
+			},
+			contains: []string{`"gpu_temp":"NaN"`, `"gpu_utilization":null`},
+			excludes: []string{`"gpu_memory_utilization"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.encoder.Marshal([]cmd.GpuStatus{status})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !json.Valid(data) {
+				t.Fatalf("invalid JSON: %s", data)
+			}
+			for _, s := range tt.contains {
+				if !strings.Contains(string(data), s) {
+					t.Errorf("expected %s in %s", s, data)
+				}
+			}
+			for _, s := range tt.excludes {
+				if strings.Contains(string(data), s) {
+					t.Errorf("expected no %s in %s", s, data)
+				}
+			}
+		})
+	}
+
+	// Finite values are encoded exactly like encoding/json
+	finite := cmd.GpuStatus{
+		Hostname:        "node-a",
+		UUID:            "finite-uuid",
+		Timestamp:       time.Unix(1743982065, 0).UTC(),
+		GPUTemp:         41.5,
+		ThrottleReasons: []string{"sw_power_cap"},
+		NVLinkLinks:     map[string]float64{"1": 2e21, "0": 0.001},
+	}
+	expected, _ := json.Marshal(finite)
+	var encoder cmd.JSONEncoder
+	got, err := encoder.Marshal(finite)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(got) != string(expected) {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestMetricsHandlerNonFinite(t *testing.T) {
+	source := &fakeSource{results: []cmd.Result{
+		throughputResult("DCGM_FI_DEV_GPU_TEMP", "node-a", "0", "nan-uuid", 1743982065, "NaN"),
+		throughputResult("DCGM_FI_DEV_GPU_UTIL", "node-a", "0", "nan-uuid", 1743982065, "+Inf"),
+	}}
+	handlers := cmd.NewHandlers(source, []string{"DCGM_FI_DEV_GPU_TEMP", "DCGM_FI_DEV_GPU_UTIL"})
+
+	rr := httptest.NewRecorder()
+	handlers.Metrics(rr, httptest.NewRequest(http.MethodGet, "/metrics?sort=effective_utilization", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), `"gpu_temp":null`) {
+		t.Errorf("expected a null gpu_temp, got %s", rr.Body.String())
+	}
+
+	enc := &cmd.JSONEncoder{Fields: map[string]cmd.NonFinitePolicy{"gpu_temp": "bogus"}}
+	if err := enc.Validate(); err == nil {
+		t.Error("expected error for an unknown policy")
+	}
+}
@@ -0,0 +1,136 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
+)
+
+const exporterPayload = `# HELP DCGM_FI_DEV_GPU_TEMP GPU temperature (in C).
+# TYPE DCGM_FI_DEV_GPU_TEMP gauge
+DCGM_FI_DEV_GPU_TEMP{gpu="0",UUID="GPU-1234",device="nvidia0",modelName="NVIDIA A100",Hostname="gpu-node-1"} 42
+DCGM_FI_DEV_GPU_TEMP{gpu="1",UUID="GPU-5678",device="nvidia1",modelName="NVIDIA A100",Hostname="gpu-node-1"} 40
+# HELP DCGM_FI_DEV_GPU_UTIL GPU utilization (in %).
+# TYPE DCGM_FI_DEV_GPU_UTIL gauge
+DCGM_FI_DEV_GPU_UTIL{gpu="0",UUID="GPU-1234",device="nvidia0",modelName="NVIDIA A100",Hostname="gpu-node-1"} 87 1743982065253
+DCGM_FI_DEV_POWER_USAGE{gpu="0",UUID="GPU-1234",device="nvidia0",modelName="NVIDIA A100",Hostname="gpu-node-1"} 250.5
+`
+
+func TestParseExpositionFormat(t *testing.T) {
+	scrapeTime := time.Unix(1743982000, 0)
+
+	tests := []struct {
+		name          string
+		input         string
+		expectedCount int
+		expectedError bool
+	}{
+		{
+			name:          "Success: dcgm-exporter payload",
+			input:         exporterPayload,
+			expectedCount: 4,
+		},
+		{
+			name:          "Success: escaped label values",
+			input:         `metric{path="C:\\dir",quote="say \"hi\""} 1`,
+			expectedCount: 1,
+		},
+		{
+			name:          "Success: metric without labels",
+			input:         "up 1",
+			expectedCount: 1,
+		},
+		{
+			name:          "Error: unterminated label set",
+			input:         `metric{gpu="0" 1`,
+			expectedError: true,
+		},
+		{
+			name:          "Error: invalid value",
+			input:         `metric{gpu="0"} abc`,
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := cmd.ParseExpositionFormat(strings.NewReader(tt.input), scrapeTime)
+			if tt.expectedError {
+				if err == nil {
+					t.Errorf("expected error but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(results) != tt.expectedCount {
+				t.Errorf("expected %d results, got %d", tt.expectedCount, len(results))
+			}
+		})
+	}
+
+	results, err := cmd.ParseExpositionFormat(strings.NewReader(exporterPayload), scrapeTime)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if results[0].Metric["Hostname"] != "gpu-node-1" || results[0].Metric["__name__"] != "DCGM_FI_DEV_GPU_TEMP" {
+		t.Errorf("unexpected labels: %v", results[0].Metric)
+	}
+	ts, _ := results[0].GetTimestamp()
+	if !ts.Equal(scrapeTime) {
+		t.Errorf("expected scrape time %v, got %v", scrapeTime, ts)
+	}
+	ts, _ = results[2].GetTimestamp()
+	if ts.UnixMilli() != 1743982065253 {
+		t.Errorf("expected explicit timestamp, got %v", ts.UnixMilli())
+	}
+
+	escaped, _ := cmd.ParseExpositionFormat(strings.NewReader(`metric{path="C:\\dir",quote="say \"hi\""} 1`), scrapeTime)
+	if escaped[0].Metric["path"] != `C:\dir` || escaped[0].Metric["quote"] != `say "hi"` {
+		t.Errorf("unexpected unescaped labels: %v", escaped[0].Metric)
+	}
+}
+
+func TestMetricsHandlerExporterMode(t *testing.T) {
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte(exporterPayload))
+	}))
+	defer exporter.Close()
+
+	t.Setenv("PROMETHEUS_URL", "")
+	t.Setenv("EXPORTER_URLS", "- "+exporter.URL+"/metrics")
+	t.Setenv("METRIC_NAMES", "- DCGM_FI_DEV_GPU_TEMP\n- DCGM_FI_DEV_GPU_UTIL")
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	cmd.MetricsHandler(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	var statuses []cmd.GpuStatus
+	if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(statuses) != 2 {
+		t.Fatalf("expected 2 GPUs, got %d", len(statuses))
+	}
+	if statuses[0].GPUTemp != 42 || statuses[0].GPUUtil != 87 {
+		t.Errorf("unexpected values for first GPU: %+v", statuses[0])
+	}
+
+	w = httptest.NewRecorder()
+	cmd.ReadinessProbeHandler(w, httptest.NewRequest("GET", "/ready", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected readiness %d, got %d", http.StatusOK, w.Code)
+	}
+}
@@ -0,0 +1,162 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
+)
+
+// newCountingServer returns a server answering every request with status and counting the hits
+func newCountingServer(t *testing.T, status int, hits *int32) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		http.Error(w, http.StatusText(status), status)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPrometheusFailover(t *testing.T) {
+	healthy := newPrometheusServer(t,
+		throughputResult("DCGM_FI_DEV_GPU_TEMP", "node-a", "0", "failover-uuid", 1743982065, "40"),
+	)
+
+	var downHits int32
+	down := newCountingServer(t, http.StatusServiceUnavailable, &downHits)
+
+	results, err := cmd.FetchPrometheusMetrics(down.URL+","+healthy.URL, "- DCGM_FI_DEV_GPU_TEMP")
+	if err != nil {
+		t.Fatalf("expected failover to the healthy replica, got %v", err)
+	}
+	if len(results) != 1 {
+		t.Errorf("expected 1 result, got %d", len(results))
+	}
+
+	// Once the breaker is open, the failing replica is skipped
+	noRetries := cmd.DefaultClientConfig()
+	noRetries.MaxRetries = 0
+	client, err := noRetries.NewClient(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	atomic.StoreInt32(&downHits, 0)
+	source := &cmd.PrometheusSource{
+		URLs:             []string{down.URL, healthy.URL},
+		Client:           client,
+		BreakerThreshold: 1,
+		BreakerCooldown:  time.Minute,
+	}
+	ctx := context.Background()
+	metricNames := []string{"DCGM_FI_DEV_GPU_TEMP"}
+	for i := 0; i < 3; i++ {
+		if _, err := source.FetchInstant(ctx, metricNames); err != nil {
+			t.Fatalf("fetch %d: unexpected error: %v", i, err)
+		}
+	}
+	if hits := atomic.LoadInt32(&downHits); hits != 1 {
+		t.Errorf("expected the open breaker to stop queries to the failing replica, got %d hits", hits)
+	}
+	if err := source.HealthCheck(ctx); err != nil {
+		t.Errorf("expected healthy source with one replica up, got %v", err)
+	}
+
+	// Query errors are not retried on other replicas
+	var badHits, otherHits int32
+	bad := newCountingServer(t, http.StatusBadRequest, &badHits)
+	other := newCountingServer(t, http.StatusBadRequest, &otherHits)
+	if _, err := cmd.FetchPrometheusMetrics(bad.URL+","+other.URL, "- DCGM_FI_DEV_GPU_TEMP"); err == nil {
+		t.Error("expected error for a bad query")
+	}
+	if atomic.LoadInt32(&otherHits) != 0 {
+		t.Error("expected a bad query not to fail over")
+	}
+
+	// Every replica down
+	var otherDownHits int32
+	otherDown := newCountingServer(t, http.StatusBadGateway, &otherDownHits)
+	source = &cmd.PrometheusSource{URLs: []string{otherDown.URL, otherDown.URL + "/"}, Client: client}
+	if err := source.HealthCheck(ctx); err == nil {
+		t.Error("expected health check error when every replica is down")
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	healthy := newPrometheusServer(t,
+		throughputResult("DCGM_FI_DEV_GPU_TEMP", "node-a", "0", "half-open-uuid", 1743982065, "40"),
+	)
+
+	// The failing replica holds every query after the first until released
+	var downHits int32
+	release := make(chan struct{})
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&downHits, 1) > 1 {
+			<-release
+		}
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(down.Close)
+	var releaseOnce sync.Once
+	releaseProbe := func() { releaseOnce.Do(func() { close(release) }) }
+	defer releaseProbe()
+
+	noRetries := cmd.DefaultClientConfig()
+	noRetries.MaxRetries = 0
+	client, err := noRetries.NewClient(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	source := &cmd.PrometheusSource{
+		URLs:             []string{down.URL, healthy.URL},
+		Client:           client,
+		BreakerThreshold: 1,
+		BreakerCooldown:  50 * time.Millisecond,
+	}
+	ctx := context.Background()
+	metricNames := []string{"DCGM_FI_DEV_GPU_TEMP"}
+
+	if _, err := source.FetchInstant(ctx, metricNames); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	// After the cooldown a single probe reaches the failing replica, the others fail over
+	errs := make(chan error, 5)
+	for range 5 {
+		go func() {
+			_, err := source.FetchInstant(ctx, metricNames)
+			errs <- err
+		}()
+	}
+	for i := range 4 {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Errorf("fetch %d: unexpected error: %v", i, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the fetches without the probe to complete")
+		}
+	}
+	if hits := atomic.LoadInt32(&downHits); hits != 2 {
+		t.Errorf("expected a single probe of the failing replica, got %d queries", hits-1)
+	}
+
+	// The failed probe reopens the breaker
+	releaseProbe()
+	if err := <-errs; err != nil {
+		t.Errorf("expected the probe to fail over, got %v", err)
+	}
+	if _, err := source.FetchInstant(ctx, metricNames); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if hits := atomic.LoadInt32(&downHits); hits != 2 {
+		t.Errorf("expected the failed probe to reopen the breaker, got %d queries", hits)
+	}
+}
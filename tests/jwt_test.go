@@ -0,0 +1,444 @@
+package tests
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
+)
+
+// signJWT returns a token with the claims signed by key with RS256 or ES256
+func signJWT(t *testing.T, key crypto.Signer, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	segment := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("failed to encode token: %v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := segment(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatalf("failed to sign token: %v", err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatalf("failed to sign token: %v", err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// jwks encodes the public keys by key ID as a JSON Web Key Set
+func jwks(t *testing.T, keys map[string]crypto.Signer) []byte {
+	t.Helper()
+	b64 := base64.RawURLEncoding.EncodeToString
+	set := map[string][]map[string]string{"keys": {}}
+	for kid, key := range keys {
+		switch pub := key.Public().(type) {
+		case *rsa.PublicKey:
+			set["keys"] = append(set["keys"], map[string]string{
+				"kty": "RSA", "kid": kid, "use": "sig",
+				"n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case *ecdsa.PublicKey:
+			set["keys"] = append(set["keys"], map[string]string{
+				"kty": "EC", "kid": kid, "crv": "P-256",
+				"x": b64(pub.X.FillBytes(make([]byte, 32))), "y": b64(pub.Y.FillBytes(make([]byte, 32))),
+			})
+		}
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatalf("failed to encode JWKS: %v", err)
+	}
+	return data
+}
+
+func TestJWTAuthentication(t *testing.T) {
+	prom := newPrometheusServer(t,
+		podResult("node-a", "jwt-uuid-1", "ml", "train-0"),
+		podResult("node-b", "jwt-uuid-2", "ml", "train-1"),
+		podResult("node-b", "jwt-uuid-3", "web", "infer-0"),
+	)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	rotatedKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	// The issuer stand-in publishes the rotated key once the test is under way
+	var mu sync.Mutex
+	published := map[string]crypto.Signer{"rsa-1": rsaKey, "ec-1": ecKey}
+	issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Write(jwks(t, published))
+	}))
+	defer issuer.Close()
+
+	cfg := cmd.DefaultConfig()
+	cfg.Source.Prometheus.URLs = cmd.ParseReplicaURLs(prom.URL)
+	cfg.Metrics.Names = []string{"DCGM_FI_DEV_GPU_TEMP"}
+	cfg.Auth = cmd.APIAuthConfig{
+		APIKeys: []cmd.APIKey{{ID: "admin", Key: "admin-secret"}},
+		JWT: cmd.JWTConfig{
+			JWKSURL:         issuer.URL,
+			Issuer:          "https://idp.example.com",
+			Audience:        "dcgm-metrics-api",
+			AdminGroups:     []string{"gpu-admins"},
+			GroupNamespaces: map[string][]string{"ml-team": {"ml"}},
+		},
+	}
+	handler, err := cmd.NewServer(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	claims := func(sub string, extra map[string]any) map[string]any {
+		c := map[string]any{
+			"sub": sub,
+			"iss": "https://idp.example.com",
+			"aud": []string{"dcgm-metrics-api"},
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+	groups := func(names ...string) map[string]any { return map[string]any{"groups": names} }
+
+	tests := []struct {
+		name           string
+		token          string
+		rotate         bool
+		expectedStatus int
+		expectedGPUs   []string
+	}{
+		{
+			name:           "Admin group sees every GPU",
+			token:          signJWT(t, rsaKey, "RS256", "rsa-1", claims("alice", groups("gpu-admins"))),
+			expectedStatus: http.StatusOK,
+			expectedGPUs:   []string{"jwt-uuid-1", "jwt-uuid-2", "jwt-uuid-3"},
+		},
+		{
+			name:           "Namespaces claim",
+			token:          signJWT(t, ecKey, "ES256", "ec-1", claims("bob", map[string]any{"namespaces": "web"})),
+			expectedStatus: http.StatusOK,
+			expectedGPUs:   []string{"jwt-uuid-3"},
+		},
+		{
+			name:           "Namespaces of a group",
+			token:          signJWT(t, rsaKey, "RS256", "rsa-1", claims("carol", groups("ml-team", "readers"))),
+			expectedStatus: http.StatusOK,
+			expectedGPUs:   []string{"jwt-uuid-1", "jwt-uuid-2"},
+		},
+		{
+			name:           "Token without namespaces",
+			token:          signJWT(t, rsaKey, "RS256", "rsa-1", claims("dave", groups("readers"))),
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Expired token",
+			token:          signJWT(t, rsaKey, "RS256", "rsa-1", claims("alice", map[string]any{"groups": []string{"gpu-admins"}, "exp": time.Now().Add(-time.Hour).Unix()})),
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Other audience",
+			token:          signJWT(t, rsaKey, "RS256", "rsa-1", claims("alice", map[string]any{"groups": []string{"gpu-admins"}, "aud": "grafana"})),
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Signed by another key",
+			token:          signJWT(t, rotatedKey, "ES256", "ec-1", claims("mallory", groups("gpu-admins"))),
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Unsigned token",
+			token:          strings.Join(strings.Split(signJWT(t, rsaKey, "RS256", "rsa-1", claims("mallory", groups("gpu-admins"))), ".")[:2], ".") + ".",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Key rotated at the issuer",
+			token:          signJWT(t, rotatedKey, "ES256", "ec-2", claims("bob", map[string]any{"namespaces": []string{"web"}})),
+			rotate:         true,
+			expectedStatus: http.StatusOK,
+			expectedGPUs:   []string{"jwt-uuid-3"},
+		},
+		{
+			name:           "API key as bearer token",
+			token:          "admin-secret",
+			expectedStatus: http.StatusOK,
+			expectedGPUs:   []string{"jwt-uuid-1", "jwt-uuid-2", "jwt-uuid-3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.rotate {
+				mu.Lock()
+				published["ec-2"] = rotatedKey
+				mu.Unlock()
+			}
+
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/metrics", nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+			if tt.expectedGPUs == nil {
+				return
+			}
+
+			var statuses []cmd.GpuStatus
+			if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			var uuids []string
+			for _, s := range statuses {
+				uuids = append(uuids, s.UUID)
+			}
+			sort.Strings(uuids)
+			if strings.Join(uuids, ",") != strings.Join(tt.expectedGPUs, ",") {
+				t.Errorf("expected GPUs %v, got %v", tt.expectedGPUs, uuids)
+			}
+		})
+	}
+
+	// Tenants are limited to the data endpoints; admins may call every endpoint
+	tenant := signJWT(t, rsaKey, "RS256", "rsa-1", claims("carol", groups("ml-team")))
+	admin := signJWT(t, rsaKey, "RS256", "rsa-1", claims("alice", groups("gpu-admins")))
+	endpoints := []struct {
+		method         string
+		path           string
+		token          string
+		expectedStatus int
+	}{
+		{method: http.MethodPost, path: "/admin/reload", token: tenant, expectedStatus: http.StatusForbidden},
+		{method: http.MethodGet, path: "/admin/config", token: tenant, expectedStatus: http.StatusForbidden},
+		{method: http.MethodGet, path: "/simulator/metrics", token: tenant, expectedStatus: http.StatusForbidden},
+		{method: http.MethodGet, path: "/hosts/node-a", token: tenant, expectedStatus: http.StatusOK},
+		{method: http.MethodGet, path: "/throttling", token: tenant, expectedStatus: http.StatusOK},
+		{method: http.MethodGet, path: "/admin/config", token: admin, expectedStatus: http.StatusOK},
+	}
+	for _, tt := range endpoints {
+		req, err := http.NewRequest(tt.method, server.URL+tt.path, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.expectedStatus {
+			t.Errorf("%s %s: expected status %d, got %d", tt.method, tt.path, tt.expectedStatus, resp.StatusCode)
+		}
+	}
+}
+
+func TestJWTIssuerUnavailable(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	var hits int32
+	issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		time.Sleep(20 * time.Millisecond)
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer issuer.Close()
+
+	cfg := cmd.DefaultConfig()
+	cfg.Source.Type = cmd.SourceSimulate
+	cfg.Metrics.Names = []string{"DCGM_FI_DEV_GPU_TEMP"}
+	cfg.Auth.JWT = cmd.JWTConfig{JWKSURL: issuer.URL, AdminGroups: []string{"gpu-admins"}}
+	handler, err := cmd.NewServer(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Until the keys could be fetched once, the issuer is not queried again for every request
+	token := signJWT(t, key, "ES256", "ec-1", map[string]any{
+		"sub": "alice", "groups": []string{"gpu-admins"}, "exp": time.Now().Add(time.Hour).Unix(),
+	})
+	get := func() {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusInternalServerError {
+			t.Errorf("expected status 500 while the issuer is down, got %d", rec.Code)
+		}
+	}
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get()
+		}()
+	}
+	wg.Wait()
+	attempts := int32(cmd.DefaultClientConfig().MaxRetries + 1)
+	if n := atomic.LoadInt32(&hits); n != attempts {
+		t.Errorf("expected a single JWKS fetch of %d attempts, got %d requests", attempts, n)
+	}
+	for range 10 {
+		get()
+	}
+	if n := atomic.LoadInt32(&hits); n != attempts {
+		t.Errorf("expected no JWKS fetch within the backoff, got %d requests", n-attempts)
+	}
+}
+
+func TestJWTFromJWKSFile(t *testing.T) {
+	prom := newPrometheusServer(t,
+		podResult("node-a", "file-uuid-1", "ml", "train-0"),
+		podResult("node-a", "file-uuid-2", "web", "infer-0"),
+	)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksFile, jwks(t, map[string]crypto.Signer{"ec-1": key}), 0o600); err != nil {
+		t.Fatalf("failed to write JWKS file: %v", err)
+	}
+
+	clearConfigEnv(t)
+	t.Setenv("PROMETHEUS_URL", prom.URL)
+	t.Setenv("METRIC_NAMES", "- DCGM_FI_DEV_GPU_TEMP")
+	t.Setenv("JWT_JWKS_FILE", jwksFile)
+	t.Setenv("JWT_NAMESPACES_CLAIM", "kubernetes.namespaces")
+	cfg, err := cmd.LoadConfig("", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	handler, err := cmd.NewServer(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	token := signJWT(t, key, "ES256", "ec-1", map[string]any{
+		"sub":        "notebook",
+		"exp":        time.Now().Add(time.Hour).Unix(),
+		"kubernetes": map[string]any{"namespaces": []string{"ml"}},
+	})
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var statuses []cmd.GpuStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &statuses); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(statuses) != 1 || statuses[0].UUID != "file-uuid-1" {
+		t.Errorf("expected only the GPU of namespace ml, got %+v", statuses)
+	}
+
+	// A broken edit of the file keeps the previous keys and is logged once
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	if err := os.WriteFile(jwksFile, []byte(`{"keys": [`), 0o600); err != nil {
+		t.Fatalf("failed to write JWKS file: %v", err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(jwksFile, later, later); err != nil {
+		t.Fatalf("failed to set the modification time: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("request %d: expected status 200 with the previous keys, got %d: %s", i, rec.Code, rec.Body.String())
+		}
+	}
+	if count := strings.Count(logs.String(), "invalid JWKS file"); count != 1 {
+		t.Errorf("expected the broken file to be logged once, got %d times: %q", count, logs.String())
+	}
+}
+
+func TestJWTConfigValidate(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        cmd.JWTConfig
+		expectedError string
+	}{
+		{name: "Disabled", config: cmd.JWTConfig{}},
+		{name: "JWKS URL", config: cmd.JWTConfig{JWKSURL: "https://idp.example.com/keys", AdminGroups: []string{"admins"}}},
+		{name: "Both JWKS sources", config: cmd.JWTConfig{JWKSURL: "https://idp.example.com/keys", JWKSFile: "jwks.json"}, expectedError: "jwks_url and jwks_file are mutually exclusive"},
+		{name: "Settings without JWKS", config: cmd.JWTConfig{Issuer: "https://idp.example.com"}, expectedError: "jwks_url or jwks_file is required"},
+		{name: "Invalid JWKS URL", config: cmd.JWTConfig{JWKSURL: "idp.example.com/keys"}, expectedError: "invalid jwks_url: idp.example.com/keys"},
+		{name: "Negative refresh interval", config: cmd.JWTConfig{JWKSFile: "jwks.json", JWKSRefreshInterval: -time.Second}, expectedError: "jwks_refresh_interval must not be negative"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.expectedError == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.expectedError {
+				t.Errorf("expected error %q, got %v", tt.expectedError, err)
+			}
+		})
+	}
+}
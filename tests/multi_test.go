@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
+)
+
+// newPrometheusServer returns a mock Prometheus answering every query with results
+func newPrometheusServer(t *testing.T, results ...cmd.Result) *httptest.Server {
+	t.Helper()
+	body, err := json.Marshal(cmd.PrometheusResponse{
+		Status: "success",
+		Data:   cmd.PrometheusData{ResultType: "vector", Result: results},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode mock response: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestMultiplePrometheusBackends(t *testing.T) {
+	prodA := newPrometheusServer(t,
+		throughputResult("DCGM_FI_DEV_GPU_TEMP", "node-a", "0", "multi-uuid-1", 1743982065, "40"),
+		throughputResult("DCGM_FI_DEV_GPU_TEMP", "node-shared", "0", "multi-uuid-shared", 1743982060, "50"),
+	)
+	prodB := newPrometheusServer(t,
+		throughputResult("DCGM_FI_DEV_GPU_TEMP", "node-b", "0", "multi-uuid-2", 1743982065, "41"),
+		throughputResult("DCGM_FI_DEV_GPU_TEMP", "node-shared", "0", "multi-uuid-shared", 1743982065, "55"),
+	)
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer broken.Close()
+
+	t.Setenv("METRICS_SOURCE", "")
+	t.Setenv("PROMETHEUS_URL", "")
+	t.Setenv("PROMETHEUS_BACKENDS", "prod-a: "+prodA.URL+"\nprod-b: "+prodB.URL+"\nstaging: "+broken.URL)
+	t.Setenv("METRIC_NAMES", "- DCGM_FI_DEV_GPU_TEMP")
+
+	w := httptest.NewRecorder()
+	cmd.MetricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if errs := resp.Header.Values("X-Backend-Error"); len(errs) != 1 || !strings.HasPrefix(errs[0], "staging: ") {
+		t.Errorf("expected the staging backend error, got %v", errs)
+	}
+
+	var statuses []cmd.GpuStatus
+	if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(statuses) != 3 {
+		t.Fatalf("expected 3 GPUs after de-duplication, got %d", len(statuses))
+	}
+
+	clusters := map[string]string{}
+	for _, s := range statuses {
+		clusters[s.UUID] = s.Cluster
+		if s.UUID == "multi-uuid-shared" && s.GPUTemp != 55 {
+			t.Errorf("expected the newest sample of the shared GPU, got %v", s.GPUTemp)
+		}
+	}
+	if clusters["multi-uuid-1"] != "prod-a" || clusters["multi-uuid-2"] != "prod-b" {
+		t.Errorf("unexpected cluster tags: %v", clusters)
+	}
+
+	w = httptest.NewRecorder()
+	cmd.ReadinessProbeHandler(w, httptest.NewRequest("GET", "/ready", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected readiness %d with one backend down, got %d", http.StatusOK, w.Code)
+	}
+
+	t.Setenv("PROMETHEUS_BACKENDS", "staging: "+broken.URL)
+	w = httptest.NewRecorder()
+	cmd.MetricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d when every backend fails, got %d", http.StatusInternalServerError, w.Code)
+	}
+}
+
+func TestMultiSourceClusterLabelClash(t *testing.T) {
+	result := throughputResult("DCGM_FI_DEV_GPU_TEMP", "node-a", "0", "clash-uuid-1", 1743982065, "40")
+	result.Metric["cluster"] = "rack-7"
+	source := &cmd.MultiSource{Backends: []cmd.NamedSource{
+		{Name: "prod-a", Source: &fakeSource{results: []cmd.Result{result}}},
+	}}
+
+	results, err := source.FetchInstant(context.Background(), []string{"DCGM_FI_DEV_GPU_TEMP"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(results))
+	}
+	if cluster := results[0].Metric["cluster"]; cluster != "prod-a" {
+		t.Errorf("expected cluster prod-a, got %q", cluster)
+	}
+	if exported := results[0].Metric["exported_cluster"]; exported != "rack-7" {
+		t.Errorf("expected exported_cluster rack-7, got %q", exported)
+	}
+	if result.Metric["cluster"] != "rack-7" {
+		t.Errorf("expected the backend result to be left unchanged, got %v", result.Metric)
+	}
+}
@@ -0,0 +1,156 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
+)
+
+func TestPrometheusResultTypes(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		expectedCount int
+		expectedValue float64
+		expectedError bool
+	}{
+		{
+			name:          "Vector",
+			body:          `{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1743982065,"1"]}]}`,
+			expectedCount: 1,
+			expectedValue: 1,
+		},
+		{
+			name:          "Matrix uses the latest sample",
+			body:          `{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[1743982005,"3"],[1743982065,"4"]]}]}`,
+			expectedCount: 1,
+			expectedValue: 4,
+		},
+		{
+			name:          "Scalar",
+			body:          `{"resultType":"scalar","result":[1743982065,"42"]}`,
+			expectedCount: 1,
+			expectedValue: 42,
+		},
+		{
+			name:          "String",
+			body:          `{"resultType":"string","result":[1743982065,"hello"]}`,
+			expectedCount: 1,
+		},
+		{
+			name:          "Unknown result type",
+			body:          `{"resultType":"histogram","result":[]}`,
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var data cmd.PrometheusData
+			err := json.Unmarshal([]byte(tt.body), &data)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("expected error but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(data.Result) != tt.expectedCount {
+				t.Fatalf("expected %d results, got %d", tt.expectedCount, len(data.Result))
+			}
+			if ts, err := data.Result[0].GetTimestamp(); err != nil || ts.Unix() != 1743982065 {
+				t.Errorf("expected timestamp 1743982065, got %v (%v)", ts, err)
+			}
+			if tt.expectedValue != 0 {
+				if value, err := data.Result[0].GetValue(); err != nil || value != tt.expectedValue {
+					t.Errorf("expected value %v, got %v (%v)", tt.expectedValue, value, err)
+				}
+			}
+		})
+	}
+}
+
+func TestPrometheusErrorsAndWarnings(t *testing.T) {
+	tests := []struct {
+		name             string
+		status           int
+		body             string
+		expectedStatus   int
+		expectedWarnings []string
+	}{
+		{
+			name:           "Bad data",
+			status:         http.StatusBadRequest,
+			body:           `{"status":"error","errorType":"bad_data","error":"parse error"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Execution error",
+			status:         http.StatusUnprocessableEntity,
+			body:           `{"status":"error","errorType":"execution","error":"many-to-many matching not allowed"}`,
+			expectedStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:           "Timeout",
+			status:         http.StatusServiceUnavailable,
+			body:           `{"status":"error","errorType":"timeout","error":"query timed out"}`,
+			expectedStatus: http.StatusGatewayTimeout,
+		},
+		{
+			name:           "Plain error body",
+			status:         http.StatusInternalServerError,
+			body:           `oops`,
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name:   "Success with warnings",
+			status: http.StatusOK,
+			body: `{"status":"success","warnings":["result truncated"],"data":{"resultType":"vector","result":[
+				{"metric":{"__name__":"DCGM_FI_DEV_GPU_TEMP","Hostname":"node-a","gpu":"0","UUID":"warn-uuid"},"value":[1743982065,"40"]}]}}`,
+			expectedStatus:   http.StatusOK,
+			expectedWarnings: []string{"result truncated"},
+		},
+	}
+
+	noRetries := cmd.DefaultClientConfig()
+	noRetries.MaxRetries = 0
+	client, err := noRetries.NewClient(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			source := &cmd.PrometheusSource{URLs: []string{server.URL}, Client: client}
+			handlers := cmd.NewHandlers(source, []string{"DCGM_FI_DEV_GPU_TEMP"})
+
+			rr := httptest.NewRecorder()
+			handlers.Metrics(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			warnings := rr.Header().Values("X-Prometheus-Warning")
+			if len(warnings) != len(tt.expectedWarnings) {
+				t.Fatalf("expected warnings %v, got %v", tt.expectedWarnings, warnings)
+			}
+			for i, warning := range tt.expectedWarnings {
+				if warnings[i] != warning {
+					t.Errorf("expected warning %q, got %q", warning, warnings[i])
+				}
+			}
+		})
+	}
+}
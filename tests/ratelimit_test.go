@@ -0,0 +1,174 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
+)
+
+func TestRateLimit(t *testing.T) {
+	cfg := cmd.DefaultConfig()
+	cfg.Source.Type = cmd.SourceSimulate
+	cfg.Metrics.Names = []string{"DCGM_FI_DEV_GPU_TEMP"}
+	cfg.Auth.APIKeys = []cmd.APIKey{{ID: "notebook", Key: "notebook-secret"}, {ID: "grafana", Key: "grafana-secret"}}
+	cfg.RateLimit = cmd.RateLimitConfig{
+		Rate:   20,
+		Burst:  2,
+		Routes: []cmd.RouteRateLimit{{Path: "/hosts", Rate: 100, Burst: 10}},
+	}
+	handler, err := cmd.NewServer(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	get := func(path, key, remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = remote
+		if key != "" {
+			req.Header.Set(cmd.APIKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The notebook uses its burst, then is limited on every route without a limit of its own
+	for i := range 2 {
+		if rec := get("/metrics", "notebook-secret", "10.0.0.1:1000"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: expected status 200, got %d", i, rec.Code)
+		}
+	}
+	rec := get("/throttling", "notebook-secret", "10.0.0.1:1000")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", rec.Code)
+	}
+	if retryAfter := rec.Header().Get("Retry-After"); retryAfter != "1" {
+		t.Errorf("expected Retry-After 1, got %q", retryAfter)
+	}
+	var errResp cmd.ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &errResp); err != nil || errResp.Error != "rate limit exceeded, retry in 1s" {
+		t.Errorf("expected a JSON rate limit error, got %q", rec.Body.String())
+	}
+
+	// Other keys, even from the same address, routes with their own limit and probes are unaffected
+	for i := range 2 {
+		if rec := get("/metrics", "grafana-secret", "10.0.0.1:1000"); rec.Code != http.StatusOK {
+			t.Errorf("request %d: expected another key to have its own bucket, got %d", i, rec.Code)
+		}
+	}
+	if rec := get("/hosts", "notebook-secret", "10.0.0.1:1000"); rec.Code != http.StatusOK {
+		t.Errorf("expected the route limit to apply to /hosts, got %d", rec.Code)
+	}
+	if rec := get("/health", "", "10.0.0.1:1000"); rec.Code != http.StatusOK {
+		t.Errorf("expected probes not to be limited, got %d", rec.Code)
+	}
+
+	// Tokens are refilled at the rate
+	time.Sleep(60 * time.Millisecond)
+	if rec := get("/metrics", "notebook-secret", "10.0.0.1:1000"); rec.Code != http.StatusOK {
+		t.Errorf("expected a token after waiting, got %d", rec.Code)
+	}
+}
+
+func TestRateLimitByAddress(t *testing.T) {
+	cfg := cmd.DefaultConfig()
+	cfg.Source.Type = cmd.SourceSimulate
+	cfg.Metrics.Names = []string{"DCGM_FI_DEV_GPU_TEMP"}
+	cfg.RateLimit = cmd.RateLimitConfig{Rate: 0.5}
+	handler, err := cmd.NewServer(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		remote         string
+		expectedStatus int
+		retryAfter     string
+	}{
+		{remote: "10.0.0.1:1000", expectedStatus: http.StatusOK},
+		{remote: "10.0.0.1:2000", expectedStatus: http.StatusTooManyRequests, retryAfter: "2"},
+		{remote: "10.0.0.2:1000", expectedStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.RemoteAddr = tt.remote
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tt.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", tt.remote, tt.expectedStatus, rec.Code)
+		}
+		if retryAfter := rec.Header().Get("Retry-After"); retryAfter != tt.retryAfter {
+			t.Errorf("%s: expected Retry-After %q, got %q", tt.remote, tt.retryAfter, retryAfter)
+		}
+	}
+}
+
+func TestRateLimitBeforeAuthentication(t *testing.T) {
+	cfg := cmd.DefaultConfig()
+	cfg.Source.Type = cmd.SourceSimulate
+	cfg.Metrics.Names = []string{"DCGM_FI_DEV_GPU_TEMP"}
+	cfg.Auth.APIKeys = []cmd.APIKey{{ID: "notebook", Key: "notebook-secret"}}
+	cfg.RateLimit = cmd.RateLimitConfig{Rate: 0.5, Burst: 2}
+	handler, err := cmd.NewServer(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Guessed keys use up the bucket of the address, which valid keys do not
+	tests := []struct {
+		key            string
+		expectedStatus int
+	}{
+		{key: "notebook-secret", expectedStatus: http.StatusOK},
+		{key: "guess-1", expectedStatus: http.StatusUnauthorized},
+		{key: "guess-2", expectedStatus: http.StatusUnauthorized},
+		{key: "guess-3", expectedStatus: http.StatusTooManyRequests},
+		{key: "notebook-secret", expectedStatus: http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.RemoteAddr = "10.0.0.1:1000"
+		req.Header.Set(cmd.APIKeyHeader, tt.key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tt.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", tt.key, tt.expectedStatus, rec.Code)
+		}
+	}
+}
+
+func TestRateLimitSurvivesReload(t *testing.T) {
+	cfg := cmd.DefaultConfig()
+	cfg.Source.Type = cmd.SourceSimulate
+	cfg.Metrics.Names = []string{"DCGM_FI_DEV_GPU_TEMP"}
+	cfg.RateLimit = cmd.RateLimitConfig{Rate: 0.5}
+	handler, err := cmd.NewServer(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	serve := func(method, path, remote string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := serve(http.MethodGet, "/metrics", "10.0.0.1:1000"); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if code := serve(http.MethodPost, "/admin/reload", "10.0.0.9:1000"); code != http.StatusOK {
+		t.Fatalf("expected the reload to succeed, got %d", code)
+	}
+	if code := serve(http.MethodGet, "/metrics", "10.0.0.1:1000"); code != http.StatusTooManyRequests {
+		t.Errorf("expected the bucket to be kept across the reload, got %d", code)
+	}
+}
@@ -0,0 +1,217 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
+)
+
+const reloadConfig = `
+source:
+  type: simulate
+  simulator:
+    hosts: 1
+    gpus_per_host: 1
+metrics:
+  names: [%s]
+`
+
+func TestReloader(t *testing.T) {
+	clearConfigEnv(t)
+
+	path := writeConfig(t, strings.Replace(reloadConfig, "%s", "DCGM_FI_DEV_GPU_TEMP", 1))
+	r, err := cmd.NewReloader(path, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	initial := r.Handlers()
+	if len(initial.MetricNames) != 1 {
+		t.Fatalf("expected 1 metric name, got %v", initial.MetricNames)
+	}
+
+	// A valid change swaps in new handlers; the old ones stay usable
+	if err := os.WriteFile(path, []byte(strings.Replace(reloadConfig, "%s", "DCGM_FI_DEV_GPU_TEMP, DCGM_FI_DEV_GPU_UTIL", 1)), 0o600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(r.Handlers().MetricNames) != 2 {
+		t.Errorf("expected 2 metric names after reload, got %v", r.Handlers().MetricNames)
+	}
+	if len(initial.MetricNames) != 1 {
+		t.Errorf("expected the previous handlers to be unchanged, got %v", initial.MetricNames)
+	}
+
+	// An invalid change is rejected and the current handlers are kept
+	if err := os.WriteFile(path, []byte("metrics:\n  names: []\n"), 0o600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Fatal("expected error but got nil")
+	}
+	if len(r.Handlers().MetricNames) != 2 {
+		t.Errorf("expected the handlers to be kept after a failed reload, got %v", r.Handlers().MetricNames)
+	}
+
+	status := r.Status()
+	if status.Success || !strings.Contains(status.Error, "source.prometheus.urls") {
+		t.Errorf("expected a failed status naming the missing setting, got %+v", status)
+	}
+	if status.Reloads != 1 {
+		t.Errorf("expected 1 successful reload, got %d", status.Reloads)
+	}
+}
+
+func TestReloadKeepsServerSettings(t *testing.T) {
+	clearConfigEnv(t)
+
+	withEndpoint := func(endpoint, metric string) string {
+		return "server:\n  metrics_endpoint: " + endpoint + "\n" + strings.Replace(reloadConfig, "%s", metric, 1)
+	}
+	path := writeConfig(t, withEndpoint("/gpu-metrics", "DCGM_FI_DEV_GPU_TEMP"))
+	r, err := cmd.NewReloader(path, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The routes are registered at startup, so a new endpoint waits for a restart
+	// while the other settings are applied
+	if err := os.WriteFile(path, []byte(withEndpoint("/other-metrics", "DCGM_FI_DEV_GPU_UTIL")), 0o600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if endpoint := r.Config().Server.MetricsEndpoint; endpoint != "/gpu-metrics" {
+		t.Errorf("expected the running metrics endpoint to be kept, got %s", endpoint)
+	}
+	if names := r.Handlers().MetricNames; len(names) != 1 || names[0] != "DCGM_FI_DEV_GPU_UTIL" {
+		t.Errorf("expected the new metric names, got %v", names)
+	}
+}
+
+func TestReloaderWatch(t *testing.T) {
+	clearConfigEnv(t)
+
+	path := writeConfig(t, strings.Replace(reloadConfig, "%s", "DCGM_FI_DEV_GPU_TEMP", 1))
+	r, err := cmd.NewReloader(path, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, 10*time.Millisecond)
+
+	if err := os.WriteFile(path, []byte(strings.Replace(reloadConfig, "%s", "DCGM_FI_DEV_FB_FREE, DCGM_FI_DEV_FB_USED", 1)), 0o600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(r.Handlers().MetricNames) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the config file change to be picked up, got %v", r.Handlers().MetricNames)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// An invalid file is attempted once, not on every tick until it changes
+	if err := os.WriteFile(path, []byte("metrics:\n  names: []\n"), 0o600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for r.Status().Success {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the invalid config file to be attempted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	attempt := r.Status().LastAttempt
+	time.Sleep(50 * time.Millisecond)
+	if last := r.Status().LastAttempt; !last.Equal(attempt) {
+		t.Errorf("expected the invalid config file not to be retried, last attempt moved from %v to %v", attempt, last)
+	}
+}
+
+func TestReloadHandlers(t *testing.T) {
+	clearConfigEnv(t)
+
+	path := writeConfig(t, strings.Replace(reloadConfig, "%s", "DCGM_FI_DEV_GPU_TEMP", 1))
+	r, err := cmd.NewReloader(path, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		handler        http.HandlerFunc
+		config         string
+		expectedStatus int
+		expectSuccess  bool
+	}{
+		{
+			name:           "Status",
+			method:         http.MethodGet,
+			handler:        r.ConfigStatus,
+			expectedStatus: http.StatusOK,
+			expectSuccess:  true,
+		},
+		{
+			name:           "Reload",
+			method:         http.MethodPost,
+			handler:        r.ReloadConfig,
+			config:         strings.Replace(reloadConfig, "%s", "DCGM_FI_DEV_GPU_UTIL", 1),
+			expectedStatus: http.StatusOK,
+			expectSuccess:  true,
+		},
+		{
+			name:           "Reload invalid config",
+			method:         http.MethodPost,
+			handler:        r.ReloadConfig,
+			config:         "server:\n  lisen: \":9090\"\n",
+			expectedStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:           "Reload with GET",
+			method:         http.MethodGet,
+			handler:        r.ReloadConfig,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.config != "" {
+				if err := os.WriteFile(path, []byte(tt.config), 0o600); err != nil {
+					t.Fatalf("failed to write config file: %v", err)
+				}
+			}
+
+			rr := httptest.NewRecorder()
+			tt.handler(rr, httptest.NewRequest(tt.method, "/admin", nil))
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !tt.expectSuccess {
+				return
+			}
+
+			var status cmd.ReloadStatus
+			if err := json.NewDecoder(rr.Body).Decode(&status); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if !status.Success || status.ConfigFile != path {
+				t.Errorf("unexpected status: %+v", status)
+			}
+		})
+	}
+}
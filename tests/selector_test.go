@@ -0,0 +1,189 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
+)
+
+func TestInjectMatchers(t *testing.T) {
+	matchers, err := cmd.ParseSelector(`{cluster="prod", job="dcgm-exporter"}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{
+			name:     "Metric name",
+			query:    "DCGM_FI_DEV_GPU_TEMP",
+			expected: `DCGM_FI_DEV_GPU_TEMP{cluster="prod",job="dcgm-exporter"}`,
+		},
+		{
+			name:     "Existing matchers",
+			query:    `DCGM_FI_DEV_GPU_TEMP{Hostname="node-a"}`,
+			expected: `DCGM_FI_DEV_GPU_TEMP{Hostname="node-a",cluster="prod",job="dcgm-exporter"}`,
+		},
+		{
+			name:     "Range function",
+			query:    "rate(DCGM_FI_PROF_PCIE_TX_BYTES[1m])",
+			expected: `rate(DCGM_FI_PROF_PCIE_TX_BYTES{cluster="prod",job="dcgm-exporter"}[1m])`,
+		},
+		{
+			name:     "Aggregation with grouping",
+			query:    "avg by (UUID) (avg_over_time(DCGM_FI_DEV_GPU_UTIL[10m] offset 5m))",
+			expected: `avg by (UUID) (avg_over_time(DCGM_FI_DEV_GPU_UTIL{cluster="prod",job="dcgm-exporter"}[10m] offset 5m))`,
+		},
+		{
+			name:     "Binary operation with vector matching",
+			query:    `DCGM_FI_DEV_FB_USED / on(UUID) (DCGM_FI_DEV_FB_USED + DCGM_FI_DEV_FB_FREE) > 0.9`,
+			expected: `DCGM_FI_DEV_FB_USED{cluster="prod",job="dcgm-exporter"} / on(UUID) (DCGM_FI_DEV_FB_USED{cluster="prod",job="dcgm-exporter"} + DCGM_FI_DEV_FB_FREE{cluster="prod",job="dcgm-exporter"}) > 0.9`,
+		},
+		{
+			name:     "Selector without metric name",
+			query:    `{__name__=~"DCGM_FI_DEV_.*"}`,
+			expected: `{__name__=~"DCGM_FI_DEV_.*",cluster="prod",job="dcgm-exporter"}`,
+		},
+		{
+			name:     "String arguments are left alone",
+			query:    `label_replace(up, "dst", "$1", "src", "(.*)")`,
+			expected: `label_replace(up{cluster="prod",job="dcgm-exporter"}, "dst", "$1", "src", "(.*)")`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cmd.InjectMatchers(tt.query, matchers)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseMatcher(t *testing.T) {
+	tests := []struct {
+		name          string
+		matcher       string
+		expected      string
+		expectedError bool
+	}{
+		{name: "Equal", matcher: "Hostname=node-a", expected: `Hostname="node-a"`},
+		{name: "Regexp", matcher: "modelName=~H100.*", expected: `modelName=~"H100.*"`},
+		{name: "Not equal", matcher: "cluster!=dev", expected: `cluster!="dev"`},
+		{name: "Quotes are escaped", matcher: `Hostname=a"} or vector(1) #`, expected: `Hostname="a\"} or vector(1) #"`},
+		{name: "Invalid label name", matcher: `Host name=a`, expectedError: true},
+		{name: "Invalid regexp", matcher: "Hostname=~(", expectedError: true},
+		{name: "No operator", matcher: "Hostname", expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matcher, err := cmd.ParseMatcher(tt.matcher)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("expected error but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if matcher.String() != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, matcher.String())
+			}
+		})
+	}
+}
+
+func TestMetricsHandlerMatchers(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query().Get("query"))
+		json.NewEncoder(w).Encode(cmd.PrometheusResponse{
+			Status: "success",
+			Data: cmd.PrometheusData{ResultType: "vector", Result: []cmd.Result{
+				throughputResult("DCGM_FI_DEV_GPU_TEMP", "node-a", "0", "match-uuid-1", 1743982065, "40"),
+				throughputResult("DCGM_FI_DEV_GPU_TEMP", "node-b", "0", "match-uuid-2", 1743982065, "41"),
+			}},
+		})
+	}))
+	defer server.Close()
+
+	selector, err := cmd.ParseSelector(`{job="dcgm-exporter"}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	source := &cmd.PrometheusSource{URLs: []string{server.URL}, Selector: selector}
+	handlers := cmd.NewHandlers(source, []string{"DCGM_FI_DEV_GPU_TEMP"})
+
+	tests := []struct {
+		name           string
+		url            string
+		expectedStatus int
+		expectedQuery  string
+		expectedCount  int
+	}{
+		{
+			name:           "Base selector only",
+			url:            "/metrics",
+			expectedStatus: http.StatusOK,
+			expectedQuery:  `DCGM_FI_DEV_GPU_TEMP{job="dcgm-exporter"}`,
+			expectedCount:  2,
+		},
+		{
+			name:           "Per-request matcher",
+			url:            "/metrics?match=Hostname=node-b",
+			expectedStatus: http.StatusOK,
+			expectedQuery:  `DCGM_FI_DEV_GPU_TEMP{job="dcgm-exporter",Hostname="node-b"}`,
+			expectedCount:  1,
+		},
+		{
+			name:           "No matching GPU",
+			url:            "/metrics?match=Hostname=node-z",
+			expectedStatus: http.StatusOK,
+			expectedQuery:  `DCGM_FI_DEV_GPU_TEMP{job="dcgm-exporter",Hostname="node-z"}`,
+			expectedCount:  0,
+		},
+		{
+			name:           "Invalid matcher",
+			url:            "/metrics?match=bad",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queries = nil
+			rr := httptest.NewRecorder()
+			handlers.Metrics(rr, httptest.NewRequest(http.MethodGet, tt.url, nil))
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+			if len(queries) != 1 || queries[0] != tt.expectedQuery {
+				t.Errorf("expected query %s, got %v", tt.expectedQuery, queries)
+			}
+
+			var statuses []cmd.GpuStatus
+			if err := json.Unmarshal(rr.Body.Bytes(), &statuses); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if len(statuses) != tt.expectedCount {
+				t.Errorf("expected %d GPUs, got %d", tt.expectedCount, len(statuses))
+			}
+		})
+	}
+}
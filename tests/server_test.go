@@ -0,0 +1,167 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
+)
+
+// newTestServer creates an API server backed by a fake Prometheus
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	prom := newPrometheusServer(t,
+		throughputResult("DCGM_FI_DEV_GPU_TEMP", "node-a", "0", "server-uuid-1", 1743982065, "40"),
+		throughputResult("DCGM_FI_DEV_GPU_TEMP", "node-a", "1", "server-uuid-2", 1743982065, "41"),
+		throughputResult("DCGM_FI_DEV_GPU_TEMP", "node-b", "0", "server-uuid-3", 1743982065, "42"),
+	)
+
+	cfg := cmd.DefaultConfig()
+	cfg.Source.Prometheus.URLs = cmd.ParseReplicaURLs(prom.URL)
+	cfg.Metrics.Names = []string{"DCGM_FI_DEV_GPU_TEMP"}
+	handler, err := cmd.NewServer(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestNewServer(t *testing.T) {
+	server := newTestServer(t)
+	// Servers have their own routes, so several can run in one process
+	newTestServer(t)
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		expectedStatus int
+		expectedError  string
+		expectedAllow  string
+		check          func(t *testing.T, body []byte)
+	}{
+		{
+			name:           "All GPUs",
+			method:         http.MethodGet,
+			path:           "/metrics",
+			expectedStatus: http.StatusOK,
+			check: func(t *testing.T, body []byte) {
+				var statuses []cmd.GpuStatus
+				if err := json.Unmarshal(body, &statuses); err != nil || len(statuses) != 3 {
+					t.Errorf("expected 3 GPUs, got %s", body)
+				}
+			},
+		},
+		{
+			name:           "GPU by UUID",
+			method:         http.MethodGet,
+			path:           "/gpus/server-uuid-2",
+			expectedStatus: http.StatusOK,
+			check: func(t *testing.T, body []byte) {
+				var status cmd.GpuStatus
+				if err := json.Unmarshal(body, &status); err != nil || status.DeviceID != "1" || status.GPUTemp != 41 {
+					t.Errorf("expected GPU 1 of node-a, got %s", body)
+				}
+			},
+		},
+		{
+			name:           "Unknown GPU",
+			method:         http.MethodGet,
+			path:           "/gpus/missing",
+			expectedStatus: http.StatusNotFound,
+			expectedError:  "GPU not found: missing",
+		},
+		{
+			name:           "Host by name",
+			method:         http.MethodGet,
+			path:           "/hosts/node-a",
+			expectedStatus: http.StatusOK,
+			check: func(t *testing.T, body []byte) {
+				var summary cmd.HostSummary
+				if err := json.Unmarshal(body, &summary); err != nil || summary.GPUCount != 2 {
+					t.Errorf("expected 2 GPUs on node-a, got %s", body)
+				}
+			},
+		},
+		{
+			name:           "Unknown host",
+			method:         http.MethodGet,
+			path:           "/hosts/node-z",
+			expectedStatus: http.StatusNotFound,
+			expectedError:  "host not found: node-z",
+		},
+		{
+			name:           "Wrong method",
+			method:         http.MethodPost,
+			path:           "/metrics",
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedError:  "method not allowed",
+			expectedAllow:  "GET, HEAD",
+		},
+		{
+			name:           "Unknown path",
+			method:         http.MethodGet,
+			path:           "/unknown",
+			expectedStatus: http.StatusNotFound,
+			expectedError:  "not found",
+		},
+		{
+			name:           "Simulator metrics outside simulate mode",
+			method:         http.MethodGet,
+			path:           "/simulator/metrics",
+			expectedStatus: http.StatusNotFound,
+			expectedError:  "not found",
+		},
+		{
+			name:           "Reload",
+			method:         http.MethodPost,
+			path:           "/admin/reload",
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, server.URL+tt.path, nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+			if tt.expectedAllow != "" && resp.Header.Get("Allow") != tt.expectedAllow {
+				t.Errorf("expected Allow %q, got %q", tt.expectedAllow, resp.Header.Get("Allow"))
+			}
+
+			if tt.expectedError != "" {
+				var errorResponse cmd.ErrorResponse
+				if err := json.NewDecoder(resp.Body).Decode(&errorResponse); err != nil {
+					t.Fatalf("failed to decode error response: %v", err)
+				}
+				if errorResponse.Error != tt.expectedError {
+					t.Errorf("expected error %q, got %q", tt.expectedError, errorResponse.Error)
+				}
+				return
+			}
+
+			if tt.check != nil {
+				var body json.RawMessage
+				if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+					t.Fatalf("failed to decode response: %v", err)
+				}
+				tt.check(t, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
+)
+
+var simulatedMetricNames = []string{
+	"DCGM_FI_DEV_GPU_TEMP",
+	"DCGM_FI_DEV_FB_FREE",
+	"DCGM_FI_DEV_FB_USED",
+	"DCGM_FI_DEV_GPU_UTIL",
+	"DCGM_FI_DEV_CLOCK_THROTTLE_REASONS",
+	"DCGM_FI_DEV_XID_ERRORS",
+}
+
+func TestSimulatorSource(t *testing.T) {
+	sim := &cmd.SimulatorSource{
+		Hosts:        3,
+		GPUsPerHost:  4,
+		Models:       []string{"NVIDIA A100-SXM4-80GB", "NVIDIA H100 80GB HBM3"},
+		Pattern:      cmd.PatternMixed,
+		ThrottleRate: 1,
+		Seed:         42,
+	}
+	ctx := context.Background()
+
+	results, err := sim.FetchInstant(ctx, simulatedMetricNames)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 3*4*len(simulatedMetricNames) {
+		t.Errorf("expected %d results, got %d", 3*4*len(simulatedMetricNames), len(results))
+	}
+
+	statuses, err := cmd.MergeGpuMetrics(results)
+	if err != nil {
+		t.Fatalf("unexpected merge error: %v", err)
+	}
+	if len(statuses) != 12 {
+		t.Fatalf("expected 12 GPUs, got %d", len(statuses))
+	}
+	if statuses[0].Name != "NVIDIA A100-SXM4-80GB" || statuses[4].Name != "NVIDIA H100 80GB HBM3" {
+		t.Errorf("unexpected model mix: %s, %s", statuses[0].Name, statuses[4].Name)
+	}
+	if len(cmd.ThrottledGpus(statuses)) != 12 {
+		t.Errorf("expected every GPU to be throttled with a throttle rate of 1")
+	}
+
+	// The same seed yields the same fleet
+	again, _ := (&cmd.SimulatorSource{Hosts: 3, GPUsPerHost: 4, Seed: 42}).FetchInstant(ctx, simulatedMetricNames)
+	if again[0].Metric["UUID"] != results[0].Metric["UUID"] {
+		t.Errorf("expected deterministic UUIDs, got %s and %s", again[0].Metric["UUID"], results[0].Metric["UUID"])
+	}
+
+	end := time.Now()
+	ranged, err := sim.FetchRange(ctx, []string{"DCGM_FI_DEV_GPU_UTIL"}, end.Add(-10*time.Minute), end, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected range error: %v", err)
+	}
+	if len(ranged) != 12 || len(ranged[0].Values) != 11 {
+		t.Errorf("expected 12 series with 11 samples, got %d series", len(ranged))
+	}
+}
+
+func TestSimulatorExposition(t *testing.T) {
+	sim := &cmd.SimulatorSource{Hosts: 2, GPUsPerHost: 2, Pattern: cmd.PatternIdle}
+
+	w := httptest.NewRecorder()
+	sim.ServeHTTP(w, httptest.NewRequest("GET", "/simulator/metrics", nil))
+
+	results, err := cmd.ParseExpositionFormat(w.Body, time.Now())
+	if err != nil {
+		t.Fatalf("failed to parse exposition: %v", err)
+	}
+
+	statuses, err := cmd.MergeGpuMetrics(results)
+	if err != nil {
+		t.Fatalf("unexpected merge error: %v", err)
+	}
+	if len(statuses) != 4 {
+		t.Errorf("expected 4 GPUs, got %d", len(statuses))
+	}
+	for _, s := range statuses {
+		if s.GPUUtil > 3 {
+			t.Errorf("expected idle GPU, got utilization %v", s.GPUUtil)
+		}
+	}
+}
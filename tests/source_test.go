@@ -0,0 +1,198 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
+)
+
+// fakeSource is an in-memory MetricSource
+type fakeSource struct {
+	results []cmd.Result
+	err     error
+}
+
+func (f *fakeSource) FetchInstant(ctx context.Context, metricNames []string) ([]cmd.Result, error) {
+	return f.results, f.err
+}
+
+func (f *fakeSource) FetchRange(ctx context.Context, metricNames []string, start, end time.Time, step time.Duration) ([]cmd.Result, error) {
+	return f.results, f.err
+}
+
+func (f *fakeSource) HealthCheck(ctx context.Context) error {
+	return f.err
+}
+
+func TestHandlersWithSource(t *testing.T) {
+	tests := []struct {
+		name           string
+		source         *fakeSource
+		expectedStatus int
+		expectedCount  int
+	}{
+		{
+			name: "Success",
+			source: &fakeSource{results: []cmd.Result{
+				throughputResult("DCGM_FI_DEV_GPU_TEMP", "host-a", "0", "src-uuid-1", 1743982065, "40"),
+				throughputResult("DCGM_FI_DEV_GPU_TEMP", "host-a", "1", "src-uuid-2", 1743982065, "41"),
+			}},
+			expectedStatus: http.StatusOK,
+			expectedCount:  2,
+		},
+		{
+			name:           "Source error",
+			source:         &fakeSource{err: errors.New("source unavailable")},
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := cmd.NewHandlers(tt.source, []string{"DCGM_FI_DEV_GPU_TEMP"})
+
+			w := httptest.NewRecorder()
+			h.Metrics(w, httptest.NewRequest("GET", "/metrics", nil))
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if tt.expectedStatus == http.StatusOK {
+				var statuses []cmd.GpuStatus
+				if err := json.NewDecoder(w.Body).Decode(&statuses); err != nil {
+					t.Fatalf("failed to decode response: %v", err)
+				}
+				if len(statuses) != tt.expectedCount {
+					t.Errorf("expected %d GPUs, got %d", tt.expectedCount, len(statuses))
+				}
+			}
+
+			w = httptest.NewRecorder()
+			h.Ready(w, httptest.NewRequest("GET", "/ready", nil))
+			expectedReady := http.StatusOK
+			if tt.source.err != nil {
+				expectedReady = http.StatusServiceUnavailable
+			}
+			if w.Code != expectedReady {
+				t.Errorf("expected readiness %d, got %d", expectedReady, w.Code)
+			}
+		})
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	source := &cmd.FileSource{Path: "metrics.json"}
+	ctx := context.Background()
+
+	if err := source.HealthCheck(ctx); err != nil {
+		t.Fatalf("unexpected health check error: %v", err)
+	}
+
+	results, err := source.FetchInstant(ctx, []string{"DCGM_FI_DEV_GPU_TEMP"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 2 {
+		t.Errorf("expected 2 results, got %d", len(results))
+	}
+
+	ranged, err := source.FetchRange(ctx, []string{"DCGM_FI_DEV_GPU_TEMP"},
+		time.Unix(1743982000, 0), time.Unix(1743982100, 0), time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected range error: %v", err)
+	}
+	if len(ranged) != 2 || len(ranged[0].Values) != 1 {
+		t.Errorf("expected 2 series with one sample each, got %+v", ranged)
+	}
+
+	if _, err := source.FetchRange(ctx, []string{"DCGM_FI_DEV_GPU_TEMP"},
+		time.Unix(0, 0), time.Unix(100, 0), time.Minute); err == nil {
+		t.Error("expected error for a range without samples")
+	}
+
+	missing := &cmd.FileSource{Path: "missing.json"}
+	if err := missing.HealthCheck(ctx); err == nil {
+		t.Error("expected health check error for a missing file")
+	}
+}
+
+func writeSnapshot(t *testing.T, dir, name string, ts float64, temp string) {
+	t.Helper()
+	resp := cmd.PrometheusResponse{
+		Status: "success",
+		Data: cmd.PrometheusData{
+			ResultType: "vector",
+			Result: []cmd.Result{
+				throughputResult("DCGM_FI_DEV_GPU_TEMP", "host-a", "0", "replay-uuid", ts, temp),
+			},
+		},
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatalf("failed to encode snapshot: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+}
+
+func TestFileSourceDirectoryPlayback(t *testing.T) {
+	dir := t.TempDir()
+	writeSnapshot(t, dir, "20250407T000000.json", 1743984000, "40")
+	writeSnapshot(t, dir, "20250407T000100.json", 1743984060, "50")
+	ctx := context.Background()
+	metricNames := []string{"DCGM_FI_DEV_GPU_TEMP"}
+
+	source := &cmd.FileSource{Path: dir}
+	for i, expected := range []float64{40, 50, 40} {
+		results, err := source.FetchInstant(ctx, metricNames)
+		if err != nil {
+			t.Fatalf("fetch %d: unexpected error: %v", i, err)
+		}
+		value, _ := results[0].GetValue()
+		if value != expected {
+			t.Errorf("fetch %d: expected %v, got %v", i, expected, value)
+		}
+	}
+
+	ranged, err := source.FetchRange(ctx, metricNames, time.Unix(1743984000, 0), time.Unix(1743984060, 0), time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected range error: %v", err)
+	}
+	if len(ranged) != 1 || len(ranged[0].Values) != 2 {
+		t.Errorf("expected one series with two samples, got %+v", ranged)
+	}
+
+	// A request advances the playback once, and custom fields are not queried
+	handlers := cmd.NewHandlers(&cmd.FileSource{Path: dir}, metricNames)
+	handlers.CustomFields = []cmd.CustomField{{Name: "power_per_util", Query: "DCGM_FI_DEV_POWER_USAGE"}}
+	for i, expected := range []float64{40, 50, 40} {
+		report, err := handlers.Fetch(ctx, nil)
+		if err != nil {
+			t.Fatalf("request %d: unexpected error: %v", i, err)
+		}
+		if len(report.Statuses) != 1 || report.Statuses[0].GPUTemp != expected {
+			t.Errorf("request %d: expected temperature %v, got %+v", i, expected, report.Statuses)
+		}
+		if len(report.CustomFieldErrors) != 1 || report.CustomFieldErrors[0] != "power_per_util: "+cmd.ErrCustomFieldsUnsupported.Error() {
+			t.Errorf("request %d: expected the custom field to be unsupported, got %v", i, report.CustomFieldErrors)
+		}
+	}
+
+	rebased := &cmd.FileSource{Path: dir, Rebase: true}
+	results, err := rebased.FetchInstant(ctx, metricNames)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	timestamp, _ := results[0].GetTimestamp()
+	if time.Since(timestamp) > time.Minute {
+		t.Errorf("expected rebased timestamp, got %v", timestamp)
+	}
+}
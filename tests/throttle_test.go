@@ -0,0 +1,88 @@
+package tests
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
+)
+
+func TestDecodeThrottleReasons(t *testing.T) {
+	tests := []struct {
+		name     string
+		mask     uint64
+		expected []string
+	}{
+		{
+			name:     "No reasons",
+			mask:     0,
+			expected: nil,
+		},
+		{
+			name:     "Idle",
+			mask:     0x1,
+			expected: []string{"gpu_idle"},
+		},
+		{
+			name:     "Power cap and thermal",
+			mask:     0x4 | 0x20 | 0x40,
+			expected: []string{"sw_power_cap", "sw_thermal_slowdown", "hw_thermal_slowdown"},
+		},
+		{
+			name:     "Unknown bit",
+			mask:     0x8 | 0x400,
+			expected: []string{"hw_slowdown", "unknown_0x400"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reasons := cmd.DecodeThrottleReasons(tt.mask)
+			if !reflect.DeepEqual(reasons, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, reasons)
+			}
+		})
+	}
+}
+
+func TestThrottledGpus(t *testing.T) {
+	results := []cmd.Result{
+		{
+			Metric: map[string]string{
+				"__name__":  "DCGM_FI_DEV_CLOCK_THROTTLE_REASONS",
+				"Hostname":  "test-host",
+				"gpu":       "0",
+				"UUID":      "test-uuid-1",
+				"modelName": "Test GPU",
+			},
+			Value: []interface{}{1743982065.253, "1"},
+		},
+		{
+			Metric: map[string]string{
+				"__name__":  "DCGM_FI_DEV_CLOCKS_EVENT_REASONS",
+				"Hostname":  "test-host",
+				"gpu":       "1",
+				"UUID":      "test-uuid-2",
+				"modelName": "Test GPU",
+			},
+			Value: []interface{}{1743982065.253, "68"},
+		},
+	}
+
+	statuses, err := cmd.MergeGpuMetrics(results)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	reports := cmd.ThrottledGpus(statuses)
+	if len(reports) != 1 {
+		t.Fatalf("expected 1 throttled GPU, got %d", len(reports))
+	}
+	if reports[0].UUID != "test-uuid-2" {
+		t.Errorf("expected test-uuid-2 to be throttled, got %s", reports[0].UUID)
+	}
+	expected := []string{"sw_power_cap", "hw_thermal_slowdown"}
+	if !reflect.DeepEqual(reports[0].Reasons, expected) {
+		t.Errorf("expected reasons %v, got %v", expected, reports[0].Reasons)
+	}
+}
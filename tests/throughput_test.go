@@ -0,0 +1,133 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
+)
+
+func throughputResult(name, host, gpu, uuid string, ts float64, value string) cmd.Result {
+	return cmd.Result{
+		Metric: map[string]string{
+			"__name__":  name,
+			"Hostname":  host,
+			"gpu":       gpu,
+			"UUID":      uuid,
+			"modelName": "Test GPU",
+		},
+		Value: []interface{}{ts, value},
+	}
+}
+
+func TestMergeThroughputMetrics(t *testing.T) {
+	results := []cmd.Result{
+		throughputResult("DCGM_FI_PROF_PCIE_TX_BYTES", "host-a", "0", "tp-uuid-1", 1743982065, "1000"),
+		throughputResult("DCGM_FI_PROF_PCIE_RX_BYTES", "host-a", "0", "tp-uuid-1", 1743982065, "2000"),
+		throughputResult("DCGM_FI_PROF_NVLINK_TX_BYTES", "host-a", "0", "tp-uuid-1", 1743982065, "3000"),
+		throughputResult("DCGM_FI_DEV_PCIE_TX_THROUGHPUT", "host-a", "1", "tp-uuid-2", 1743982065, "2"),
+		throughputResult("DCGM_FI_PROF_NVLINK_TX_BYTES", "host-a", "1", "tp-uuid-2", 1743982065, "500"),
+		throughputResult("DCGM_FI_PROF_PCIE_TX_BYTES", "host-b", "0", "tp-uuid-3", 1743982065, "10"),
+	}
+
+	statuses, err := cmd.MergeGpuMetrics(results)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if statuses[0].PCIeTxBytes != 1000 || statuses[0].PCIeRxBytes != 2000 || statuses[0].NVLinkTxBytes != 3000 {
+		t.Errorf("unexpected throughput for first GPU: %+v", statuses[0])
+	}
+	if statuses[1].PCIeTxBytes != 2048 {
+		t.Errorf("expected KB/s throughput to be converted to 2048 bytes/sec, got %v", statuses[1].PCIeTxBytes)
+	}
+
+	summaries := cmd.SummarizeHosts(statuses)
+	if len(summaries) != 2 {
+		t.Fatalf("expected 2 hosts, got %d", len(summaries))
+	}
+	if summaries[0].Hostname != "host-a" || summaries[0].GPUCount != 2 {
+		t.Errorf("unexpected first host summary: %+v", summaries[0])
+	}
+	if summaries[0].PCIeTxBytes != 3048 || summaries[0].NVLinkTxBytes != 3500 {
+		t.Errorf("unexpected host-a totals: %+v", summaries[0])
+	}
+}
+
+func TestMergeNVLinkLinkRates(t *testing.T) {
+	statuses, err := cmd.MergeGpuMetrics([]cmd.Result{
+		throughputResult("DCGM_FI_DEV_NVLINK_BANDWIDTH_L0", "host-a", "0", "tp-link-uuid", 1743982000, "100"),
+		throughputResult("DCGM_FI_DEV_NVLINK_BANDWIDTH_L1", "host-a", "0", "tp-link-uuid", 1743982000, "50"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Rates in KiB/s, from the first query on
+	if rate := statuses[0].NVLinkLinks["L0"]; rate != 102400 {
+		t.Errorf("expected 102400 bytes/sec on L0, got %v", rate)
+	}
+
+	summaries := cmd.SummarizeHosts(statuses)
+	if summaries[0].NVLinkBytes != 153600 {
+		t.Errorf("expected per-link rates to be summed per host, got %v", summaries[0].NVLinkBytes)
+	}
+}
+
+func TestNVLinkCounterQueries(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		queries = append(queries, query)
+		// rate() drops the metric name
+		result := throughputResult("DCGM_FI_DEV_GPU_TEMP", "host-a", "0", "tp-rate-uuid", 1743982000, "10")
+		if strings.HasPrefix(query, "rate(") {
+			delete(result.Metric, "__name__")
+		}
+		json.NewEncoder(w).Encode(cmd.PrometheusResponse{
+			Status: "success",
+			Data:   cmd.PrometheusData{ResultType: "vector", Result: []cmd.Result{result}},
+		})
+	}))
+	defer server.Close()
+
+	source := &cmd.PrometheusSource{URLs: []string{server.URL}}
+	results, err := source.FetchInstant(context.Background(), []string{"DCGM_FI_DEV_GPU_TEMP", "DCGM_FI_DEV_NVLINK_BANDWIDTH_TOTAL"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"DCGM_FI_DEV_GPU_TEMP", "rate(DCGM_FI_DEV_NVLINK_BANDWIDTH_TOTAL[2m])"}
+	if strings.Join(queries, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected queries %v, got %v", expected, queries)
+	}
+
+	statuses, err := cmd.MergeGpuMetrics(results)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if statuses[0].NVLinkBytes != 10240 {
+		t.Errorf("expected 10240 bytes/sec of NVLink traffic, got %v", statuses[0].NVLinkBytes)
+	}
+}
+
+func TestNVLinkCountersRequirePrometheusFromEnv(t *testing.T) {
+	clearConfigEnv(t)
+	t.Setenv("METRICS_SOURCE", "simulate")
+	t.Setenv("METRIC_NAMES", "- DCGM_FI_DEV_GPU_TEMP\n- DCGM_FI_DEV_NVLINK_BANDWIDTH_TOTAL")
+
+	w := httptest.NewRecorder()
+	cmd.MetricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+	var errorResponse cmd.ErrorResponse
+	if err := json.NewDecoder(w.Body).Decode(&errorResponse); err != nil {
+		t.Fatalf("failed to decode error response: %v", err)
+	}
+	if !strings.Contains(errorResponse.Error, "metrics.names[1]: DCGM_FI_DEV_NVLINK_BANDWIDTH_TOTAL is a counter") {
+		t.Errorf("expected the NVLink counter to be rejected, got %q", errorResponse.Error)
+	}
+}
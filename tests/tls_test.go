@@ -0,0 +1,250 @@
+package tests
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
+)
+
+// testCA issues certificates for the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCA creates a self-signed CA
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a certificate and key signed by the CA to dir and returns their paths
+func (ca *testCA) issue(t *testing.T, dir, name string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to encode key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestServeTLS(t *testing.T) {
+	clearConfigEnv(t)
+
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(caFile, ca.pem, 0o600); err != nil {
+		t.Fatalf("failed to write CA file: %v", err)
+	}
+	certFile, keyFile := ca.issue(t, dir, "server", 10, x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, dir, "client", 20, x509.ExtKeyUsageClientAuth)
+
+	addr, probeAddr := freeAddress(t), freeAddress(t)
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("LISTEN_ADDRESS", addr)
+	t.Setenv("PROBE_LISTEN_ADDRESS", probeAddr)
+	t.Setenv("METRICS_SOURCE", "simulate")
+	t.Setenv("METRIC_NAMES", "- DCGM_FI_DEV_GPU_TEMP")
+	t.Setenv("TLS_CERT_FILE", certFile)
+	t.Setenv("TLS_KEY_FILE", keyFile)
+	t.Setenv("TLS_CLIENT_CA_FILE", caFile)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Run(ctx)
+	}()
+
+	// Probes are served in plaintext
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get("http://" + probeAddr + "/ready")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("probe listener did not become ready: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	resp, err := http.Get("http://" + probeAddr + "/metrics")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected only probes on the probe listener, got %d for /metrics", resp.StatusCode)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatalf("failed to load client certificate: %v", err)
+	}
+	get := func(certs []tls.Certificate) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certs},
+			DisableKeepAlives: true,
+		}}
+		return client.Get("https://" + addr + "/metrics")
+	}
+
+	// Clients must present a certificate signed by the client CA
+	resp, err = get([]tls.Certificate{cert})
+	if err != nil {
+		t.Fatalf("expected the client certificate to be accepted, got %v", err)
+	}
+	peerSerial := resp.TLS.PeerCertificates[0].SerialNumber.Int64()
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+	if peerSerial != 10 {
+		t.Errorf("expected the server certificate with serial 10, got %d", peerSerial)
+	}
+	if resp, err := get(nil); err == nil {
+		resp.Body.Close()
+		t.Error("expected a request without client certificate to be rejected")
+	}
+
+	// A rotated server certificate is served without a restart
+	ca.issue(t, dir, "server", 11, x509.ExtKeyUsageServerAuth)
+	future := time.Now().Add(time.Minute)
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.Chtimes(file, future, future); err != nil {
+			t.Fatalf("failed to touch %s: %v", file, err)
+		}
+	}
+	resp, err = get([]tls.Certificate{cert})
+	if err != nil {
+		t.Fatalf("request failed after rotation: %v", err)
+	}
+	resp.Body.Close()
+	if serial := resp.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 11 {
+		t.Errorf("expected the rotated certificate with serial 11, got %d", serial)
+	}
+
+	// Files caught mid-rotation keep the last good certificate and client CAs
+	later := future.Add(time.Minute)
+	for _, file := range []string{certFile, caFile} {
+		if err := os.WriteFile(file, []byte("-----BEGIN CERTIFICATE-----\n"), 0o600); err != nil {
+			t.Fatalf("failed to truncate %s: %v", file, err)
+		}
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatalf("failed to touch %s: %v", file, err)
+		}
+	}
+	resp, err = get([]tls.Certificate{cert})
+	if err != nil {
+		t.Fatalf("expected the previous certificate while the files are incomplete, got %v", err)
+	}
+	resp.Body.Close()
+	if serial := resp.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 11 {
+		t.Errorf("expected the previous certificate with serial 11, got %d", serial)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after shutdown")
+	}
+}
+
+func TestTLSConfigValidate(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        cmd.TLSConfig
+		expectedError string
+	}{
+		{name: "Disabled", config: cmd.TLSConfig{}},
+		{name: "mTLS", config: cmd.TLSConfig{CertFile: "tls.crt", KeyFile: "tls.key", ClientCAFile: "ca.crt", ClientAuth: cmd.ClientAuthOptional}},
+		{name: "Missing key", config: cmd.TLSConfig{CertFile: "tls.crt"}, expectedError: "cert_file and key_file must be set together"},
+		{name: "Client CA without certificate", config: cmd.TLSConfig{ClientCAFile: "ca.crt"}, expectedError: "client_ca_file requires cert_file and key_file"},
+		{name: "Client auth without CA", config: cmd.TLSConfig{CertFile: "tls.crt", KeyFile: "tls.key", ClientAuth: cmd.ClientAuthRequire}, expectedError: "client_auth requires client_ca_file"},
+		{name: "Invalid client auth", config: cmd.TLSConfig{CertFile: "tls.crt", KeyFile: "tls.key", ClientCAFile: "ca.crt", ClientAuth: "always"}, expectedError: `client_auth must be require or optional: "always"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.expectedError == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.expectedError {
+				t.Errorf("expected error %q, got %v", tt.expectedError, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/V01d42/dcgm-metrics-api/pkg/cmd"
+)
+
+func TestRenderTop(t *testing.T) {
+	data := []cmd.GpuStatus{
+		{Hostname: "node-a", DeviceID: "0", Name: "NVIDIA H100", GPUUtil: 20, MemUsed: 1000, MemTotal: 80000, GPUTemp: 40},
+		{Hostname: "node-b", DeviceID: "0", Name: "NVIDIA H100", GPUUtil: 95, MemUsed: 78000, MemTotal: 80000, GPUTemp: 80},
+		{Hostname: "node-a", DeviceID: "1", Name: "NVIDIA H100", GPUUtil: 75, MemUsed: 40000, MemTotal: 80000, GPUTemp: 90},
+	}
+	now := time.Date(2025, 4, 7, 9, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		sort          string
+		color         bool
+		expectedHosts []string
+		expected      []string
+	}{
+		{
+			name:          "Sorted by host",
+			sort:          cmd.TopSortHost,
+			expectedHosts: []string{"node-a  0", "node-a  1", "node-b  0"},
+			expected:      []string{"2025-04-07 09:00:00 - 3 GPUs on 2 hosts, average utilization 63%"},
+		},
+		{
+			name:          "Sorted by temperature",
+			sort:          cmd.TopSortTemp,
+			expectedHosts: []string{"node-a  1", "node-b  0", "node-a  0"},
+		},
+		{
+			name:          "Colored by thresholds",
+			sort:          cmd.TopSortUtil,
+			color:         true,
+			expectedHosts: []string{"node-b  0", "node-a  1", "node-a  0"},
+			// Utilization: critical, warning and normal
+			expected: []string{"\x1b[31m95%\x1b[0m", "\x1b[33m75%\x1b[0m", "\x1b[32m20%\x1b[0m"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := cmd.DefaultTopOptions()
+			opts.Sort = tt.sort
+			opts.Color = tt.color
+
+			var out bytes.Buffer
+			if err := cmd.RenderTop(&out, data, opts, now); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			lines := strings.Split(strings.TrimRight(out.String(), "\n"), "\n")
+			if len(lines) != 6 {
+				t.Fatalf("expected a summary, a blank line, a header and 3 rows, got %q", out.String())
+			}
+			for i, host := range tt.expectedHosts {
+				if !strings.HasPrefix(lines[3+i], host) {
+					t.Errorf("expected row %d to start with %q, got %q", i, host, lines[3+i])
+				}
+			}
+			for _, s := range tt.expected {
+				if !strings.Contains(out.String(), s) {
+					t.Errorf("expected output containing %q, got %q", s, out.String())
+				}
+			}
+			if !tt.color && strings.Contains(out.String(), "\x1b[") {
+				t.Errorf("expected no colors, got %q", out.String())
+			}
+		})
+	}
+}
+
+func TestThresholdsSet(t *testing.T) {
+	tests := []struct {
+		value         string
+		expected      cmd.Thresholds
+		expectedError string
+	}{
+		{value: "60, 80", expected: cmd.Thresholds{Warn: 60, Crit: 80}},
+		{value: "80", expectedError: "thresholds must be formatted as warn,crit"},
+		{value: "80,hot", expectedError: "invalid critical threshold"},
+		{value: "90,80", expectedError: "critical threshold 80 is below warning threshold 90"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			var th cmd.Thresholds
+			err := th.Set(tt.value)
+			if tt.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+					t.Errorf("expected error containing %q, got %v", tt.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if th != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, th)
+			}
+		})
+	}
+}
+
+func TestExecuteTopFromAPI(t *testing.T) {
+	var match []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		match = r.URL.Query()["match"]
+		json.NewEncoder(w).Encode([]cmd.GpuStatus{
+			{Hostname: "node-a", DeviceID: "0", Name: "NVIDIA H100", GPUUtil: 50, MemUsed: 1000, MemTotal: 80000, GPUTemp: 40},
+		})
+	}))
+	defer api.Close()
+
+	var stdout, stderr bytes.Buffer
+	err := cmd.Execute([]string{"top", "-api", api.URL + "/metrics", "-host", "node-.*", "-count", "1", "-no-color"}, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(match) != 1 || match[0] != "Hostname=~node-.*" {
+		t.Errorf("expected the host filter to be passed as a match parameter, got %v", match)
+	}
+	if !strings.Contains(stdout.String(), "1 GPUs on 1 hosts") || !strings.Contains(stdout.String(), "node-a") {
+		t.Errorf("unexpected output: %q", stdout.String())
+	}
+}